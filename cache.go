@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	cacheFileExt = ".xml"
+
+	// answers on today and later dates may change, they are kept for a short time
+	defaultCacheTTL = time.Hour
+)
+
+// Entry of the response cache.
+type CacheEntry struct {
+	URL      string
+	Size     int64
+	Modified time.Time
+}
+
+// 'ResponseCache' keeps raw server answers in files named after the hash of the query URL.
+// The first line of a file is the URL, the answer follows it. Answers received after
+// the requested dates never expire, answers on today and later dates expire after the TTL.
+type ResponseCache struct {
+	dir string
+	ttl time.Duration
+	now func() time.Time
+}
+
+// Creates a 'ResponseCache' instance in the directory.
+func newResponseCache(dir string) *ResponseCache {
+	return &ResponseCache{
+		dir: dir,
+		ttl: defaultCacheTTL,
+		now: time.Now,
+	}
+}
+
+// Returns the default cache directory.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "cbr_currencies")
+}
+
+// Returns the cached answer to the query, whose latest requested date is the given one,
+// and the time it was received.
+func (c *ResponseCache) Get(url string, latest time.Time) ([]byte, time.Time, bool) {
+	return c.read(url, func(received time.Time) bool {
+		return isFinalAnswer(latest, received) || c.now().Sub(received) <= c.ttl
+	})
+}
+
+// Returns the cached answer to the query if it was received within the TTL, and the time
+// it was received. Suits answers which don't depend on a date.
+func (c *ResponseCache) GetRecent(url string, ttl time.Duration) ([]byte, time.Time, bool) {
+	return c.read(url, func(received time.Time) bool {
+		return c.now().Sub(received) <= ttl
+	})
+}
+
+// Returns the cached answer to the query if it's fresh, and the time it was received.
+func (c *ResponseCache) read(url string, fresh func(received time.Time) bool) ([]byte, time.Time, bool) {
+	name := c.fileName(url)
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	if !fresh(info.ModTime()) {
+		return nil, time.Time{}, false
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	cachedURL, answer, found := bytes.Cut(data, []byte("\n"))
+	if !found || string(cachedURL) != url {
+		return nil, time.Time{}, false
+	}
+
+	return answer, info.ModTime(), true
+}
+
+// Saves the answer to the query.
+func (c *ResponseCache) Put(url string, answer []byte) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create the cache directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create a cache file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	w.WriteString(url)
+	w.WriteString("\n")
+	w.Write(answer)
+	if err = w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write a cache file: %v", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write a cache file: %v", err)
+	}
+	now := c.now()
+	if err = os.Chtimes(tmp.Name(), now, now); err != nil {
+		return fmt.Errorf("failed to write a cache file: %v", err)
+	}
+
+	if err = os.Rename(tmp.Name(), c.fileName(url)); err != nil {
+		return fmt.Errorf("failed to write a cache file: %v", err)
+	}
+	return nil
+}
+
+// Returns the cached entries sorted by URL.
+func (c *ResponseCache) Entries() ([]CacheEntry, error) {
+	names, err := filepath.Glob(filepath.Join(c.dir, "*"+cacheFileExt))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []CacheEntry{}
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		url, _ := bufio.NewReader(io.LimitReader(f, 4096)).ReadString('\n')
+		f.Close()
+
+		entries = append(entries, CacheEntry{
+			URL:      strings.TrimSpace(url),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].URL < entries[j].URL })
+
+	return entries, nil
+}
+
+// Removes all cached answers and returns their number.
+func (c *ResponseCache) Clear() (int, error) {
+	names, err := filepath.Glob(filepath.Join(c.dir, "*"+cacheFileExt))
+	if err != nil {
+		return 0, err
+	}
+
+	for i, name := range names {
+		if err = os.Remove(name); err != nil {
+			return i, fmt.Errorf("failed to remove a cache file: %v", err)
+		}
+	}
+	return len(names), nil
+}
+
+// Checks the answer on the date received at the given time never changes: the date
+// had passed by then.
+func isFinalAnswer(latest, received time.Time) bool {
+	day := time.Date(received.Year(), received.Month(), received.Day(), 0, 0, 0, 0, latest.Location())
+	return latest.Before(day)
+}
+
+func (c *ResponseCache) fileName(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+cacheFileExt)
+}
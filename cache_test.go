@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	cache := newResponseCache(t.TempDir())
+	now := time.Date(2023, 3, 10, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	past := time.Date(2023, 3, 9, 0, 0, 0, 0, time.UTC)
+	today := time.Date(2023, 3, 10, 0, 0, 0, 0, time.UTC)
+	const pastURL = "https://www.cbr.ru/scripts/XML_daily_eng.asp?date_req=09/03/2023"
+	const todayURL = "https://www.cbr.ru/scripts/XML_daily_eng.asp?date_req=10/03/2023"
+
+	if _, _, ok := cache.Get(pastURL, past); ok {
+		t.Fatalf("found an answer in the empty cache")
+	}
+
+	if err := cache.Put(pastURL, []byte("<?xml past")); err != nil {
+		t.Fatalf("failed to cache the answer: %v", err)
+	}
+	if err := cache.Put(todayURL, []byte("<?xml today")); err != nil {
+		t.Fatalf("failed to cache the answer: %v", err)
+	}
+
+	answer, received, ok := cache.Get(pastURL, past)
+	if !ok || string(answer) != "<?xml past" {
+		t.Fatalf("expected \"<?xml past\" got %q", answer)
+	}
+	if !received.Equal(now) {
+		t.Fatalf("expected %v got %v", now, received)
+	}
+	if answer, _, ok = cache.Get(todayURL, today); !ok || string(answer) != "<?xml today" {
+		t.Fatalf("expected \"<?xml today\" got %q", answer)
+	}
+
+	// a day later the answer on today has expired, the one on a past date has not
+	now = now.Add(24 * time.Hour)
+	if _, _, ok = cache.Get(todayURL, today); ok {
+		t.Fatalf("expected the answer on today expired")
+	}
+	if _, _, ok = cache.Get(pastURL, past); !ok {
+		t.Fatalf("expected the answer on a past date kept")
+	}
+
+	// an answer which doesn't depend on a date is kept for the given time
+	if _, _, ok = cache.GetRecent(pastURL, 48*time.Hour); !ok {
+		t.Fatalf("expected the answer received within 48h")
+	}
+	if _, _, ok = cache.GetRecent(pastURL, 12*time.Hour); ok {
+		t.Fatalf("expected the answer received more than 12h ago expired")
+	}
+
+	entries, err := cache.Entries()
+	if err != nil {
+		t.Fatalf("failed to read the cache: %v", err)
+	}
+	if len(entries) != 2 || entries[0].URL != pastURL || entries[1].URL != todayURL {
+		t.Fatalf("expected 2 entries got %v", entries)
+	}
+
+	count, err := cache.Clear()
+	if err != nil || count != 2 {
+		t.Fatalf("expected 2 answers removed got %d: %v", count, err)
+	}
+	if files, _ := os.ReadDir(cache.dir); len(files) != 0 {
+		t.Fatalf("expected an empty cache directory got %d files", len(files))
+	}
+}
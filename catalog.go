@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const catalogLink = "https://www.cbr.ru/scripts/XML_valFull.asp"
+
+// the catalog changes rarely, a cached one is used for a day
+const catalogCacheTTL = 24 * time.Hour
+
+// Reference data of a currency.
+type CurrencyInfo struct {
+	ID       string `json:"id,omitempty"` // internal CBR code, for example 'R01235'
+	NumCode  int    `json:"num_code"`
+	CharCode string `json:"char_code"`
+	Name     string `json:"name"`
+	RusName  string `json:"rus_name,omitempty"`
+}
+
+// Item of the CBR currency reference feed.
+type CatalogItem struct {
+	ID         string `xml:"ID,attr"`
+	Name       string
+	EngName    string
+	Nominal    int
+	ParentCode string
+	NumCode    string `xml:"ISO_Num_Code"`
+	CharCode   string `xml:"ISO_Char_Code"`
+}
+
+type CbrCatalogResult struct {
+	XMLName xml.Name      `xml:"Valuta"`
+	Items   []CatalogItem `xml:"Item"`
+}
+
+// Currencies used when the reference feed is unavailable.
+var builtinCurrencies = []CurrencyInfo{
+	{"R01010", 36, "AUD", "Australian Dollar", "Австралийский доллар"},
+	{"R01020A", 944, "AZN", "Azerbaijan Manat", "Азербайджанский манат"},
+	{"R01035", 826, "GBP", "British Pound Sterling", "Фунт стерлингов Соединенного королевства"},
+	{"R01060", 51, "AMD", "Armenia Dram", "Армянский драм"},
+	{"R01090B", 933, "BYN", "Belarussian Ruble", "Белорусский рубль"},
+	{"R01100", 975, "BGN", "Bulgarian lev", "Болгарский лев"},
+	{"R01115", 986, "BRL", "Brazil Real", "Бразильский реал"},
+	{"R01135", 348, "HUF", "Hungarian Forint", "Венгерский форинт"},
+	{"R01200", 344, "HKD", "Hong Kong Dollar", "Гонконгский доллар"},
+	{"R01215", 208, "DKK", "Danish Krone", "Датская крона"},
+	{"R01235", 840, "USD", "US Dollar", "Доллар США"},
+	{"R01239", 978, "EUR", "Euro", "Евро"},
+	{"R01270", 356, "INR", "Indian Rupee", "Индийская рупия"},
+	{"R01335", 398, "KZT", "Kazakhstan Tenge", "Казахстанский тенге"},
+	{"R01350", 124, "CAD", "Canadian Dollar", "Канадский доллар"},
+	{"R01370", 417, "KGS", "Kyrgyzstan Som", "Киргизский сом"},
+	{"R01375", 156, "CNY", "China Yuan", "Китайский юань"},
+	{"R01500", 498, "MDL", "Moldova Lei", "Молдавский лей"},
+	{"R01535", 578, "NOK", "Norwegian Krone", "Норвежская крона"},
+	{"R01565", 985, "PLN", "Polish Zloty", "Польский злотый"},
+	{"R01585F", 946, "RON", "Romanian Leu", "Румынский лей"},
+	{"R01589", 960, "XDR", "SDR", "СДР (специальные права заимствования)"},
+	{"R01625", 702, "SGD", "Singapore Dollar", "Сингапурский доллар"},
+	{"R01670", 972, "TJS", "Tajikistan Ruble", "Таджикский сомони"},
+	{"R01700J", 949, "TRY", "Turkish Lira", "Турецкая лира"},
+	{"R01710A", 934, "TMT", "New Turkmenistan Manat", "Новый туркменский манат"},
+	{"R01717", 860, "UZS", "Uzbekistan Sum", "Узбекский сум"},
+	{"R01720", 980, "UAH", "Ukrainian Hryvnia", "Украинская гривна"},
+	{"R01760", 203, "CZK", "Czech Koruna", "Чешская крона"},
+	{"R01770", 752, "SEK", "Swedish Krona", "Шведская крона"},
+	{"R01775", 756, "CHF", "Swiss Franc", "Швейцарский франк"},
+	{"R01810", 710, "ZAR", "S.African Rand", "Южноафриканский рэнд"},
+	{"R01815", 410, "KRW", "Won, Republic of Korea", "Вона Республики Корея"},
+	{"R01820", 392, "JPY", "Japanese Yen", "Японская иена"},
+}
+
+// 'CurrencyCatalog' holds the reference data of the currencies known to CBR.
+type CurrencyCatalog struct {
+	items map[string]CurrencyInfo // by char code
+	saved time.Time               // the time it was saved in a storage, zero if it wasn't
+}
+
+// Creates a 'CurrencyCatalog' instance from the list of currencies.
+func newCurrencyCatalog(items []CurrencyInfo) *CurrencyCatalog {
+	c := &CurrencyCatalog{items: make(map[string]CurrencyInfo, len(items))}
+	for _, item := range items {
+		c.items[item.CharCode] = item
+	}
+	return c
+}
+
+// Creates a 'CurrencyCatalog' instance from the built-in list of currencies.
+func newBuiltinCatalog() *CurrencyCatalog {
+	return newCurrencyCatalog(builtinCurrencies)
+}
+
+// Checks the currency code exists in the catalog.
+func (c *CurrencyCatalog) CodeExists(code string) bool {
+	_, exist := c.items[code]
+	return exist
+}
+
+// Finds the reference data of the currency by its code.
+func (c *CurrencyCatalog) Lookup(code string) (CurrencyInfo, bool) {
+	info, ok := c.items[code]
+	return info, ok
+}
+
+// Finds the reference data of the currency by its CBR identifier.
+func (c *CurrencyCatalog) LookupID(id string) (CurrencyInfo, bool) {
+	for _, item := range c.items {
+		if item.ID == id {
+			return item, true
+		}
+	}
+	return CurrencyInfo{}, false
+}
+
+// Returns the time the catalog was saved in the storage it's loaded from, zero if it
+// wasn't loaded from a storage.
+func (c *CurrencyCatalog) SavedAt() time.Time {
+	return c.saved
+}
+
+// Returns the number of currencies in the catalog.
+func (c *CurrencyCatalog) Len() int {
+	return len(c.items)
+}
+
+// Returns the currencies sorted by code.
+func (c *CurrencyCatalog) Items() []CurrencyInfo {
+	items := make([]CurrencyInfo, 0, len(c.items))
+	for _, item := range c.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].CharCode < items[j].CharCode })
+	return items
+}
+
+// Decodes the answer of the reference feed. Items without an ISO char code are skipped.
+// When several items share a char code, the one which is its own parent wins.
+func decodeCurrencyCatalog(answer io.Reader) (*CurrencyCatalog, error) {
+	decoder := newCbrDecoder(answer)
+	if !decoder.isValid {
+		return nil, decoder.incorrectAnswerError()
+	}
+
+	result := CbrCatalogResult{}
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	items := map[string]CatalogItem{}
+	for _, item := range result.Items {
+		item.CharCode = strings.ToUpper(strings.TrimSpace(item.CharCode))
+		if item.CharCode == "" {
+			continue
+		}
+		if prev, ok := items[item.CharCode]; ok && prev.isParent() {
+			continue
+		}
+		items[item.CharCode] = item
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("the currency catalog is empty")
+	}
+
+	list := make([]CurrencyInfo, 0, len(items))
+	for _, item := range items {
+		num, _ := strconv.Atoi(strings.TrimSpace(item.NumCode))
+		list = append(list, CurrencyInfo{
+			ID:       strings.TrimSpace(item.ID),
+			NumCode:  num,
+			CharCode: item.CharCode,
+			Name:     strings.TrimSpace(item.EngName),
+			RusName:  strings.TrimSpace(item.Name),
+		})
+	}
+
+	return newCurrencyCatalog(list), nil
+}
+
+func (i CatalogItem) isParent() bool {
+	return strings.TrimSpace(i.ParentCode) == strings.TrimSpace(i.ID)
+}
+
+// Downloads the currency catalog from the CBR reference feed. The answer is taken from
+// the cache if it's received within 'catalogCacheTTL' and saved in it, unless the cache is nil.
+func fetchCurrencyCatalog(ctx context.Context, client *CbrClient, cache *ResponseCache) (*CurrencyCatalog, error) {
+	if cache != nil {
+		if answer, _, ok := cache.GetRecent(catalogLink, catalogCacheTTL); ok {
+			catalog, err := decodeCurrencyCatalog(bytes.NewReader(answer))
+			if err == nil {
+				logger.Info("currency catalog taken from the cache")
+				return catalog, nil
+			}
+			logger.Warn(fmt.Sprintf("failed to decode the cached currency catalog: %v", err))
+		}
+	}
+
+	// the answer is cached only if it's decoded successfully
+	var (
+		catalog *CurrencyCatalog
+		buf     bytes.Buffer
+	)
+	err := client.Get(ctx, catalogLink, func(answer io.Reader) error {
+		buf.Reset()
+		if cache != nil {
+			answer = io.TeeReader(answer, &buf)
+		}
+		var err error
+		catalog, err = decodeCurrencyCatalog(answer)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		if err = cache.Put(catalogLink, buf.Bytes()); err != nil {
+			logger.Warn(fmt.Sprintf("failed to cache the currency catalog: %v", err))
+		}
+	}
+	return catalog, nil
+}
+
+// Loads the currency catalog. The catalog cached in the storage is used if any,
+// otherwise it's taken from the response cache or downloaded unless the client is nil,
+// and saved in the storage. The built-in list is the last resort.
+func loadCurrencyCatalog(ctx context.Context, storage Storage, client *CbrClient,
+	cache *ResponseCache) *CurrencyCatalog {
+
+	// the stored catalog is downloaded again once it's older than 'catalogCacheTTL',
+	// it's still used if the download fails
+	var stored *CurrencyCatalog
+	if storage != nil {
+		catalog, err := storage.LoadCatalog(ctx)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("failed to load the currency catalog from %q: %v", storage, err))
+		} else if catalog.Len() > 0 {
+			if client == nil || time.Since(catalog.SavedAt()) < catalogCacheTTL {
+				return catalog
+			}
+			logger.Info(fmt.Sprintf("the currency catalog in %q is saved at %s, it's downloaded again",
+				storage, catalog.SavedAt().Format(time.RFC3339)))
+			stored = catalog
+		}
+	}
+
+	if client == nil {
+		return newBuiltinCatalog()
+	}
+
+	catalog, err := fetchCurrencyCatalog(ctx, client, cache)
+	if err != nil {
+		if stored != nil {
+			logger.Warn(fmt.Sprintf("failed to download the currency catalog, the stored one is used: %v", err))
+			return stored
+		}
+		logger.Warn(fmt.Sprintf("failed to download the currency catalog, the built-in one is used: %v", err))
+		return newBuiltinCatalog()
+	}
+	logger.Info(fmt.Sprintf("currency catalog loaded: %d currencies", catalog.Len()))
+
+	if storage != nil {
+		if err = storage.SaveCatalog(ctx, catalog); err != nil {
+			logger.Warn(fmt.Sprintf("failed to save the currency catalog in %q: %v", storage, err))
+		}
+	}
+
+	return catalog
+}
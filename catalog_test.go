@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeCurrencyCatalog(t *testing.T) {
+	if _, err := decodeCurrencyCatalog(strings.NewReader("")); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+
+	s := `<?xml version="1.0" encoding="windows-1251"?>
+	<Valuta name="Foreign Currency Market Lib">
+		<Item ID="R01090">
+			<Name></Name>
+			<EngName>Belarussian Ruble</EngName>
+			<Nominal>1000</Nominal>
+			<ParentCode>R01090    </ParentCode>
+			<ISO_Num_Code>974</ISO_Num_Code>
+			<ISO_Char_Code>BYR</ISO_Char_Code>
+		</Item>
+		<Item ID="R01235">
+			<Name></Name>
+			<EngName>US Dollar</EngName>
+			<Nominal>1</Nominal>
+			<ParentCode>R01235    </ParentCode>
+			<ISO_Num_Code>840</ISO_Num_Code>
+			<ISO_Char_Code>USD</ISO_Char_Code>
+		</Item>
+		<Item ID="R01235A">
+			<Name></Name>
+			<EngName>US Dollar</EngName>
+			<Nominal>1</Nominal>
+			<ParentCode>R01235    </ParentCode>
+			<ISO_Num_Code>840</ISO_Num_Code>
+			<ISO_Char_Code>USD</ISO_Char_Code>
+		</Item>
+		<Item ID="R01436">
+			<Name></Name>
+			<EngName>Lithuanian Talon</EngName>
+			<Nominal>1</Nominal>
+			<ParentCode>R01435    </ParentCode>
+			<ISO_Num_Code></ISO_Num_Code>
+			<ISO_Char_Code></ISO_Char_Code>
+		</Item>
+	</Valuta>`
+	catalog, err := decodeCurrencyCatalog(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("got an error: %v", err)
+	}
+	if catalog.Len() != 2 {
+		t.Fatalf("expected 2 currencies got %d", catalog.Len())
+	}
+
+	info, ok := catalog.Lookup("BYR")
+	if !ok {
+		t.Fatalf("currency code 'BYR' doesn't exist")
+	}
+	expected := CurrencyInfo{ID: "R01090", NumCode: 974, CharCode: "BYR", Name: "Belarussian Ruble"}
+	if info != expected {
+		t.Fatalf("expected %v got %v", expected, info)
+	}
+
+	if info, _ = catalog.Lookup("USD"); info.ID != "R01235" {
+		t.Fatalf("expected 'R01235' got %q", info.ID)
+	}
+}
+
+func TestLoadCurrencyCatalogCache(t *testing.T) {
+	cache := newResponseCache(t.TempDir())
+	answer := `<?xml version="1.0" encoding="windows-1251"?>
+	<Valuta name="Foreign Currency Market Lib">
+		<Item ID="R01090">
+			<Name></Name>
+			<EngName>Belarussian Ruble</EngName>
+			<Nominal>1000</Nominal>
+			<ParentCode>R01090    </ParentCode>
+			<ISO_Num_Code>974</ISO_Num_Code>
+			<ISO_Char_Code>BYR</ISO_Char_Code>
+		</Item>
+	</Valuta>`
+	if err := cache.Put(catalogLink, []byte(answer)); err != nil {
+		t.Fatalf("failed to cache the catalog: %v", err)
+	}
+
+	// the cached catalog is used without requests
+	client := newCbrClient(time.Second, 0)
+	catalog := loadCurrencyCatalog(context.Background(), nil, client, cache)
+	if catalog.Len() != 1 || !catalog.CodeExists("BYR") {
+		t.Fatalf("expected the cached catalog with BYR got %d currencies", catalog.Len())
+	}
+}
+
+func TestLoadCurrencyCatalogStorage(t *testing.T) {
+	ctx := context.Background()
+	cache := newResponseCache(t.TempDir())
+	answer := `<?xml version="1.0" encoding="windows-1251"?>
+	<Valuta name="Foreign Currency Market Lib">
+		<Item ID="R01090">
+			<EngName>Belarussian Ruble</EngName>
+			<ParentCode>R01090    </ParentCode>
+			<ISO_Num_Code>974</ISO_Num_Code>
+			<ISO_Char_Code>BYR</ISO_Char_Code>
+		</Item>
+	</Valuta>`
+	if err := cache.Put(catalogLink, []byte(answer)); err != nil {
+		t.Fatalf("failed to cache the catalog: %v", err)
+	}
+	storage := newMemStorage()
+	stored := newCurrencyCatalog([]CurrencyInfo{{ID: "R01235", NumCode: 840, CharCode: "USD", Name: "US Dollar"}})
+	if err := storage.SaveCatalog(ctx, stored); err != nil {
+		t.Fatalf("failed to save the catalog: %v", err)
+	}
+
+	// the stored catalog is used while it's fresh
+	client := newCbrClient(time.Second, 0)
+	if catalog := loadCurrencyCatalog(ctx, storage, client, cache); !catalog.CodeExists("USD") {
+		t.Fatalf("expected the stored catalog with USD got %v", catalog.Items())
+	}
+
+	// an outdated one is used offline only
+	storage.savedAt = time.Now().Add(-catalogCacheTTL - time.Hour)
+	if catalog := loadCurrencyCatalog(ctx, storage, nil, cache); !catalog.CodeExists("USD") {
+		t.Fatalf("expected the stored catalog with USD got %v", catalog.Items())
+	}
+	if catalog := loadCurrencyCatalog(ctx, storage, client, cache); !catalog.CodeExists("BYR") {
+		t.Fatalf("expected the downloaded catalog with BYR got %v", catalog.Items())
+	}
+	saved, err := storage.LoadCatalog(ctx)
+	if err != nil || !saved.CodeExists("BYR") || time.Since(saved.SavedAt()) > time.Minute {
+		t.Fatalf("expected the downloaded catalog saved got %v: %v", saved, err)
+	}
+}
+
+func TestBuiltinCatalog(t *testing.T) {
+	catalog := newBuiltinCatalog()
+	if catalog.Len() != len(builtinCurrencies) {
+		t.Fatalf("expected %d currencies got %d", len(builtinCurrencies), catalog.Len())
+	}
+	if catalog.CodeExists("RUB") {
+		t.Fatalf("'RUB' found in the catalog")
+	}
+	for _, c := range builtinCurrencies {
+		if c.ID == "" || c.NumCode == 0 || c.Name == "" || c.RusName == "" {
+			t.Fatalf("incomplete reference data: %v", c)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 'PreviousRates' looks up the exchange rates of the publication before the given rates.
+// They are read from the storage if there is one. The rates missing in it are taken from
+// the answer with the series of the rates or the rates of the previous day are requested
+// from the server. The rates seen before are used instead of the requests.
+type PreviousRates struct {
+	storage Storage
+	fetch   func(ctx context.Context, query RateQuery) *QueryResult
+	days    map[string]*DayRates // the rates by the requested date
+}
+
+// Creates a 'PreviousRates' instance reading the storage, or requesting the server with
+// 'fetch' if the storage is nil.
+func newPreviousRates(storage Storage, fetch func(context.Context, RateQuery) *QueryResult) *PreviousRates {
+	return &PreviousRates{storage: storage, fetch: fetch, days: map[string]*DayRates{}}
+}
+
+// Remembers the rates of all the currencies on a date, so that they aren't requested
+// as the previous ones.
+func (p *PreviousRates) remember(rates *DayRates) {
+	p.days[rates.Query.Date("2006-01-02")] = rates
+}
+
+// Sets the previous rates of the currencies enabled in the filter. A currency without
+// a previous rate in the storage is looked up on the server unless 'fetch' is nil,
+// a currency without a previous rate anywhere is skipped.
+func (p *PreviousRates) Load(ctx context.Context, rates *DayRates, filter *CurrencyFilter) error {
+	effective := rates.Effective
+	if effective.IsZero() {
+		effective = rates.Query.LatestDate()
+	}
+	rates.Previous = map[string]StoredRate{}
+
+	missing := map[string]bool{}
+	for _, c := range rates.Currencies {
+		if filter.IsEnabled() && filter.IsCurrencyDisabled(c.CharCode) {
+			continue
+		}
+		if p.storage != nil {
+			rate, err := p.storage.GetPreviousRate(ctx, effective, c.CharCode)
+			if err == nil {
+				rates.Previous[c.CharCode] = *rate
+				continue
+			}
+			if !errors.Is(err, errNoStoredRates) {
+				return err
+			}
+		}
+		missing[c.CharCode] = true
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// the rates of a series are preceded by the rates from the same answer,
+	// only the first ones are requested
+	if rates.Preceding != nil {
+		for code, rate := range rates.Preceding {
+			if missing[code] {
+				rates.Previous[code] = rate
+			}
+		}
+		return nil
+	}
+	if p.fetch == nil {
+		return nil
+	}
+
+	previous, err := p.day(ctx, effective.AddDate(0, 0, -1))
+	if err != nil {
+		return err
+	}
+	if previous == nil || !previous.Effective.Before(effective) {
+		return nil
+	}
+	for _, c := range previous.Currencies {
+		if missing[c.CharCode] {
+			rates.Previous[c.CharCode] = StoredRate{Date: previous.Query.LatestDate(), Effective: previous.Effective, Currency: c}
+		}
+	}
+	return nil
+}
+
+// Returns the rates requested on the date, nil if the server has none.
+func (p *PreviousRates) day(ctx context.Context, date time.Time) (*DayRates, error) {
+	key := date.Format("2006-01-02")
+	if rates, ok := p.days[key]; ok {
+		return rates, nil
+	}
+
+	query := newExchRateQuery()
+	query.SetTime(date)
+	result := p.fetch(ctx, query)
+	if result.Err != nil {
+		return nil, fmt.Errorf("previous rates on %s weren't received: %v", query.Date("02.01.2006"), result.Err)
+	}
+
+	var rates *DayRates
+	if len(result.Rates) > 0 {
+		rates = &result.Rates[0]
+	}
+	p.days[key] = rates
+	return rates, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewRateChange(t *testing.T) {
+	r := RateRecord{Nominal: 10, Value: mustParseDecimal("55")}
+	previous := StoredRate{Currency: Currency{Nominal: 100, Value: mustParseDecimal("500")}}
+	previous.Effective, _ = parseDate("10.03.2023")
+
+	change, err := newRateChange(r, previous)
+	if err != nil {
+		t.Fatalf("failed to count the change: %v", err)
+	}
+	if change.Value.String() != "50" || change.Diff.String() != "5" || change.Percent == nil ||
+		change.Percent.String() != "10" {
+		t.Fatalf("expected 50, 5 and 10%% got %v", change)
+	}
+	if change.Effective.String() != "10.03.2023" {
+		t.Fatalf("expected 10.03.2023 got %s", change.Effective)
+	}
+
+	previous.Value = mustParseDecimal("0")
+	if change, err = newRateChange(r, previous); err != nil || change.Percent != nil {
+		t.Fatalf("expected no percent got %v: %v", change.Percent, err)
+	}
+}
+
+func TestPreviousRatesStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := newMemStorage()
+	filter := newCurrencyFilter(newBuiltinCatalog())
+
+	rates := newTestDayRates()
+	rates.Query.SetDate("10.03.2023")
+	rates.Effective = rates.Query.LatestDate()
+	if _, err := storage.Add(ctx, rates, filter); err != nil {
+		t.Fatalf("failed to add rates: %v", err)
+	}
+
+	previous := newPreviousRates(storage, nil)
+	rates = newTestDayRates()
+	rates.Effective, _ = parseDate("11.03.2023")
+	rates.Currencies = append(rates.Currencies, Currency{NumCode: 978, CharCode: "EUR", Nominal: 1, Value: mustParseDecimal("80")})
+	if err := previous.Load(ctx, rates, filter); err != nil {
+		t.Fatalf("failed to load the previous rates: %v", err)
+	}
+	if len(rates.Previous) != 2 || rates.Previous["USD"].Value.String() != "75.5" {
+		t.Fatalf("expected USD and JPY got %v", rates.Previous)
+	}
+}
+
+func TestPreviousRatesStorageFetch(t *testing.T) {
+	ctx := context.Background()
+	storage := newMemStorage()
+	filter := newCurrencyFilter(newBuiltinCatalog())
+
+	rates := newTestDayRates()
+	rates.Query.SetDate("10.03.2023")
+	rates.Effective = rates.Query.LatestDate()
+	if _, err := storage.Add(ctx, rates, filter); err != nil {
+		t.Fatalf("failed to add rates: %v", err)
+	}
+
+	// the rates missing in the storage are requested
+	fetched := 0
+	previous := newPreviousRates(storage, func(ctx context.Context, query RateQuery) *QueryResult {
+		fetched++
+		day := newTestDayRates()
+		day.Query = query.(*ExchRateQuery)
+		day.Effective = day.Query.LatestDate()
+		day.Currencies = append(day.Currencies, Currency{NumCode: 978, CharCode: "EUR", Nominal: 1, Value: mustParseDecimal("79")})
+		return &QueryResult{Query: query, Rates: []DayRates{*day}}
+	})
+	rates = newTestDayRates()
+	rates.Effective, _ = parseDate("11.03.2023")
+	rates.Currencies = append(rates.Currencies, Currency{NumCode: 978, CharCode: "EUR", Nominal: 1, Value: mustParseDecimal("80")})
+	if err := previous.Load(ctx, rates, filter); err != nil {
+		t.Fatalf("failed to load the previous rates: %v", err)
+	}
+	if fetched != 1 || len(rates.Previous) != 3 {
+		t.Fatalf("expected 3 rates after 1 request got %v after %d", rates.Previous, fetched)
+	}
+	if rates.Previous["USD"].Value.String() != "75.5" || rates.Previous["EUR"].Value.String() != "79" {
+		t.Fatalf("expected USD 75.5 and EUR 79 got %v", rates.Previous)
+	}
+}
+
+func TestPreviousRatesFetch(t *testing.T) {
+	ctx := context.Background()
+	filter := newCurrencyFilter(newBuiltinCatalog())
+
+	fetched := []string{}
+	previous := newPreviousRates(nil, func(ctx context.Context, query RateQuery) *QueryResult {
+		fetched = append(fetched, query.String())
+		rates := newTestDayRates()
+		rates.Query = query.(*ExchRateQuery)
+		rates.Effective = rates.Query.LatestDate().AddDate(0, 0, -1)
+		return &QueryResult{Query: query, Rates: []DayRates{*rates}}
+	})
+
+	// the rates of 11.03 were published for 10.03, the previous ones are requested on 09.03
+	rates := newTestDayRates()
+	if err := previous.Load(ctx, rates, filter); err != nil {
+		t.Fatalf("failed to load the previous rates: %v", err)
+	}
+	if len(fetched) != 1 || fetched[0] != "https://www.cbr.ru/scripts/XML_daily_eng.asp?date_req=09/03/2023" {
+		t.Fatalf("expected a request on 09.03.2023 got %v", fetched)
+	}
+	if rates.Previous["JPY"].Effective.Format("02.01.2006") != "08.03.2023" {
+		t.Fatalf("expected 08.03.2023 got %v", rates.Previous["JPY"])
+	}
+
+	// the remembered rates aren't requested
+	day := newTestDayRates()
+	day.Query.SetDate("12.03.2023")
+	day.Effective, _ = parseDate("12.03.2023")
+	previous.remember(newTestDayRates())
+	if err := previous.Load(ctx, day, filter); err != nil || len(fetched) != 1 {
+		t.Fatalf("expected 1 request got %v: %v", fetched, err)
+	}
+	if day.Previous["USD"].Effective.Format("02.01.2006") != "10.03.2023" {
+		t.Fatalf("expected 10.03.2023 got %v", day.Previous["USD"])
+	}
+}
+
+func TestPreviousRatesSeries(t *testing.T) {
+	ctx := context.Background()
+	filter := newCurrencyFilter(newBuiltinCatalog())
+
+	fetched := 0
+	previous := newPreviousRates(nil, func(ctx context.Context, query RateQuery) *QueryResult {
+		fetched++
+		return &QueryResult{Query: query, Rates: []DayRates{*newTestDayRates()}}
+	})
+
+	// the rates preceded in the answer aren't requested
+	rates := newTestDayRates()
+	before := StoredRate{Currency: Currency{CharCode: "USD", Nominal: 1, Value: mustParseDecimal("75")}}
+	before.Effective, _ = parseDate("09.03.2023")
+	rates.Preceding = map[string]StoredRate{"USD": before}
+	if err := previous.Load(ctx, rates, filter); err != nil || fetched != 0 {
+		t.Fatalf("expected no requests got %d: %v", fetched, err)
+	}
+	if len(rates.Previous) != 1 || rates.Previous["USD"].Value.String() != "75" {
+		t.Fatalf("expected USD 75 got %v", rates.Previous)
+	}
+}
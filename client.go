@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	maxResponseSize = 32 << 20 // the greatest size of a server answer
+	maxBackoff      = 10 * time.Second
+
+	defaultTimeout = 30 * time.Second
+	defaultRetries = 3
+)
+
+var errResponseTooLarge = errors.New("response is too large")
+
+// 'RequestError' describes a failed request. Transient failures (5xx responses, timeouts,
+// reset connections) may succeed if the request is repeated, permanent ones will not.
+type RequestError struct {
+	URL        string
+	StatusCode int // zero if there is no response
+	Transient  bool
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("request '%s' failed with status %d: %v", e.URL, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("request '%s' failed: %v", e.URL, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Checks the error is a transient request failure.
+func isTransient(err error) bool {
+	var rerr *RequestError
+	return errors.As(err, &rerr) && rerr.Transient
+}
+
+// Http client.
+type CbrClient struct {
+	client  *http.Client
+	maxSize int64
+	retries int
+	backoff time.Duration // the first delay before a retry, every next one is doubled
+	limiter *RateLimiter  // shared by all requests of the client, nil if there is no limit
+}
+
+// Creates a 'CbrClient' instance. The timeout limits every attempt including reading
+// the answer, transient failures are retried the given number of times.
+func newCbrClient(timeout time.Duration, retries int) *CbrClient {
+	tr := &http.Transport{
+		IdleConnTimeout:   5 * time.Second,
+		DisableKeepAlives: true,
+	}
+
+	return &CbrClient{
+		client:  &http.Client{Transport: tr, Timeout: timeout},
+		maxSize: maxResponseSize,
+		retries: retries,
+		backoff: 500 * time.Millisecond,
+	}
+}
+
+// Limits the number of request attempts per second, a non-positive rate means no limit.
+func (c *CbrClient) SetRateLimit(perSecond float64) {
+	c.limiter = newRateLimiter(perSecond)
+}
+
+// Makes a request to the server to get exchange rate data and passes the answer to
+// 'read', reading more than the size limit from it fails. Transient failures are retried
+// also while the answer is read, then 'read' is called again with the new answer. An error
+// returned by 'read' which isn't a 'RequestError' isn't retried.
+func (c *CbrClient) Get(ctx context.Context, query string, read func(answer io.Reader) error) error {
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return &RequestError{URL: query, Err: err}
+		}
+
+		err := c.attempt(ctx, query, read)
+		if err == nil {
+			return nil
+		}
+		if !isTransient(err) || attempt >= c.retries {
+			return err
+		}
+
+		delay := c.delay(attempt)
+		logger.Warn(fmt.Sprintf("[%s] attempt %d failed, retrying in %v: %v", query, attempt+1, delay, err))
+
+		select {
+		case <-ctx.Done():
+			return &RequestError{URL: query, Err: ctx.Err()}
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Makes one attempt of the request and reads the answer.
+func (c *CbrClient) attempt(ctx context.Context, query string, read func(answer io.Reader) error) error {
+	body, err := c.get(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return read(body)
+}
+
+// Returns the delay before the retry: exponential backoff with full jitter.
+func (c *CbrClient) delay(attempt int) time.Duration {
+	d := c.backoff << attempt
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// Sends the request and checks the answer. The caller must close the returned body.
+func (c *CbrClient) get(ctx context.Context, query string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", query, nil)
+	if err != nil {
+		return nil, &RequestError{URL: query, Err: fmt.Errorf("failed to create request: %v", err)}
+	}
+	req.Header.Add("Accept", `text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8`)
+	req.Header.Add("User-Agent", `Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/112.0`)
+	req.Header.Add("Connection", "close")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, &RequestError{URL: query, Transient: isTransientNetError(ctx, err), Err: err}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		transient := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, &RequestError{
+			URL:        query,
+			StatusCode: resp.StatusCode,
+			Transient:  transient,
+			Err:        fmt.Errorf("unexpected status: %s", resp.Status),
+		}
+	}
+
+	body := &limitedBody{ReadCloser: resp.Body, ctx: ctx, url: query, limit: c.maxSize, left: c.maxSize}
+
+	// CBR answers with XML, anything else is an error page or a plain text error
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "" && !strings.Contains(contentType, "xml") {
+		defer body.Close()
+		prefix, _ := io.ReadAll(io.LimitReader(body, incorrectAnswerPrefixSize))
+		err = fmt.Errorf("unexpected content type %q: %s", contentType, strings.TrimSpace(string(prefix)))
+		if strings.Contains(string(prefix), "Error in parameters") {
+			err = fmt.Errorf("%w: %s", errCbrParameters, strings.TrimSpace(string(prefix)))
+		}
+		return nil, &RequestError{URL: query, StatusCode: resp.StatusCode, Err: err}
+	}
+
+	return body, nil
+}
+
+// Checks the network error may disappear if the request is repeated.
+func isTransientNetError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		// the caller cancelled the request
+		return false
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
+// 'limitedBody' fails reading a response body longer than the limit. Failures of reading
+// are reported as 'RequestError', so that the transient ones are retried.
+type limitedBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	url   string
+	limit int64
+	left  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return n, &RequestError{URL: b.url, Err: fmt.Errorf("%w: more than %d bytes", errResponseTooLarge, b.limit)}
+	}
+	if err != nil && err != io.EOF {
+		return n, &RequestError{URL: b.url, Transient: isTransientNetError(b.ctx, err), Err: err}
+	}
+	return n, err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(retries int) *CbrClient {
+	client := newCbrClient(time.Second, retries)
+	client.backoff = time.Millisecond
+	return client
+}
+
+// Returns the function reading the whole answer into the slice.
+func readAnswer(body *[]byte) func(io.Reader) error {
+	return func(answer io.Reader) error {
+		var err error
+		*body, err = io.ReadAll(answer)
+		return err
+	}
+}
+
+func TestCbrClientGet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml; charset=windows-1251")
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer server.Close()
+
+	client := newTestClient(0)
+	var body []byte
+	err := client.Get(context.Background(), server.URL, readAnswer(&body))
+	if err != nil || len(body) != 100 {
+		t.Fatalf("expected 100 bytes got %d: %v", len(body), err)
+	}
+
+	client.maxSize = 99
+	err = client.Get(context.Background(), server.URL, readAnswer(&body))
+	if !errors.Is(err, errResponseTooLarge) || isTransient(err) {
+		t.Fatalf("expected %v got %v", errResponseTooLarge, err)
+	}
+
+	// a failure of the reader isn't retried
+	calls := 0
+	errRead := errors.New("read failed")
+	err = newTestClient(2).Get(context.Background(), server.URL, func(io.Reader) error {
+		calls++
+		return errRead
+	})
+	if err != errRead || calls != 1 {
+		t.Fatalf("expected %v after 1 call got %v after %d", errRead, err, calls)
+	}
+}
+
+func TestCbrClientRetries(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte("<?xml"))
+	}))
+	defer server.Close()
+
+	var body []byte
+	if err := newTestClient(2).Get(context.Background(), server.URL, readAnswer(&body)); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls got %d", calls)
+	}
+
+	calls = 0
+	err := newTestClient(1).Get(context.Background(), server.URL, readAnswer(&body))
+	var rerr *RequestError
+	if !errors.As(err, &rerr) || rerr.StatusCode != http.StatusServiceUnavailable || !isTransient(err) {
+		t.Fatalf("expected a transient error with status 503 got %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 calls got %d", calls)
+	}
+}
+
+func TestCbrClientPermanentErrors(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/params":
+			w.Header().Set("Content-Type", "text/html; charset=windows-1251")
+			w.Write([]byte("Error in parameters"))
+		}
+	}))
+	defer server.Close()
+
+	client := newTestClient(3)
+	var body []byte
+	err := client.Get(context.Background(), server.URL+"/missing", readAnswer(&body))
+	if err == nil || isTransient(err) {
+		t.Fatalf("expected a permanent error got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call got %d", calls)
+	}
+
+	err = client.Get(context.Background(), server.URL+"/params", readAnswer(&body))
+	if !errors.Is(err, errCbrParameters) || isTransient(err) {
+		t.Fatalf("expected %v got %v", errCbrParameters, err)
+	}
+}
+
+func TestCbrClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := newTestClient(0)
+	client.client.Timeout = 50 * time.Millisecond
+	var body []byte
+	if err := client.Get(context.Background(), server.URL, readAnswer(&body)); !isTransient(err) {
+		t.Fatalf("expected a transient error got %v", err)
+	}
+}
+
+func TestCbrClientDroppedAnswer(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/xml")
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("<?xml"))
+		if calls < 2 {
+			// the connection is dropped in the middle of the answer
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("failed to hijack the connection: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		w.Write([]byte(strings.Repeat("x", 95)))
+	}))
+	defer server.Close()
+
+	var body []byte
+	if err := newTestClient(1).Get(context.Background(), server.URL, readAnswer(&body)); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if calls != 2 || len(body) != 100 {
+		t.Fatalf("expected 100 bytes after 2 calls got %d after %d", len(body), calls)
+	}
+
+	calls = 0
+	err := newTestClient(0).Get(context.Background(), server.URL, readAnswer(&body))
+	var rerr *RequestError
+	if !errors.As(err, &rerr) || !isTransient(err) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected a transient error got %v", err)
+	}
+}
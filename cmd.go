@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"regexp"
+	"os"
 	"strings"
 	"time"
 
@@ -10,9 +12,32 @@ import (
 )
 
 var (
-	argCurrency []string
-	argDate     []string
-	argSql      string
+	argCurrency    []string
+	argDate        []string
+	argFrom        string
+	argTo          string
+	argStep        string
+	argStrict      bool
+	argSql         string
+	argStore       string
+	argTimeout     time.Duration
+	argRetries     int
+	argConcurrency int
+	argRate        float64
+	argNoCache     bool
+	argCacheDir    string
+	argOffline     bool
+	argDbFirst     bool
+	argAsOf        string
+	argOutput      string
+	argFormat      string
+	argTemplate    string
+	argSort        string
+	argStream      bool
+	argChange      bool
+	argConvertDate string
+	argPrecision   int
+	argRounding    string
 )
 
 func newRootCmd() *cobra.Command {
@@ -20,6 +45,35 @@ func newRootCmd() *cobra.Command {
 		Use:   "cbr_currencies",
 		Short: "Gets the Bank of Russia exchange rate",
 		Long:  "cbr_currencies is a tool to get the Bank of Russia exchange rate for today or specified date.",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(argSql) > 0 {
+				logger.Info(fmt.Sprintf("database location was entered: %s", argSql))
+				argSql = strings.TrimSpace(argSql)
+				if _, err := newDbStorageAt(argSql); err != nil {
+					return fmt.Errorf("invalid database location: %v", err)
+				}
+			}
+			if len(argStore) > 0 {
+				logger.Info(fmt.Sprintf("storage was entered: %s", argStore))
+				if len(argSql) > 0 {
+					return fmt.Errorf("flags --sql and --store can't be used together")
+				}
+				argStore = strings.TrimSpace(argStore)
+				if _, err := newStorage(argStore); err != nil {
+					return fmt.Errorf("invalid storage: %v", err)
+				}
+			}
+			if argTimeout <= 0 {
+				return fmt.Errorf("timeout value %v is incorrect", argTimeout)
+			}
+			if argRetries < 0 {
+				return fmt.Errorf("retries value %d is incorrect", argRetries)
+			}
+			if argRate < 0 {
+				return fmt.Errorf("rate value %v is incorrect", argRate)
+			}
+			return nil
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if !isArgsEmpty(args) {
 				logger.Info(fmt.Sprintf("args was entered: %v", args))
@@ -27,11 +81,43 @@ func newRootCmd() *cobra.Command {
 					strings.Join(args, ", "))
 			}
 
+			if (argOffline || argDbFirst) && len(storeLocation()) == 0 {
+				return fmt.Errorf("the storage must be set with --offline and --db-first")
+			}
+
+			if cmd.Flags().Changed("as-of") {
+				logger.Info(fmt.Sprintf("as of was entered: %q", argAsOf))
+				if len(storeLocation()) == 0 {
+					return fmt.Errorf("the storage must be set with --as-of")
+				}
+				if _, err := parseMoment(argAsOf); err != nil {
+					return fmt.Errorf("as of value %q is incorrect: %v", argAsOf, err)
+				}
+				// the past state of the database is only read
+				argOffline = true
+			}
+
+			// the filter and the validator use the same catalog, so that the historical
+			// codes aren't reported as unknown
+			storage, err := openStorage(storeLocation())
+			if err != nil && !errors.Is(err, errNoStorage) {
+				return err
+			}
+			var client *CbrClient
+			if !argOffline {
+				client = newClientFromArgs()
+			}
+			currencyCatalog = loadCurrencyCatalog(context.Background(), storage, client, newCacheFromArgs())
+			if storage != nil {
+				storage.Close()
+			}
+
 			if len(argCurrency) > 0 {
 				logger.Info(fmt.Sprintf("currencies was entered: %v", argCurrency))
+
 				for i, c := range argCurrency {
 					c = strings.ToUpper(strings.TrimSpace(c))
-					if currencyFilter.CodeExists(c) {
+					if currencyCatalog.CodeExists(c) {
 						argCurrency[i] = c
 					} else {
 						return fmt.Errorf("currency value %q is incorrect", c)
@@ -51,12 +137,50 @@ func newRootCmd() *cobra.Command {
 				}
 			}
 
-			if len(argSql) > 0 {
-				logger.Info(fmt.Sprintf("database file name was entered: %s", argSql))
-				argSql = strings.TrimSpace(argSql)
-				if !isFileNameCorrect(argSql) {
-					return fmt.Errorf("invalid database file name: %q", argSql)
+			if cmd.Flags().Changed("from") || cmd.Flags().Changed("to") {
+				logger.Info(fmt.Sprintf("period was entered: %q - %q, step %q", argFrom, argTo, argStep))
+				if cmd.Flags().Changed("date") {
+					return fmt.Errorf("flags --date and --from/--to can't be used together")
+				}
+				if !cmd.Flags().Changed("from") || !cmd.Flags().Changed("to") {
+					return fmt.Errorf("both --from and --to must be set")
+				}
+
+				argFrom = strings.TrimSpace(argFrom)
+				if !isDateCorrect(argFrom) {
+					return fmt.Errorf("date value %q is incorrect", argFrom)
 				}
+				argTo = strings.TrimSpace(argTo)
+				if !isDateCorrect(argTo) {
+					return fmt.Errorf("date value %q is incorrect", argTo)
+				}
+			}
+
+			if argConcurrency < 1 {
+				return fmt.Errorf("concurrency value %d is incorrect", argConcurrency)
+			}
+
+			if cmd.Flags().Changed("format") && cmd.Flags().Changed("template-file") {
+				return fmt.Errorf("flags --format and --template-file can't be used together")
+			}
+			if cmd.Flags().Changed("output") &&
+				(cmd.Flags().Changed("format") || cmd.Flags().Changed("template-file")) {
+				return fmt.Errorf("flag --output can't be used with --format and --template-file")
+			}
+			if _, err := formatterFromArgs(); err != nil {
+				return err
+			}
+			if _, err := parseRecordOrder(argSort); err != nil {
+				return err
+			}
+
+			argStep = strings.ToLower(strings.TrimSpace(argStep))
+			if !isStepCorrect(argStep) {
+				return fmt.Errorf("step value %q is incorrect", argStep)
+			}
+			if cmd.Flags().Changed("from") && !isPeriodCorrect(argFrom, argTo, argStep) {
+				return fmt.Errorf("period %q - %q is incorrect: it must not be reversed or have more than %d dates",
+					argFrom, argTo, maxPeriodDates)
 			}
 
 			return nil
@@ -67,13 +191,619 @@ func newRootCmd() *cobra.Command {
 		"the currency you're interested, for example 'USD' (according to ISO 4217)")
 	cmd.Flags().StringSliceVarP(&argDate, "date", "d", []string{},
 		"exchange rate date (as day.month.year)")
-	cmd.Flags().StringVarP(&argSql, "sql", "s", "",
-		"name of the SQLite database file in which the exchange rate data should be saved, for example 'currencies.db'")
+	cmd.Flags().StringVar(&argFrom, "from", "",
+		"the first date of the period (as day.month.year)")
+	cmd.Flags().StringVar(&argTo, "to", "",
+		"the last date of the period (as day.month.year)")
+	cmd.Flags().StringVar(&argStep, "step", stepDaily,
+		"step of the period: 'daily', 'weekly' or 'monthly'")
+	cmd.Flags().BoolVar(&argStrict, "strict", false,
+		"fail a request if its answer has any inconsistencies instead of reporting them")
+	cmd.Flags().IntVar(&argConcurrency, "concurrency", defaultConcurrency,
+		"number of requests made at the same time")
+	cmd.PersistentFlags().StringVarP(&argSql, "sql", "s", "",
+		"path of the SQLite database file in which the exchange rate data should be saved, for example 'currencies.db', or a 'file:' URI with SQLite options")
+	cmd.PersistentFlags().StringVar(&argStore, "store", "",
+		"storage of the exchange rate data instead of --sql: 'sqlite://<path>', 'jsonl://<path>' or 'mem://'")
+	cmd.PersistentFlags().DurationVar(&argTimeout, "timeout", defaultTimeout,
+		"time limit of one request attempt, for example '10s'")
+	cmd.PersistentFlags().IntVar(&argRetries, "retries", defaultRetries,
+		"number of retries of a request failed with a server or network error")
+	cmd.PersistentFlags().Float64Var(&argRate, "rate", defaultRate,
+		"greatest number of requests per second, 0 means no limit")
+	cmd.Flags().BoolVar(&argOffline, "offline", false,
+		"answer from the database only, without requests to the server")
+	cmd.Flags().BoolVar(&argDbFirst, "db-first", false,
+		"answer from the database, request the server only for the dates missing in it")
+	cmd.Flags().StringVar(&argAsOf, "as-of", "",
+		"answer from the database as it was at the moment (as day.month.year [hours:minutes]), implies --offline")
+	cmd.Flags().StringVarP(&argOutput, "output", "o", outputTable,
+		"output format: "+strings.Join(outputFormats(), ", "))
+	cmd.Flags().StringVar(&argFormat, "format", "",
+		"template of a line for every rate, for example '{{.Date}};{{.CharCode}};{{.Value}}'")
+	cmd.Flags().StringVar(&argTemplate, "template-file", "",
+		"file with the template of the whole report")
+	cmd.Flags().StringVar(&argSort, "sort", "",
+		"order of the rates within a date: "+strings.Join(sortOrders(), ", ")+
+			", with the '-' prefix for the descending order (as published by default)")
+	cmd.Flags().BoolVar(&argChange, "change", false,
+		"add the previous value and the change since the previous publication, "+
+			"the previous rates are read from the storage or requested from the server")
+	cmd.Flags().BoolVar(&argStream, "stream", false,
+		"write every date as soon as it and the dates before it are ready instead of at the end")
+	cmd.Flags().BoolVar(&argNoCache, "no-cache", false,
+		"don't take answers from the cache and don't save them in it")
+	cmd.PersistentFlags().StringVar(&argCacheDir, "cache-dir", defaultCacheDir(),
+		"directory of the server answer cache")
 	cmd.Flags().SortFlags = false
+	cmd.PersistentFlags().SortFlags = false
+
+	cmd.AddCommand(newCatalogCmd())
+	cmd.AddCommand(newCacheCmd())
+	cmd.AddCommand(newDbCmd())
+	cmd.AddCommand(newReprocessCmd())
+	cmd.AddCommand(newConvertCmd())
+
+	return cmd
+}
+
+func newCatalogCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "catalog",
+		Short: "Manages the currency catalog",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "refresh",
+		Short: "Downloads the currency catalog and caches it in the database",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(storeLocation()) == 0 {
+				return fmt.Errorf("pass the name of the database file, for example \"-s currencies.db\"")
+			}
+			storage, err := openStorage(storeLocation())
+			if err != nil {
+				return err
+			}
+			defer storage.Close()
+
+			ctx := context.Background()
+			catalog, err := fetchCurrencyCatalog(ctx, newClientFromArgs(), nil)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to download the currency catalog: %v", err))
+				return fmt.Errorf("failed to download the currency catalog: %v", err)
+			}
+			if err = storage.SaveCatalog(ctx, catalog); err != nil {
+				logger.Error(fmt.Sprintf("failed to save the currency catalog: %v", err))
+				return fmt.Errorf("failed to save the currency catalog: %v", err)
+			}
+			logger.Info(fmt.Sprintf("currency catalog refreshed in %q: %d currencies", storage, catalog.Len()))
+
+			fmt.Printf("%d currencies saved in %q.\n", catalog.Len(), storage)
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "Prints the currency catalog",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storage, err := openStorage(storeLocation())
+			if err != nil && !errors.Is(err, errNoStorage) {
+				return err
+			}
+			if storage != nil {
+				defer storage.Close()
+			}
+
+			client := newClientFromArgs()
+			for _, c := range loadCurrencyCatalog(context.Background(), storage, client, newCacheFromArgs()).Items() {
+				fmt.Printf("%-8s %03d %s  %s\n", c.ID, c.NumCode, c.CharCode, c.Name)
+			}
+			return nil
+		},
+	})
+
+	return cmd
+}
+
+func newCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manages the cache of server answers",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "info",
+		Short: "Prints the cached answers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := newResponseCache(argCacheDir).Entries()
+			if err != nil {
+				return fmt.Errorf("failed to read the cache: %v", err)
+			}
+
+			var size int64
+			for _, e := range entries {
+				fmt.Printf("%s %8d %s\n", e.Modified.Format("2006-01-02 15:04"), e.Size, e.URL)
+				size += e.Size
+			}
+			fmt.Printf("%d answers, %d bytes in %q.\n", len(entries), size, argCacheDir)
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "clear",
+		Short: "Removes all cached answers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			count, err := newResponseCache(argCacheDir).Clear()
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to clear the cache: %v", err))
+				return fmt.Errorf("failed to clear the cache: %v", err)
+			}
+			logger.Info(fmt.Sprintf("cache %q cleared: %d answers removed", argCacheDir, count))
+
+			fmt.Printf("%d answers removed.\n", count)
+			return nil
+		},
+	})
+
+	return cmd
+}
+
+func newDbCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "db",
+		Short: "Manages the database",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := cmd.Root().PersistentPreRunE(cmd, args); err != nil {
+				return err
+			}
+			// the merged databases are passed as arguments
+			if len(storeLocation()) == 0 && cmd.Name() != "merge" {
+				return fmt.Errorf("pass the name of the database file, for example \"-s currencies.db\"")
+			}
+			return nil
+		},
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "migrate",
+		Short: "Applies the pending schema migrations",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storage, err := sqliteStorage(storeLocation())
+			if err != nil {
+				return err
+			}
+			if err = storage.Prepare(); err != nil {
+				return err
+			}
+			defer storage.Close()
+
+			ctx := context.Background()
+			count, err := storage.Migrate(ctx)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to migrate the database: %v", err))
+				return fmt.Errorf("failed to migrate the database: %v", err)
+			}
+			version, err := storage.SchemaVersion(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to read the schema version: %v", err)
+			}
+
+			fmt.Printf("%d migrations applied, %q is at version %d.\n", count, storage.name, version)
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "Prints the schema version and the migrations of the database",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storage, err := existingDbStorage(storeLocation())
+			if err != nil {
+				return err
+			}
+			defer storage.Close()
+
+			status, err := storage.SchemaStatus(context.Background())
+			if err != nil {
+				return fmt.Errorf("failed to read the schema version: %v", err)
+			}
+
+			version, pending := 0, 0
+			for _, m := range status {
+				applied := "pending"
+				if m.AppliedAt.IsZero() {
+					pending++
+				} else {
+					version = m.Version
+					applied = m.AppliedAt.Local().Format("2006-01-02 15:04")
+				}
+				fmt.Printf("%4d %-16s %s\n", m.Version, applied, m.Name)
+			}
+			fmt.Printf("%q is at version %d, the latest is %d, %d migrations pending.\n",
+				storage.name, version, latestSchemaVersion(), pending)
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "backup <file>",
+		Short: "Copies the database to a new file, the database can be used meanwhile",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storage, err := existingDbStorage(storeLocation())
+			if err != nil {
+				return err
+			}
+			defer storage.Close()
+
+			path, err := expandPath(strings.TrimSpace(args[0]))
+			if err != nil {
+				return err
+			}
+			if err = storage.Backup(context.Background(), path); err != nil {
+				logger.Error(fmt.Sprintf("failed to back up the database: %v", err))
+				return fmt.Errorf("failed to back up the database: %v", err)
+			}
+			logger.Info(fmt.Sprintf("database %q backed up to %q", storage.name, path))
+
+			fmt.Printf("%q is copied to %q.\n", storage.name, path)
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "merge <target> <source>...",
+		Short: "Adds the rates of the source databases missing in the target one and reports the differing rates",
+		Args:  cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target, err := sqliteStorage(strings.TrimSpace(args[0]))
+			if err != nil {
+				return err
+			}
+			if err = target.Prepare(); err != nil {
+				return err
+			}
+			defer target.Close()
+
+			ctx := context.Background()
+			if err = target.Init(ctx); err != nil {
+				logger.Error(fmt.Sprintf("failed to migrate the database: %v", err))
+				return fmt.Errorf("failed to migrate the database: %v", err)
+			}
+
+			conflicts := 0
+			for _, arg := range args[1:] {
+				path, err := expandPath(strings.TrimSpace(arg))
+				if err != nil {
+					return err
+				}
+				result, err := target.Merge(ctx, path)
+				if err != nil {
+					logger.Error(fmt.Sprintf("failed to merge %q into %q: %v", path, target.name, err))
+					return fmt.Errorf("failed to merge %q: %v", path, err)
+				}
+				logger.Info(fmt.Sprintf("%q merged into %q: %d currencies, %d fetches, %d revisions, %d conflicts",
+					path, target.name, result.Currencies, result.Fetches, result.Revisions, len(result.Conflicts)))
+
+				for _, c := range result.Conflicts {
+					logger.Warn(fmt.Sprintf("merge conflict with %q: %s", path, c))
+					fmt.Printf("conflict %s\n", c)
+				}
+				fmt.Printf("%q merged: %d revisions, %d fetches, %d currencies added or updated, %d conflicts.\n",
+					path, result.Revisions, result.Fetches, result.Currencies, len(result.Conflicts))
+				conflicts += len(result.Conflicts)
+			}
+
+			if conflicts > 0 {
+				return fmt.Errorf("%d rates differ, the ones of %q are kept", conflicts, target.name)
+			}
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "vacuum",
+		Short: "Rebuilds the database file to free the unused space",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storage, err := existingDbStorage(storeLocation())
+			if err != nil {
+				return err
+			}
+			defer storage.Close()
+
+			before := storage.fileSize()
+			if err = storage.Vacuum(context.Background()); err != nil {
+				logger.Error(fmt.Sprintf("failed to vacuum the database: %v", err))
+				return err
+			}
+			after := storage.fileSize()
+			logger.Info(fmt.Sprintf("database %q vacuumed: %d bytes before, %d bytes after", storage.name, before, after))
+
+			fmt.Printf("%q is rebuilt: %d bytes before, %d bytes after.\n", storage.name, before, after)
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "check",
+		Short: "Checks the integrity of the database and the stored rates",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storage, err := existingDbStorage(storeLocation())
+			if err != nil {
+				return err
+			}
+			defer storage.Close()
+
+			ctx := context.Background()
+			version, err := storage.SchemaVersion(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to read the schema version: %v", err)
+			}
+			if version != latestSchemaVersion() {
+				return fmt.Errorf("%q is at version %d, migrate it first with \"db migrate\"", storage.name, version)
+			}
+
+			problems, err := storage.Check(ctx, loadCurrencyCatalog(ctx, storage, nil, nil))
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to check the database: %v", err))
+				return fmt.Errorf("failed to check the database: %v", err)
+			}
+			for _, p := range problems {
+				fmt.Println(p)
+			}
+			logger.Info(fmt.Sprintf("database %q checked: %d problems", storage.name, len(problems)))
+
+			if len(problems) > 0 {
+				return fmt.Errorf("%d problems found in %q", len(problems), storage.name)
+			}
+			fmt.Printf("No problems found in %q.\n", storage.name)
+			return nil
+		},
+	})
+
+	return cmd
+}
+
+func newReprocessCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reprocess",
+		Short: "Decodes the answers archived in the database again and saves the changed rates",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(storeLocation()) == 0 {
+				return fmt.Errorf("pass the name of the database file, for example \"-s currencies.db\"")
+			}
+			storage, err := openStorage(storeLocation())
+			if err != nil {
+				return err
+			}
+			defer storage.Close()
+
+			ctx := context.Background()
+			catalog := loadCurrencyCatalog(ctx, storage, nil, nil)
+			count, revised, err := reprocessFetches(ctx, storage, catalog, newRatesValidator(catalog, argStrict))
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to reprocess the archived answers: %v", err))
+				return fmt.Errorf("failed to reprocess the archived answers: %v", err)
+			}
+			logger.Info(fmt.Sprintf("%d archived answers reprocessed in %q, %d rates revised", count, storage, revised))
+
+			fmt.Printf("%d answers reprocessed, %d rates revised.\n", count, revised)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&argStrict, "strict", false,
+		"skip an answer if it has any inconsistencies instead of reporting them")
+
+	return cmd
+}
+
+func newConvertCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "convert <amount> <from> <to>",
+		Short:   "Converts an amount between currencies by the cross rate through rubles",
+		Example: "  cbr_currencies convert 1500 USD KZT --date 10.03.2023",
+		Args:    cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			amount, err := parseDecimal(args[0])
+			if err != nil {
+				return fmt.Errorf("amount value %q is incorrect", args[0])
+			}
+
+			date := newExchRateQuery().time
+			if cmd.Flags().Changed("date") {
+				if date, err = parseDate(strings.TrimSpace(argConvertDate)); err != nil {
+					return fmt.Errorf("date value %q is incorrect", argConvertDate)
+				}
+			}
+			if argPrecision < 0 || argPrecision > maxDecimalScale {
+				return fmt.Errorf("precision value %d is incorrect", argPrecision)
+			}
+			mode, err := parseRoundingMode(argRounding)
+			if err != nil {
+				return err
+			}
+			if argOffline && len(storeLocation()) == 0 {
+				return fmt.Errorf("the storage must be set with --offline")
+			}
+
+			storage, err := openStorage(storeLocation())
+			if err != nil && !errors.Is(err, errNoStorage) {
+				return err
+			}
+			if storage != nil {
+				defer storage.Close()
+			}
+
+			ctx := context.Background()
+			var (
+				client *CbrClient
+				fetch  func(context.Context, RateQuery) *QueryResult
+			)
+			if !argOffline {
+				client = newClientFromArgs()
+			}
+			cache := newCacheFromArgs()
+			catalog := loadCurrencyCatalog(ctx, storage, client, cache)
+			if client != nil {
+				validator := newRatesValidator(catalog, false)
+				fetch = func(ctx context.Context, query RateQuery) *QueryResult {
+					return fetchRates(ctx, client, cache, query, validator, false)
+				}
+			}
+
+			codes := make([]string, 2)
+			for i, c := range args[1:] {
+				codes[i] = strings.ToUpper(strings.TrimSpace(c))
+				if codes[i] != rubleCode && !catalog.CodeExists(codes[i]) {
+					return fmt.Errorf("currency value %q is incorrect", c)
+				}
+			}
+
+			rates := newConversionRates(storage, fetch)
+			from, err := rates.Get(ctx, date, codes[0])
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to get the rate of %s: %v", codes[0], err))
+				return fmt.Errorf("failed to get the rate of %s: %v", codes[0], err)
+			}
+			to, err := rates.Get(ctx, date, codes[1])
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to get the rate of %s: %v", codes[1], err))
+				return fmt.Errorf("failed to get the rate of %s: %v", codes[1], err)
+			}
+
+			conv, err := convertAmount(amount, from, to, int32(argPrecision), mode)
+			if err != nil {
+				return err
+			}
+			logger.Info(fmt.Sprintf("%s %s converted to %s %s on %s", amount, from.CharCode,
+				conv.Result.StringFixed(int32(argPrecision)), to.CharCode, date.Format("02.01.2006")))
+
+			fmt.Printf("%s %s = %s %s on %s\n", amount, from.CharCode,
+				conv.Result.StringFixed(int32(argPrecision)), to.CharCode, date.Format("02.01.2006"))
+			fmt.Printf("1 %s = %s %s\n", from.CharCode, conv.Rate, to.CharCode)
+			for _, r := range []ConversionRate{from, to} {
+				if r.CharCode != rubleCode {
+					fmt.Printf("%8d %s = %s RUB, rates of %s from %q\n", r.Nominal, r.CharCode, r.Value,
+						r.Effective.Format("02.01.2006"), r.Source)
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&argConvertDate, "date", "d", "",
+		"exchange rate date (as day.month.year), today by default")
+	cmd.Flags().IntVar(&argPrecision, "precision", 2,
+		"number of digits after the decimal point of the result")
+	cmd.Flags().StringVar(&argRounding, "rounding", "half-even",
+		"rounding of the result: 'half-even', 'half-up' or 'down'")
+	cmd.Flags().BoolVar(&argOffline, "offline", false,
+		"take the rates from the database only, without requests to the server")
+	cmd.Flags().BoolVar(&argNoCache, "no-cache", false,
+		"don't take answers from the cache and don't save them in it")
 
 	return cmd
 }
 
+// Creates a client configured by the entered flags.
+func newClientFromArgs() *CbrClient {
+	client := newCbrClient(argTimeout, argRetries)
+	client.SetRateLimit(argRate)
+	return client
+}
+
+// Creates the formatter of the output selected by the entered flags.
+func formatterFromArgs() (Formatter, error) {
+	if len(argTemplate) > 0 {
+		return newReportTemplateFormatter(argTemplate)
+	}
+	if len(argFormat) > 0 {
+		return newRecordTemplateFormatter(argFormat)
+	}
+	return newFormatter(argOutput, argChange)
+}
+
+// Creates the response cache configured by the entered flags, nil if it's turned off.
+func newCacheFromArgs() *ResponseCache {
+	if argNoCache {
+		return nil
+	}
+	return newResponseCache(argCacheDir)
+}
+
+// Returns the location of the storage entered with --store or --sql, empty if there is none.
+func storeLocation() string {
+	if len(argStore) > 0 {
+		return argStore
+	}
+	return argSql
+}
+
+// Error of opening a storage without a location, the commands which can work without
+// a storage check it.
+var errNoStorage = errors.New("no storage is set")
+
+// Opens the storage at the location.
+func openStorage(location string) (Storage, error) {
+	if len(strings.TrimSpace(location)) == 0 {
+		return nil, errNoStorage
+	}
+
+	storage, err := newStorage(location)
+	if err != nil {
+		return nil, err
+	}
+	if db, ok := storage.(*DbStorage); ok {
+		if err = db.Prepare(); err != nil {
+			logger.Error(fmt.Sprintf("failed to open the database: %v", err))
+			return nil, err
+		}
+	}
+	if err = storage.Init(context.Background()); err != nil {
+		storage.Close()
+		logger.Error(fmt.Sprintf("failed to create the storage: %v", err))
+		return nil, fmt.Errorf("failed to create the storage: %v", err)
+	}
+	return storage, nil
+}
+
+// Returns the SQLite database at the location, other storages have no schema to manage.
+func sqliteStorage(location string) (*DbStorage, error) {
+	storage, err := newStorage(location)
+	if err != nil {
+		return nil, err
+	}
+	db, ok := storage.(*DbStorage)
+	if !ok {
+		return nil, fmt.Errorf("%q isn't an SQLite database", location)
+	}
+	return db, nil
+}
+
+// Returns the SQLite database at the location, which must exist.
+func existingDbStorage(location string) (*DbStorage, error) {
+	storage, err := sqliteStorage(location)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(storage.name); err != nil {
+		return nil, fmt.Errorf("failed to open the database: %v", err)
+	}
+	return storage, nil
+}
+
 // Checks the entered arguments are empty
 func isArgsEmpty(args []string) bool {
 	if len(args) == 0 {
@@ -89,17 +819,20 @@ func isArgsEmpty(args []string) bool {
 
 // Checks the entered date.
 func isDateCorrect(s string) bool {
-	// default date is 2 Jan 2006
-	if _, err := time.Parse("2.1.06", s); err != nil {
-		if _, err = time.Parse("2.1.2006", s); err != nil {
-			return false
-		}
-	}
-	return true
+	_, err := parseDate(s)
+	return err == nil
 }
 
-// Checks the entered file name.
-func isFileNameCorrect(s string) bool {
-	re := regexp.MustCompile(`^[A-Za-zА-Яа-я]{1,}[A-Za-zА-Яа-я0-9.]{0,}$`)
-	return re.MatchString(s)
+// Checks the entered period can be expanded into dates with the step.
+func isPeriodCorrect(from, to, step string) bool {
+	f, err := parseDate(from)
+	if err != nil {
+		return false
+	}
+	t, err := parseDate(to)
+	if err != nil {
+		return false
+	}
+	_, err = expandDateRange(f, t, step)
+	return err == nil
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -34,7 +36,40 @@ func TestExecuteCommand(t *testing.T) {
 	}
 
 	cmd = newRootCmd()
-	cmd.SetArgs([]string{"-s /usr/d"})
+	cmd.SetArgs([]string{"--from", "1.01.22", "--to", "31.03.2022", "--step", "Weekly"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("got an error: %v", err)
+	}
+	if argFrom != "1.01.22" || argTo != "31.03.2022" || argStep != "weekly" {
+		t.Fatalf("expected \"1.01.22\", \"31.03.2022\", \"weekly\" got %q, %q, %q", argFrom, argTo, argStep)
+	}
+
+	cmd = newRootCmd()
+	cmd.SetArgs([]string{"--from", "1.01.22"})
+	if err := cmd.Execute(); err == nil {
+		t.Fatalf("expected a cmd error got nil")
+	}
+
+	cmd = newRootCmd()
+	cmd.SetArgs([]string{"-d", "1.01.22", "--from", "1.01.22", "--to", "2.01.22"})
+	if err := cmd.Execute(); err == nil {
+		t.Fatalf("expected a cmd error got nil")
+	}
+
+	cmd = newRootCmd()
+	cmd.SetArgs([]string{"--from", "1.01.22", "--to", "2.01.22", "--step", "yearly"})
+	if err := cmd.Execute(); err == nil {
+		t.Fatalf("expected a cmd error got nil")
+	}
+
+	cmd = newRootCmd()
+	cmd.SetArgs([]string{"--offline"})
+	if err := cmd.Execute(); err == nil {
+		t.Fatalf("expected a cmd error got nil")
+	}
+
+	cmd = newRootCmd()
+	cmd.SetArgs([]string{"-s file:?mode=ro"})
 	err := cmd.Execute()
 	if err == nil {
 		t.Fatalf("expected a cmd error got nil")
@@ -43,6 +78,7 @@ func TestExecuteCommand(t *testing.T) {
 	cmd = newRootCmd()
 	cmd.SetArgs([]string{"-s f5.sqlite3"})
 	cmd.Execute()
+	defer removeDbFiles("f5.sqlite3")
 	if argSql != "f5.sqlite3" {
 		t.Fatalf("expected \"f5.sqlite3\" got %v", argSql)
 	}
@@ -71,21 +107,49 @@ func TestCmdIsDateCorrect(t *testing.T) {
 	}
 }
 
-func TestCmdIsFileNameCorrect(t *testing.T) {
-	if isFileNameCorrect("") {
-		t.Fatalf("file name must not be an empty string")
+func TestCmdIsPeriodCorrect(t *testing.T) {
+	if !isPeriodCorrect("01.01.2020", "31.12.2022", stepDaily) {
+		t.Fatalf("valid period failed validation")
+	}
+	if isPeriodCorrect("31.12.2022", "01.01.2020", stepDaily) {
+		t.Fatalf("period must not be reversed")
 	}
-	if isFileNameCorrect("1") {
-		t.Fatalf("file name must not start with a digit")
+	if isPeriodCorrect("01.01.1022", "31.12.2022", stepDaily) {
+		t.Fatalf("period must not be longer than %d dates", maxPeriodDates)
 	}
-	if isFileNameCorrect("/f1") {
-		t.Fatalf("file name must contain only letters and digits")
+
+	cmd := newRootCmd()
+	cmd.SetArgs([]string{"--from", "01.01.1022", "--to", "31.12.2022", "--offline", "--store", "mem://"})
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "01.01.1022") {
+		t.Fatalf("expected an error of the period got %v", err)
 	}
+}
 
-	if !isFileNameCorrect("f1") {
-		t.Fatalf("valid file name failed validation")
+func TestCatalogListWithoutStorage(t *testing.T) {
+	// the catalog is taken from the cache, so that nothing is requested
+	dir := t.TempDir()
+	answer := `<?xml version="1.0" encoding="windows-1251"?>
+	<Valuta name="Foreign Currency Market Lib">
+		<Item ID="R01235">
+			<Name>Доллар США</Name>
+			<EngName>US Dollar</EngName>
+			<Nominal>1</Nominal>
+			<ParentCode>R01235    </ParentCode>
+			<ISO_Num_Code>840</ISO_Num_Code>
+			<ISO_Char_Code>USD</ISO_Char_Code>
+		</Item>
+	</Valuta>`
+	if err := newResponseCache(dir).Put(catalogLink, []byte(answer)); err != nil {
+		t.Fatalf("failed to cache the catalog: %v", err)
 	}
-	if !isFileNameCorrect("f1.sqlite3") {
-		t.Fatalf("valid file name failed validation")
+
+	cmd := newRootCmd()
+	cmd.SetArgs([]string{"catalog", "list", "--cache-dir", dir})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("got an error: %v", err)
+	}
+
+	if _, err := openStorage(""); !errors.Is(err, errNoStorage) {
+		t.Fatalf("expected %v got %v", errNoStorage, err)
 	}
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The letter code of the ruble, the rates of the other currencies are in it.
+const rubleCode = "RUB"
+
+// Exchange rate of a currency in rubles used in a conversion.
+type ConversionRate struct {
+	CharCode  string
+	Effective time.Time // the date the rate was published for
+	Nominal   int
+	Value     Decimal // the value of 'Nominal' units in rubles
+	Source    string  // where the rate was taken from, empty for the ruble
+}
+
+// Result of a conversion of an amount from one currency to another.
+type Conversion struct {
+	Amount   Decimal
+	From, To ConversionRate
+	Rate     Decimal // the value of one unit of 'From' in units of 'To'
+	Result   Decimal // the amount in 'To'
+}
+
+// Converts the amount by the cross rate through rubles. The result is rounded to the given
+// number of digits after the decimal point, the cross rate is kept to 'unitValuePlaces'.
+func convertAmount(amount Decimal, from, to ConversionRate, places int32, mode RoundingMode) (*Conversion, error) {
+	if from.Nominal < 1 || to.Nominal < 1 || from.Value.Sign() <= 0 || to.Value.Sign() <= 0 {
+		return nil, fmt.Errorf("incorrect rates %s %v and %s %v", from.CharCode, from.Value, to.CharCode, to.Value)
+	}
+
+	// amount * (from.Value / from.Nominal) / (to.Value / to.Nominal)
+	tooLarge := func(err error) error {
+		return fmt.Errorf("%s %s can't be converted to %s: %v", amount, from.CharCode, to.CharCode, err)
+	}
+	num, err := from.Value.Mul(newDecimalFromInt(int64(to.Nominal)))
+	if err != nil {
+		return nil, tooLarge(err)
+	}
+	den, err := to.Value.Mul(newDecimalFromInt(int64(from.Nominal)))
+	if err != nil {
+		return nil, tooLarge(err)
+	}
+	conv := &Conversion{Amount: amount, From: from, To: to}
+	if conv.Rate, err = num.Div(den, unitValuePlaces, mode); err != nil {
+		return nil, tooLarge(err)
+	}
+	product, err := amount.Mul(num)
+	if err != nil {
+		return nil, tooLarge(err)
+	}
+	if conv.Result, err = product.Div(den, places, mode); err != nil {
+		return nil, tooLarge(err)
+	}
+	return conv, nil
+}
+
+// 'ConversionRates' looks up the exchange rates for conversions in the storage, then
+// in the cache or on the server.
+type ConversionRates struct {
+	storage Storage                                                 // nil if there is none
+	fetch   func(ctx context.Context, query RateQuery) *QueryResult // nil to use the storage only
+	days    map[string]*QueryResult                                 // the answers by the requested date
+}
+
+// Creates a 'ConversionRates' instance. The storage and 'fetch' may be nil.
+func newConversionRates(storage Storage, fetch func(context.Context, RateQuery) *QueryResult) *ConversionRates {
+	return &ConversionRates{storage: storage, fetch: fetch, days: map[string]*QueryResult{}}
+}
+
+// Returns the exchange rate of the currency on the date.
+func (c *ConversionRates) Get(ctx context.Context, date time.Time, code string) (ConversionRate, error) {
+	if code == rubleCode {
+		return ConversionRate{CharCode: code, Effective: date, Nominal: 1, Value: newDecimalFromInt(1)}, nil
+	}
+
+	if c.storage != nil {
+		rate, err := c.storage.GetRate(ctx, date, code)
+		if err == nil {
+			return ConversionRate{
+				CharCode:  code,
+				Effective: rate.Effective,
+				Nominal:   rate.Nominal,
+				Value:     rate.Value,
+				Source:    c.storage.String(),
+			}, nil
+		}
+		if !errors.Is(err, errNoStoredRates) {
+			return ConversionRate{}, err
+		}
+	}
+	if c.fetch == nil {
+		return ConversionRate{}, fmt.Errorf("no rate of %s on %s in the storage %q", code, date.Format("02.01.2006"), c.storage)
+	}
+
+	key := date.Format("2006-01-02")
+	result, ok := c.days[key]
+	if !ok {
+		query := newExchRateQuery()
+		query.SetTime(date)
+		result = c.fetch(ctx, query)
+		c.days[key] = result
+	}
+	if result.Err != nil {
+		return ConversionRate{}, result.Err
+	}
+
+	source := result.Query.String()
+	if result.Fetch != nil && result.Fetch.FromCache {
+		source = "the cache"
+	}
+	for _, rates := range result.Rates {
+		for _, cur := range rates.Currencies {
+			if cur.CharCode == code {
+				return ConversionRate{
+					CharCode:  code,
+					Effective: rates.Effective,
+					Nominal:   cur.Nominal,
+					Value:     cur.Value,
+					Source:    source,
+				}, nil
+			}
+		}
+	}
+	return ConversionRate{}, fmt.Errorf("no rate of %s on %s", code, date.Format("02.01.2006"))
+}
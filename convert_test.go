@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestConvertAmount(t *testing.T) {
+	usd := ConversionRate{CharCode: "USD", Nominal: 1, Value: mustParseDecimal("75.5")}
+	kzt := ConversionRate{CharCode: "KZT", Nominal: 100, Value: mustParseDecimal("16.7")}
+	rub := ConversionRate{CharCode: rubleCode, Nominal: 1, Value: newDecimalFromInt(1)}
+
+	tests := []struct {
+		amount       string
+		from, to     ConversionRate
+		places       int32
+		mode         RoundingMode
+		rate, result string
+	}{
+		{"1500", usd, kzt, 2, RoundHalfEven, "452.09580838", "678143.71"},
+		{"678143.71", kzt, usd, 2, RoundHalfEven, "0.00221192", "1500"},
+		{"1500", usd, rub, 2, RoundHalfEven, "75.5", "113250"},
+		{"16.7", rub, kzt, 4, RoundHalfEven, "5.98802395", "100"},
+		{"5", ConversionRate{CharCode: "XTS", Nominal: 10, Value: mustParseDecimal("5")}, rub, 0, RoundHalfEven, "0.5", "2"},
+		{"5", ConversionRate{CharCode: "XTS", Nominal: 10, Value: mustParseDecimal("5")}, rub, 0, RoundHalfUp, "0.5", "3"},
+	}
+	for _, test := range tests {
+		conv, err := convertAmount(mustParseDecimal(test.amount), test.from, test.to, test.places, test.mode)
+		if err != nil {
+			t.Fatalf("failed to convert %s %s: %v", test.amount, test.from.CharCode, err)
+		}
+		if conv.Rate.String() != test.rate || conv.Result.String() != test.result {
+			t.Fatalf("%s %s to %s: expected %s by %s got %s by %s", test.amount, test.from.CharCode,
+				test.to.CharCode, test.result, test.rate, conv.Result, conv.Rate)
+		}
+	}
+
+	if _, err := convertAmount(mustParseDecimal("1"), usd, ConversionRate{CharCode: "XTS"}, 2, RoundHalfEven); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+	if _, err := convertAmount(mustParseDecimal("9000000000000000000"), usd, rub, 2, RoundHalfEven); err == nil || !strings.Contains(err.Error(), errDecimalOverflow.Error()) {
+		t.Fatalf("expected %v got %v", errDecimalOverflow, err)
+	}
+}
+
+func TestConversionRates(t *testing.T) {
+	ctx := context.Background()
+	storage := newMemStorage()
+	rates := newTestDayRates()
+	if _, err := storage.Add(ctx, rates, newCurrencyFilter(newBuiltinCatalog())); err != nil {
+		t.Fatalf("failed to add rates: %v", err)
+	}
+	date := rates.Query.LatestDate()
+
+	fetched := 0
+	conversion := newConversionRates(storage, func(ctx context.Context, query RateQuery) *QueryResult {
+		fetched++
+		day := newTestDayRates()
+		day.Currencies = append(day.Currencies,
+			Currency{NumCode: 398, CharCode: "KZT", Nominal: 100, Value: mustParseDecimal("16.7")})
+		return &QueryResult{Query: query, Rates: []DayRates{*day}}
+	})
+
+	rate, err := conversion.Get(ctx, date, "JPY")
+	if err != nil || rate.Nominal != 100 || rate.Source != "mem://" || fetched != 0 {
+		t.Fatalf("expected JPY from the storage got %v: %v", rate, err)
+	}
+	if rate, err = conversion.Get(ctx, date, "KZT"); err != nil || rate.Value.String() != "16.7" || fetched != 1 {
+		t.Fatalf("expected KZT from the server got %v: %v", rate, err)
+	}
+	if _, err = conversion.Get(ctx, date, "EUR"); err == nil || fetched != 1 {
+		t.Fatalf("expected an error and 1 request got %d: %v", fetched, err)
+	}
+	if rate, err = conversion.Get(ctx, date, rubleCode); err != nil || rate.Value.String() != "1" {
+		t.Fatalf("expected 1 got %v: %v", rate, err)
+	}
+
+	offline := newConversionRates(storage, nil)
+	if _, err = offline.Get(ctx, date, "KZT"); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+
+	failed := newConversionRates(nil, func(ctx context.Context, query RateQuery) *QueryResult {
+		return &QueryResult{Query: query, Err: fmt.Errorf("request wasn't completed")}
+	})
+	if _, err = failed.Get(ctx, date, "USD"); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
-	"context"
 	"encoding/xml"
 	"fmt"
 	"io"
-	"net/http"
+	"net/url"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -31,15 +30,9 @@ func (q *ExchRateQuery) Date(format string) string {
 
 // Takes a string in format "day.month.year" and sets the date in the query.
 func (q *ExchRateQuery) SetDate(date string) error {
-	var dt time.Time
-	var err error
-	date = strings.TrimSpace(date)
-
-	// default date is 2 Jan 2006
-	if dt, err = time.Parse("2.1.06", date); err != nil {
-		if dt, err = time.Parse("2.1.2006", date); err != nil {
-			return fmt.Errorf("incorrect date format: %v", err)
-		}
+	dt, err := parseDate(date)
+	if err != nil {
+		return err
 	}
 
 	q.time = dt
@@ -47,6 +40,21 @@ func (q *ExchRateQuery) SetDate(date string) error {
 	return nil
 }
 
+// Sets the date in the query.
+func (q *ExchRateQuery) SetTime(t time.Time) {
+	q.time = t
+}
+
+// Returns the requested date.
+func (q *ExchRateQuery) LatestDate() time.Time {
+	return q.time
+}
+
+// Returns the requested date.
+func (q *ExchRateQuery) Dates() []time.Time {
+	return []time.Time{q.time}
+}
+
 // Builds the query string.
 func (q *ExchRateQuery) String() string {
 	var s strings.Builder
@@ -55,23 +63,305 @@ func (q *ExchRateQuery) String() string {
 	return s.String()
 }
 
+// Request to the CBR server which answers with the exchange rates for one or more dates.
+type RateQuery interface {
+	// Builds the query string.
+	String() string
+	// Returns the latest requested date.
+	LatestDate() time.Time
+	// Returns the requested dates.
+	Dates() []time.Time
+	// Decodes the server answer into the exchange rates grouped by date.
+	Decode(answer io.Reader) ([]DayRates, error)
+}
+
+// Exchange rates on one date.
+type DayRates struct {
+	Query      *ExchRateQuery // the requested date
+	Effective  time.Time      // the date the rates were published for
+	RawDate    string         // the date the rates were published for as CBR sent it
+	Currencies Currencies
+	Fetched    time.Time // when the answer was received from the server, zero if unknown
+	Source     string    // where the answer was taken from, for example the query URL
+	FetchID    int64     // the archived answer in the database, zero if it isn't archived
+	// the rates of the previous publication by the letter code, nil if they aren't looked up
+	Previous map[string]StoredRate
+	// the rates published before known from the same answer, nil if the answer doesn't have them
+	Preceding map[string]StoredRate
+}
+
+// Returns the effective date in the given format according to the Time.Format specification.
+func (r *DayRates) EffectiveDate(format string) string {
+	return r.Effective.Format(format)
+}
+
+// Checks the rates were published for another date than requested, for example
+// a weekend or a holiday gets the rates of the last business day.
+func (r *DayRates) IsEffectiveDateDiffers() bool {
+	return r.EffectiveDate("2006-01-02") != r.Query.Date("2006-01-02")
+}
+
+// 'DynamicQuery' requests the exchange rate dynamics of one currency for a period.
+type DynamicQuery struct {
+	link     string
+	currency CurrencyInfo
+	dates    []time.Time
+}
+
+// Creates a 'DynamicQuery' instance for the given sorted dates.
+func newDynamicQuery(currency CurrencyInfo, dates []time.Time) *DynamicQuery {
+	return &DynamicQuery{
+		link:     "https://www.cbr.ru/scripts/XML_dynamic.asp",
+		currency: currency,
+		dates:    dates,
+	}
+}
+
+// Returns the first date of the requested period. The period starts a bit earlier than
+// the first date, so a weekend or a holiday gets the last published rate as the daily
+// endpoint does.
+func (q *DynamicQuery) From() time.Time {
+	return q.dates[0].AddDate(0, 0, -dynamicLookbackDays)
+}
+
+// Returns the last date of the requested period.
+func (q *DynamicQuery) To() time.Time {
+	return q.dates[len(q.dates)-1]
+}
+
+// Returns the last date of the requested period.
+func (q *DynamicQuery) LatestDate() time.Time {
+	return q.To()
+}
+
+// Returns the requested dates.
+func (q *DynamicQuery) Dates() []time.Time {
+	return q.dates
+}
+
+// Builds the query string.
+func (q *DynamicQuery) String() string {
+	var s strings.Builder
+	s.WriteString(q.link)
+	s.WriteString("?date_req1=")
+	s.WriteString(q.From().Format("02/01/2006"))
+	s.WriteString("&date_req2=")
+	s.WriteString(q.To().Format("02/01/2006"))
+	s.WriteString("&VAL_NM_RQ=")
+	s.WriteString(q.currency.ID)
+	return s.String()
+}
+
+// The number of days before the first requested date included in a dynamic query.
+const dynamicLookbackDays = 10
+
+// Plans the requests for the dates: daily requests return all currencies on one date,
+// dynamic requests return one currency for the whole period. Picks the kind which needs
+// fewer requests.
+func planQueries(dates []time.Time, filter *CurrencyFilter, catalog *CurrencyCatalog) []RateQuery {
+	dates = append([]time.Time(nil), dates...)
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+
+	var codes []string
+	if filter.IsEnabled() {
+		codes = filter.EnabledCodes()
+	}
+
+	queries := []RateQuery{}
+	if len(codes) > 0 && len(codes) < len(dates) {
+		for _, c := range codes {
+			if info, ok := catalog.Lookup(c); ok && info.ID != "" {
+				queries = append(queries, newDynamicQuery(info, dates))
+			}
+		}
+		if len(queries) == len(codes) {
+			return queries
+		}
+		queries = queries[:0]
+	}
+
+	for _, d := range dates {
+		q := newExchRateQuery()
+		q.SetTime(d)
+		queries = append(queries, q)
+	}
+	return queries
+}
+
+// Rebuilds the query from its string and the requested dates, the currency of a dynamic
+// query is looked up in the catalog.
+func parseRateQuery(query string, dates []time.Time, catalog *CurrencyCatalog) (RateQuery, error) {
+	if len(dates) == 0 {
+		return nil, fmt.Errorf("no dates of query %q", query)
+	}
+
+	daily := newExchRateQuery()
+	if strings.HasPrefix(query, daily.link) {
+		daily.SetTime(dates[0])
+		return daily, nil
+	}
+
+	link, params, _ := strings.Cut(query, "?")
+	if link == newDynamicQuery(CurrencyInfo{}, nil).link {
+		values, err := url.ParseQuery(params)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect query %q: %v", query, err)
+		}
+		id := values.Get("VAL_NM_RQ")
+		info, ok := catalog.LookupID(id)
+		if !ok {
+			return nil, fmt.Errorf("unknown currency %q of query %q", id, query)
+		}
+		return newDynamicQuery(info, dates), nil
+	}
+
+	return nil, fmt.Errorf("unknown query %q", query)
+}
+
+// Parses a string in format "day.month.year".
+func parseDate(date string) (time.Time, error) {
+	var dt time.Time
+	var err error
+	date = strings.TrimSpace(date)
+
+	// default date is 2 Jan 2006
+	if dt, err = time.Parse("2.1.06", date); err != nil {
+		if dt, err = time.Parse("2.1.2006", date); err != nil {
+			return time.Time{}, fmt.Errorf("incorrect date format: %v", err)
+		}
+	}
+
+	return dt, nil
+}
+
+// Parses a moment entered as day.month.year with an optional time as hours:minutes
+// or hours:minutes:seconds in the local time zone, or in RFC 3339. A date without
+// a time means the end of the day.
+func parseMoment(moment string) (time.Time, error) {
+	moment = strings.TrimSpace(moment)
+	if dt, err := time.Parse(time.RFC3339, moment); err == nil {
+		return dt, nil
+	}
+
+	date, clock, found := strings.Cut(moment, " ")
+	dt, err := parseDate(date)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !found {
+		end := dt.AddDate(0, 0, 1).Add(-time.Microsecond)
+		return time.Date(end.Year(), end.Month(), end.Day(), end.Hour(), end.Minute(), end.Second(),
+			end.Nanosecond(), time.Local), nil
+	}
+
+	var t time.Time
+	if t, err = time.Parse("15:04", strings.TrimSpace(clock)); err != nil {
+		if t, err = time.Parse("15:04:05", strings.TrimSpace(clock)); err != nil {
+			return time.Time{}, fmt.Errorf("incorrect time format: %v", err)
+		}
+	}
+	return time.Date(dt.Year(), dt.Month(), dt.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+}
+
+// Steps of a date range.
+const (
+	stepDaily   = "daily"
+	stepWeekly  = "weekly"
+	stepMonthly = "monthly"
+)
+
+// Checks the step of a date range.
+func isStepCorrect(step string) bool {
+	switch step {
+	case stepDaily, stepWeekly, stepMonthly:
+		return true
+	}
+	return false
+}
+
+// Greatest number of dates a period is expanded into, five years of daily dates.
+const maxPeriodDates = 5 * 366
+
+// Expands the period from 'from' to 'to' inclusive into a list of dates with the given step.
+// A monthly step keeps the day of the month, clamping it to the last day of shorter months.
+// A period of more than 'maxPeriodDates' dates is rejected.
+func expandDateRange(from, to time.Time, step string) ([]time.Time, error) {
+	if to.Before(from) {
+		return nil, fmt.Errorf("the end of the period %s is before its beginning %s",
+			to.Format("02.01.2006"), from.Format("02.01.2006"))
+	}
+
+	var dates []time.Time
+	for i := 0; ; i++ {
+		var dt time.Time
+		switch step {
+		case stepDaily:
+			dt = from.AddDate(0, 0, i)
+		case stepWeekly:
+			dt = from.AddDate(0, 0, 7*i)
+		case stepMonthly:
+			dt = addMonths(from, i)
+		default:
+			return nil, fmt.Errorf("unknown step: %q", step)
+		}
+		if dt.After(to) {
+			break
+		}
+		if len(dates) == maxPeriodDates {
+			return nil, fmt.Errorf("the period from %s to %s has more than %d dates, split it into shorter ones",
+				from.Format("02.01.2006"), to.Format("02.01.2006"), maxPeriodDates)
+		}
+		dates = append(dates, dt)
+	}
+
+	return dates, nil
+}
+
+// Adds months to the date without overflowing into the next month.
+func addMonths(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).AddDate(0, months, 0)
+	last := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, t.Hour(), t.Minute(), t.Second(),
+		t.Nanosecond(), t.Location())
+}
+
 type Currency struct {
+	ID       string `xml:"ID,attr"` // internal CBR code, empty if the answer has none
 	NumCode  int
 	CharCode string
 	Nominal  int
 	Name     string
-	Value    float64
+	Value    Decimal
 }
 
 type Currencies []Currency
 
 type CbrResult struct {
 	XMLName    xml.Name   `xml:"ValCurs"`
+	Date       string     `xml:"Date,attr"`
 	Currencies Currencies `xml:"Valute"`
 }
 
+// Record of the exchange rate dynamics.
+type DynamicRecord struct {
+	Date    string `xml:"Date,attr"`
+	ID      string `xml:"Id,attr"`
+	Nominal int
+	Value   Decimal
+}
+
+type CbrDynamicResult struct {
+	XMLName xml.Name        `xml:"ValCurs"`
+	ID      string          `xml:"ID,attr"`
+	Records []DynamicRecord `xml:"Record"`
+}
+
 func (c Currency) String() string {
-	return fmt.Sprintf("%8d %s\t%10.4f RUB", c.Nominal, c.CharCode, c.Value)
+	return fmt.Sprintf("%8d %s\t%10s RUB", c.Nominal, c.CharCode, c.Value.StringFixed(4))
 }
 
 // 'CurrencyFilter' filters interested currencies, if any have been set.
@@ -80,46 +370,15 @@ type CurrencyFilter struct {
 	list    map[string]bool
 }
 
-// Creates a new disabled `CurrencyFilter` instance.
-func newCurrencyFilter() *CurrencyFilter {
+// Creates a new disabled `CurrencyFilter` instance for the currencies of the catalog.
+func newCurrencyFilter(catalog *CurrencyCatalog) *CurrencyFilter {
+	list := make(map[string]bool, catalog.Len())
+	for _, c := range catalog.Items() {
+		list[c.CharCode] = false
+	}
 	return &CurrencyFilter{
 		enabled: false,
-		list: map[string]bool{
-			"AUD": false,
-			"AZN": false,
-			"AMD": false,
-			"BYN": false,
-			"BGN": false,
-			"BRL": false,
-			"HUF": false,
-			"KRW": false,
-			"HKD": false,
-			"DKK": false,
-			"USD": false,
-			"EUR": false,
-			"INR": false,
-			"KZT": false,
-			"CAD": false,
-			"KGS": false,
-			"CNY": false,
-			"MDL": false,
-			"TMT": false,
-			"NOK": false,
-			"PLN": false,
-			"RON": false,
-			"XDR": false,
-			"SGD": false,
-			"TJS": false,
-			"TRY": false,
-			"UZS": false,
-			"UAH": false,
-			"GBP": false,
-			"CZK": false,
-			"SEK": false,
-			"CHF": false,
-			"ZAR": false,
-			"JPY": false,
-		},
+		list:    list,
 	}
 }
 
@@ -152,6 +411,18 @@ func (f *CurrencyFilter) IsCurrencyDisabled(code string) bool {
 	return !f.IsCurrencyEnabled(code)
 }
 
+// Returns the sorted codes of the enabled currencies.
+func (f *CurrencyFilter) EnabledCodes() []string {
+	codes := []string{}
+	for c, enabled := range f.list {
+		if enabled {
+			codes = append(codes, c)
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
 func (f *CurrencyFilter) CurrencyEnable(code string) error {
 	if _, ok := f.list[code]; ok {
 		f.list[code] = true
@@ -159,67 +430,3 @@ func (f *CurrencyFilter) CurrencyEnable(code string) error {
 	}
 	return fmt.Errorf("currency code is incorrect: %s", code)
 }
-
-// Http client.
-type CbrClient struct {
-	client *http.Client
-}
-
-// Creates a 'CbrClient' instance.
-func newCbrClient() *CbrClient {
-	tr := &http.Transport{
-		IdleConnTimeout:   5 * time.Second,
-		DisableKeepAlives: true,
-	}
-
-	return &CbrClient{
-		client: &http.Client{Transport: tr},
-	}
-}
-
-// Makes a request to the server to get exchange rate data.
-func (c *CbrClient) Get(ctx context.Context, query string) (string, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", query, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request '%s': %v", query, err)
-	}
-	req.Header.Add("Accept", `text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8`)
-	req.Header.Add("User-Agent", `Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/112.0`)
-	req.Header.Add("Connection", "close")
-
-	resp, err := c.client.Do(req)
-	if resp != nil {
-		defer resp.Body.Close()
-	}
-	if err != nil {
-		return "", fmt.Errorf("request '%s' failed: %v", query, err)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %v", err)
-	}
-
-	return string(body), nil
-}
-
-type ResultPrinter struct {
-	sync.Mutex
-}
-
-func newResultPrinter() *ResultPrinter {
-	return &ResultPrinter{}
-}
-
-func (w *ResultPrinter) print(query *ExchRateQuery, filter *CurrencyFilter, currencies *Currencies) {
-	w.Lock()
-	defer w.Unlock()
-
-	fmt.Printf("\nData on %s\n", query.Date("02.01.2006"))
-	for _, c := range *currencies {
-		if filter.IsEnabled() && filter.IsCurrencyDisabled(c.CharCode) {
-			continue
-		}
-		fmt.Println(c)
-	}
-}
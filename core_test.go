@@ -5,7 +5,7 @@ import (
 )
 
 func TestCurrencyCodeExists(t *testing.T) {
-	f := newCurrencyFilter()
+	f := newCurrencyFilter(newBuiltinCatalog())
 	if f.CodeExists("") {
 		t.Fatalf("empty string found in the list of currency codes")
 	}
@@ -21,13 +21,13 @@ func TestCurrencyCodeExists(t *testing.T) {
 }
 
 func TestNewCurrencyFilterIsDisabled(t *testing.T) {
-	if newCurrencyFilter().IsEnabled() {
+	if newCurrencyFilter(newBuiltinCatalog()).IsEnabled() {
 		t.Fatalf("new currency filter is enabled")
 	}
 }
 
 func TestCurrencyFilterIsEnabled(t *testing.T) {
-	f := newCurrencyFilter()
+	f := newCurrencyFilter(newBuiltinCatalog())
 
 	f.Enable()
 	if !f.IsEnabled() {
@@ -43,7 +43,7 @@ func TestCurrencyFilterIsEnabled(t *testing.T) {
 func TestCurrencyFilterEnableCodes(t *testing.T) {
 	var err error
 	currencies := []string{"USD", "EUR", "AUD"}
-	f := newCurrencyFilter()
+	f := newCurrencyFilter(newBuiltinCatalog())
 
 	for _, c := range currencies {
 		if err = f.CurrencyEnable(c); err != nil {
@@ -79,3 +79,104 @@ func TestExchRateQuery(t *testing.T) {
 		t.Fatalf("expected %s got %s", expected, q.String())
 	}
 }
+
+func TestExpandDateRange(t *testing.T) {
+	from, _ := parseDate("30.01.2022")
+	to, _ := parseDate("30.04.2022")
+
+	dates, err := expandDateRange(from, to, stepMonthly)
+	if err != nil {
+		t.Fatalf("failed to expand the period: %v", err)
+	}
+	expected := []string{"30.01.2022", "28.02.2022", "30.03.2022", "30.04.2022"}
+	if len(dates) != len(expected) {
+		t.Fatalf("expected %d dates got %d", len(expected), len(dates))
+	}
+	for i, d := range dates {
+		if d.Format("02.01.2006") != expected[i] {
+			t.Fatalf("expected %s got %s", expected[i], d.Format("02.01.2006"))
+		}
+	}
+
+	if dates, _ = expandDateRange(from, to, stepDaily); len(dates) != 91 {
+		t.Fatalf("expected 91 dates got %d", len(dates))
+	}
+	if dates, _ = expandDateRange(from, to, stepWeekly); len(dates) != 13 {
+		t.Fatalf("expected 13 dates got %d", len(dates))
+	}
+
+	if _, err = expandDateRange(to, from, stepDaily); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+	if _, err = expandDateRange(from, to, "yearly"); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+
+	// a period of a thousand years is rejected, the same period is fine monthly
+	from, _ = parseDate("01.01.1022")
+	if _, err = expandDateRange(from, to, stepDaily); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+	from, _ = parseDate("01.01.2017")
+	if dates, err = expandDateRange(from, to, stepDaily); err == nil || dates != nil {
+		t.Fatalf("expected an error got %d dates", len(dates))
+	}
+	if dates, err = expandDateRange(from, to, stepMonthly); err != nil || len(dates) != 64 {
+		t.Fatalf("expected 64 dates got %d: %v", len(dates), err)
+	}
+}
+
+func TestParseMoment(t *testing.T) {
+	tests := map[string]string{
+		"10.03.2023":                "2023-03-10 23:59:59.999999",
+		"10.03.23 12:30":            "2023-03-10 12:30:00",
+		"10.03.2023 12:30:15":       "2023-03-10 12:30:15",
+		"2023-03-10T12:30:15+03:00": "2023-03-10 09:30:15",
+	}
+	for moment, expected := range tests {
+		dt, err := parseMoment(moment)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", moment, err)
+		}
+		if moment[4] == '-' {
+			dt = dt.UTC()
+		}
+		if got := dt.Format("2006-01-02 15:04:05.999999"); got != expected {
+			t.Fatalf("expected %s got %s", expected, got)
+		}
+	}
+
+	if _, err := parseMoment("10.03.2023 25:00"); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+}
+
+func TestPlanQueries(t *testing.T) {
+	from, _ := parseDate("01.03.2023")
+	to, _ := parseDate("31.03.2023")
+	dates, _ := expandDateRange(from, to, stepDaily)
+
+	f := newCurrencyFilter(newBuiltinCatalog())
+	if queries := planQueries(dates, f, newBuiltinCatalog()); len(queries) != len(dates) {
+		t.Fatalf("expected %d daily queries got %d", len(dates), len(queries))
+	}
+
+	f.CurrencyEnable("USD")
+	f.CurrencyEnable("EUR")
+	f.Enable()
+	queries := planQueries(dates, f, newBuiltinCatalog())
+	if len(queries) != 2 {
+		t.Fatalf("expected 2 dynamic queries got %d", len(queries))
+	}
+	expected := "https://www.cbr.ru/scripts/XML_dynamic.asp?date_req1=19/02/2023&date_req2=31/03/2023&VAL_NM_RQ=R01239"
+	if queries[0].String() != expected {
+		t.Fatalf("expected %s got %s", expected, queries[0].String())
+	}
+
+	if queries = planQueries(dates[:2], f, newBuiltinCatalog()); len(queries) != 2 {
+		t.Fatalf("expected 2 daily queries got %d", len(queries))
+	}
+	if _, ok := queries[0].(*ExchRateQuery); !ok {
+		t.Fatalf("expected a daily query got %T", queries[0])
+	}
+}
@@ -3,72 +3,744 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 const (
-	sqlCreateTable = `
-        CREATE TABLE IF NOT EXISTS cbr_exchange_rate(
-            rate_date TEXT NOT NULL,
-            num_code INTEGER NOT NULL,
-            currency_name TEXT NOT NULL,
-            char_code TEXT NOT NULL,
-            denomination INTEGER NOT NULL,
-            rate_value FLOAT NOT NULL,
-            PRIMARY KEY(rate_date, num_code)
-        );`
-
-	sqlInsertItem = `
-        INSERT OR REPLACE INTO cbr_exchange_rate
-            (rate_date, num_code, currency_name, char_code, denomination, rate_value)
-            VALUES(?, ?, ?, ?, ?, ?);`
+	// the catalog marks the currencies it lists, the ones it no longer lists keep their rates
+	sqlClearCatalog = `
+        UPDATE currencies
+            SET catalog_updated_at = NULL;`
+
+	sqlUpsertCatalogItem = `
+        INSERT INTO currencies
+            (id, num_code, char_code, name, rus_name, catalog_updated_at)
+            VALUES(?1, ?2, ?3, ?4, ?5, ?6)
+            ON CONFLICT(id) DO UPDATE
+                SET num_code = excluded.num_code,
+                    char_code = excluded.char_code,
+                    name = excluded.name,
+                    rus_name = excluded.rus_name,
+                    catalog_updated_at = excluded.catalog_updated_at;`
+
+	sqlSelectCatalog = `
+        SELECT id, num_code, char_code, name, rus_name, catalog_updated_at
+            FROM currencies
+            WHERE catalog_updated_at IS NOT NULL;`
+
+	sqlSelectDay = `
+        SELECT effective_date, num_code, currency_name, char_code, denomination, rate_value
+            FROM cbr_exchange_rate
+            WHERE rate_date = ?
+            ORDER BY revision_id;`
+
+	sqlSelectRate = `
+        SELECT rate_date, effective_date, num_code, currency_name, char_code, denomination, rate_value
+            FROM cbr_exchange_rate
+            WHERE char_code = ?
+                AND (rate_date = ? OR effective_date = ?)
+            ORDER BY rate_date = ? DESC
+            LIMIT 1;`
+
+	sqlSelectPreviousRate = `
+        SELECT rate_date, effective_date, num_code, currency_name, char_code, denomination, rate_value
+            FROM cbr_exchange_rate
+            WHERE char_code = ?
+                AND effective_date < ?
+            ORDER BY effective_date DESC, rate_date DESC
+            LIMIT 1;`
+
+	sqlSelectSeries = `
+        SELECT rate_date, effective_date, num_code, currency_name, char_code, denomination, rate_value
+            FROM cbr_exchange_rate
+            WHERE char_code = ?
+                AND rate_date BETWEEN ? AND ?
+            ORDER BY rate_date;`
+
+	sqlSelectLatestDate = `
+        SELECT COALESCE(MAX(rate_date), '')
+            FROM cbr_exchange_rate;`
+
+	sqlSelectDates = `
+        SELECT DISTINCT rate_date
+            FROM cbr_exchange_rate
+            ORDER BY rate_date;`
+
+	// the bare columns are taken from the row with the latest date
+	sqlSelectCurrencies = `
+        SELECT num_code, char_code, currency_name, MAX(rate_date)
+            FROM cbr_exchange_rate
+            GROUP BY char_code
+            ORDER BY char_code;`
+
+	// a rate without the CBR code belongs to the currency stored with the same codes
+	sqlSelectCurrencyID = `
+        SELECT id
+            FROM currencies
+            WHERE num_code = ?
+                AND char_code = ?
+            ORDER BY catalog_updated_at IS NULL, valid_to DESC
+            LIMIT 1;`
+
+	// the currency is valid on the dates it has rates published for, its name is taken
+	// from the latest rate
+	sqlUpsertCurrency = `
+        INSERT INTO currencies
+            (id, num_code, char_code, name, valid_from, valid_to)
+            VALUES(?1, ?2, ?3, ?4, ?5, ?5)
+            ON CONFLICT(id) DO UPDATE
+                SET name = CASE
+                        WHEN excluded.name <> '' AND excluded.valid_to >= COALESCE(valid_to, '')
+                            THEN excluded.name
+                        ELSE name
+                    END,
+                    valid_from = MIN(COALESCE(valid_from, excluded.valid_from), excluded.valid_from),
+                    valid_to = MAX(COALESCE(valid_to, excluded.valid_to), excluded.valid_to);`
+
+	// a requested date refers to the rates published for its effective date, a mapping
+	// is added only if it differs from the current one
+	sqlInsertRateDate = `
+        INSERT INTO rate_dates
+            (rate_date, currency_id, effective_date, recorded_at)
+            SELECT ?1, ?2, ?3, ?4
+                WHERE COALESCE((
+                    SELECT effective_date
+                        FROM rate_dates
+                        WHERE rate_date = ?1
+                            AND currency_id = ?2
+                        ORDER BY id DESC
+                        LIMIT 1), '') <> ?3;`
+
+	// the rates are stored once by the effective date, a revision is added only if it
+	// differs from the current one
+	sqlInsertRate = `
+        INSERT INTO rates
+            (effective_date, currency_id, denomination, rate_value,
+                fetched_at, recorded_at, source, fetch_id)
+            SELECT ?1, ?2, ?3, ?4, ?5, ?6, ?7, NULLIF(?8, 0)
+                WHERE NOT EXISTS (
+                    SELECT 1
+                        FROM rates r
+                        WHERE effective_date = ?1
+                            AND currency_id = ?2
+                            AND denomination = ?3
+                            AND rate_value = ?4
+                            AND id = (
+                                SELECT MAX(id)
+                                    FROM rates
+                                    WHERE effective_date = ?1
+                                        AND currency_id = ?2));`
+
+	// replaces the view of the current rates in the queries reading them with the rates
+	// and the requested dates recorded by the given time
+	sqlWithRatesAsOf = `
+        WITH cbr_exchange_rate AS (
+            SELECT r.id AS revision_id, d.rate_date, r.effective_date, c.num_code,
+                    c.name AS currency_name, c.char_code, r.denomination, r.rate_value,
+                    r.fetched_at, r.recorded_at, r.source, r.fetch_id, r.currency_id
+                FROM rate_dates d
+                    JOIN rates r ON r.effective_date = d.effective_date
+                        AND r.currency_id = d.currency_id
+                    JOIN currencies c ON c.id = r.currency_id
+                WHERE d.id = (
+                    SELECT MAX(id)
+                        FROM rate_dates
+                        WHERE rate_date = d.rate_date
+                            AND currency_id = d.currency_id
+                            AND recorded_at <= ?1)
+                    AND r.id = (
+                        SELECT MAX(id)
+                            FROM rates
+                            WHERE effective_date = r.effective_date
+                                AND currency_id = r.currency_id
+                                AND recorded_at <= ?1))`
 )
 
+// Connection parameters: concurrent readers don't block the writer, writers wait for
+// each other instead of failing with "database is locked", and transactions take
+// the write lock at once so that they don't deadlock upgrading it. The options of
+// a 'file:' URI take precedence.
+var dbConnParams = url.Values{
+	"_journal_mode": {"WAL"},
+	"_busy_timeout": {"5000"},
+	"_txlock":       {"immediate"},
+}
+
+// Other names of the connection parameters accepted by the driver.
+var dbConnParamAliases = map[string]string{
+	"_journal_mode": "_journal",
+	"_busy_timeout": "_timeout",
+}
+
+// Format of the times stored in the database, fixed width so that they sort as strings.
+const dbTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// 'DbStorage' keeps exchange rates in a SQLite database. The connection is opened
+// on the first use and kept until 'Close'. All methods are safe for concurrent use.
 type DbStorage struct {
-	name string
+	name   string     // the path of the database file
+	params url.Values // the options of the connection
+
+	asOf time.Time // rates are read as they were recorded by this time if it isn't zero
+
+	mu sync.Mutex
+	db *sql.DB
 }
 
 func newDbStorage(name string) *DbStorage {
 	return &DbStorage{name: name}
 }
 
-// Prepares the database for work.
-func (s *DbStorage) Init(ctx context.Context) error {
-	db, err := sql.Open("sqlite3", s.name)
+// Creates a 'DbStorage' instance from the location of the database: a file path, where
+// a leading '~' means the home directory, or a 'file:' URI with SQLite options, for
+// example 'file:/var/lib/rates/cbr.db?_journal=WAL'.
+func newDbStorageAt(location string) (*DbStorage, error) {
+	location = strings.TrimSpace(location)
+	if location == "" {
+		return nil, fmt.Errorf("the database location is empty")
+	}
+
+	name := location
+	var params url.Values
+	if strings.HasPrefix(location, "file:") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect database URI %q: %v", location, err)
+		}
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, fmt.Errorf("incorrect database URI %q: only local files are supported", location)
+		}
+		if name = u.Path; u.Opaque != "" {
+			if name, err = url.PathUnescape(u.Opaque); err != nil {
+				return nil, fmt.Errorf("incorrect database URI %q: %v", location, err)
+			}
+		}
+		params = u.Query()
+	}
+	if name == "" {
+		return nil, fmt.Errorf("the database location %q has no file path", location)
+	}
+
+	name, err := expandPath(name)
 	if err != nil {
-		return fmt.Errorf("failed to open the database: %v", err)
+		return nil, err
+	}
+
+	return &DbStorage{name: name, params: params}, nil
+}
+
+// Returns the path of the database file.
+func (s *DbStorage) String() string {
+	return s.name
+}
+
+// Checks the database can be written, creates the parent directories of the file
+// if they don't exist.
+func (s *DbStorage) Prepare() error {
+	if s.params.Get("mode") == "ro" || s.params.Get("mode") == "memory" {
+		return nil
+	}
+
+	dir := filepath.Dir(s.name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("can't create the database directory %q: %v", dir, err)
+	}
+
+	info, err := os.Stat(s.name)
+	if err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("the database path %q is a directory", s.name)
+		}
+		f, err := os.OpenFile(s.name, os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("the database file %q isn't writable: %v", s.name, err)
+		}
+		return f.Close()
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("can't access the database file %q: %v", s.name, err)
+	}
+
+	// the file is created on the first use, the directory must allow it
+	f, err := os.CreateTemp(dir, ".cbr_currencies-*")
+	if err != nil {
+		return fmt.Errorf("the database directory %q isn't writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Returns the data source name of the database for the driver.
+func (s *DbStorage) dsn() string {
+	params := url.Values{}
+	for k, v := range s.params {
+		params[k] = v
+	}
+	for k, v := range dbConnParams {
+		if _, ok := params[k]; ok {
+			continue
+		}
+		if _, ok := params[dbConnParamAliases[k]]; ok {
+			continue
+		}
+		params[k] = v
+	}
+
+	path := (&url.URL{Path: filepath.ToSlash(s.name)}).EscapedPath()
+	return "file:" + path + "?" + params.Encode()
+}
+
+// Returns the connection to the database, opens it if it isn't open yet.
+func (s *DbStorage) conn() (*sql.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db == nil {
+		db, err := sql.Open("sqlite3", s.dsn())
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the database: %v", err)
+		}
+		s.db = db
+	}
+	return s.db, nil
+}
+
+// Closes the connection to the database. The storage may be used again afterwards,
+// the connection is reopened then.
+func (s *DbStorage) Close() error {
+	if s == nil {
+		return nil
 	}
-	defer db.Close()
 
-	if _, err = s.ExecQuery(ctx, sqlCreateTable); err != nil {
-		return fmt.Errorf("failed to create a table: %v", err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db == nil {
+		return nil
 	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
 
+// Makes the storage read the rates as they were recorded by the given time,
+// a zero time means the current rates.
+func (s *DbStorage) SetAsOf(t time.Time) {
+	s.asOf = t
+}
+
+// Returns the query reading the rates as of the time set by 'SetAsOf' and its parameters.
+func (s *DbStorage) ratesQuery(query string, params ...any) (string, []any) {
+	if s.asOf.IsZero() {
+		return query, params
+	}
+	return sqlWithRatesAsOf + query, append([]any{s.asOf.UTC().Format(dbTimeFormat)}, params...)
+}
+
+// Prepares the database for work: applies the pending migration steps.
+func (s *DbStorage) Init(ctx context.Context) error {
+	if _, err := s.Migrate(ctx); err != nil {
+		return err
+	}
 	return nil
 }
 
-// Adds a new record in the database.
-func (s *DbStorage) Add(ctx context.Context, query *ExchRateQuery, currencies *Currencies,
-	filter *CurrencyFilter) error {
+// Adds the exchange rates on the date in the database in one transaction. Stored rates
+// are never replaced, a changed rate is added as a new revision of it. The rates are kept
+// once by their effective date, the requested date refers to them. Returns the number
+// of the added revisions.
+func (s *DbStorage) Add(ctx context.Context, rates *DayRates, filter *CurrencyFilter) (int, error) {
+	var (
+		db       *sql.DB
+		tx       *sql.Tx
+		currency *sql.Stmt
+		mapping  *sql.Stmt
+		stmt     *sql.Stmt
+		res      sql.Result
+		count    int64
+		added    int
+		err      error
+	)
+
+	if db, err = s.conn(); err != nil {
+		return 0, err
+	}
+
+	if tx, err = db.BeginTx(ctx, nil); err != nil {
+		return 0, fmt.Errorf("failed to begin a transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if currency, err = tx.PrepareContext(ctx, sqlUpsertCurrency); err != nil {
+		return 0, fmt.Errorf("incorrect query: %v", err)
+	}
+	defer currency.Close()
+
+	if mapping, err = tx.PrepareContext(ctx, sqlInsertRateDate); err != nil {
+		return 0, fmt.Errorf("incorrect query: %v", err)
+	}
+	defer mapping.Close()
+
+	if stmt, err = tx.PrepareContext(ctx, sqlInsertRate); err != nil {
+		return 0, fmt.Errorf("incorrect query: %v", err)
+	}
+	defer stmt.Close()
 
-	for _, c := range *currencies {
+	date := rates.Query.Date("2006-01-02")
+	effective := rates.EffectiveDate("2006-01-02")
+	recorded := time.Now().UTC().Format(dbTimeFormat)
+	fetched := ""
+	if !rates.Fetched.IsZero() {
+		fetched = rates.Fetched.UTC().Format(dbTimeFormat)
+	}
+	for _, c := range rates.Currencies {
 		if filter.IsEnabled() && !filter.IsCurrencyEnabled(c.CharCode) {
 			continue
 		}
 
-		rows, err := s.ExecQuery(ctx, sqlInsertItem,
-			query.Date("2006-01-02"),
-			c.NumCode,
-			c.Name,
-			c.CharCode,
-			c.Nominal,
-			c.Value,
+		id, err := currencyID(ctx, tx, c)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = currency.ExecContext(ctx, id, c.NumCode, c.CharCode, c.Name, effective); err != nil {
+			return 0, fmt.Errorf("failed to insert a currency %q: %v", c.CharCode, err)
+		}
+
+		// the rate counts as added if it's new or the date refers to other rates now
+		if res, err = mapping.ExecContext(ctx, date, id, effective, recorded); err != nil {
+			return 0, fmt.Errorf("failed to insert a currency %q: %v", c.CharCode, err)
+		}
+		if count, err = res.RowsAffected(); err != nil {
+			return 0, fmt.Errorf("unknown database query execution status: %v", err)
+		}
+		changed := count > 0
+
+		res, err = stmt.ExecContext(ctx, effective, id, c.Nominal, c.Value,
+			fetched, recorded, rates.Source, rates.FetchID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to insert a currency %q: %v", c.CharCode, err)
+		}
+		if count, err = res.RowsAffected(); err != nil {
+			return 0, fmt.Errorf("unknown database query execution status: %v", err)
+		}
+		if changed || count > 0 {
+			added++
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit a transaction: %v", err)
+	}
+
+	return added, nil
+}
+
+// Returns the key of the currency in the database: the CBR code of the currency, the key
+// of the currency stored with the same codes if the rate has no CBR code, or a key made
+// of the codes for a new currency.
+func currencyID(ctx context.Context, tx *sql.Tx, c Currency) (string, error) {
+	if c.ID != "" {
+		return c.ID, nil
+	}
+
+	var id string
+	err := tx.QueryRowContext(ctx, sqlSelectCurrencyID, c.NumCode, c.CharCode).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return codeCurrencyID(c.NumCode, c.CharCode), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to get the value from the database: %v", err)
+	}
+	return id, nil
+}
+
+// Prefix of the keys of the currencies without a CBR code.
+const codeCurrencyIDPrefix = "ISO:"
+
+// Returns the key of a currency without a CBR code made of its codes, for example 'ISO:840:USD'.
+func codeCurrencyID(numCode int, charCode string) string {
+	return fmt.Sprintf("%s%03d:%s", codeCurrencyIDPrefix, numCode, charCode)
+}
+
+// Exchange rate of a currency stored in the database.
+type StoredRate struct {
+	Date      time.Time // the requested date
+	Effective time.Time // the date the rate was published for
+	Currency
+}
+
+var errNoStoredRates = errors.New("no exchange rates in the database")
+
+// Loads the exchange rates stored on the requested date. Returns nil if there are none.
+func (s *DbStorage) LoadDay(ctx context.Context, query *ExchRateQuery) (*DayRates, error) {
+	rates := &DayRates{Query: query}
+	q, params := s.ratesQuery(sqlSelectDay, query.Date("2006-01-02"))
+	err := s.SelectRows(ctx, func(rows *sql.Rows) error {
+		var c Currency
+		if err := rows.Scan(&rates.RawDate, &c.NumCode, &c.Name, &c.CharCode, &c.Nominal, &c.Value); err != nil {
+			return err
+		}
+		rates.Currencies = append(rates.Currencies, c)
+		return nil
+	}, q, params...)
+	if err != nil {
+		return nil, err
+	}
+	if len(rates.Currencies) == 0 {
+		return nil, nil
+	}
+
+	if rates.Effective, err = time.Parse("2006-01-02", rates.RawDate); err != nil {
+		return nil, fmt.Errorf("incorrect effective date %q: %v", rates.RawDate, err)
+	}
+
+	return rates, nil
+}
+
+// Returns the exchange rate of the currency requested on the date or published for it.
+// Returns 'errNoStoredRates' if there is no such rate.
+func (s *DbStorage) GetRate(ctx context.Context, date time.Time, code string) (*StoredRate, error) {
+	day := date.Format("2006-01-02")
+	rates, err := s.selectRates(ctx, sqlSelectRate, code, day, day, day)
+	if err != nil {
+		return nil, err
+	}
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("%w: %s on %s", errNoStoredRates, code, date.Format("02.01.2006"))
+	}
+	return &rates[0], nil
+}
+
+// Returns the latest exchange rate of the currency published for a date before the given
+// one. Returns 'errNoStoredRates' if there is no such rate.
+func (s *DbStorage) GetPreviousRate(ctx context.Context, before time.Time, code string) (*StoredRate, error) {
+	rates, err := s.selectRates(ctx, sqlSelectPreviousRate, code, before.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("%w: %s before %s", errNoStoredRates, code, before.Format("02.01.2006"))
+	}
+	return &rates[0], nil
+}
+
+// Returns the exchange rates of the currency requested on the dates from 'from' to 'to'
+// inclusive, sorted by date.
+func (s *DbStorage) GetSeries(ctx context.Context, code string, from, to time.Time) ([]StoredRate, error) {
+	return s.selectRates(ctx, sqlSelectSeries, code, from.Format("2006-01-02"), to.Format("2006-01-02"))
+}
+
+// Returns the latest requested date stored in the database.
+// Returns 'errNoStoredRates' if the database is empty.
+func (s *DbStorage) LatestDate(ctx context.Context) (time.Time, error) {
+	var day string
+	query, params := s.ratesQuery(sqlSelectLatestDate)
+	err := s.SelectRows(ctx, func(rows *sql.Rows) error {
+		return rows.Scan(&day)
+	}, query, params...)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if day == "" {
+		return time.Time{}, errNoStoredRates
+	}
+	return parseDbDate(day)
+}
+
+// Returns the requested dates stored in the database, sorted.
+func (s *DbStorage) ListDates(ctx context.Context) ([]time.Time, error) {
+	dates := []time.Time{}
+	query, params := s.ratesQuery(sqlSelectDates)
+	err := s.SelectRows(ctx, func(rows *sql.Rows) error {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			return err
+		}
+		dt, err := parseDbDate(day)
+		if err != nil {
+			return err
+		}
+		dates = append(dates, dt)
+		return nil
+	}, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	return dates, nil
+}
+
+// Returns the currencies stored in the database sorted by code, names are taken
+// from the latest rates.
+func (s *DbStorage) ListCurrencies(ctx context.Context) ([]CurrencyInfo, error) {
+	currencies := []CurrencyInfo{}
+	query, params := s.ratesQuery(sqlSelectCurrencies)
+	err := s.SelectRows(ctx, func(rows *sql.Rows) error {
+		var (
+			c      CurrencyInfo
+			latest string
 		)
-		if err != nil || rows == 0 {
-			return fmt.Errorf("failed to insert a currency: %v", err)
+		if err := rows.Scan(&c.NumCode, &c.CharCode, &c.Name, &latest); err != nil {
+			return err
 		}
+		currencies = append(currencies, c)
+		return nil
+	}, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	return currencies, nil
+}
+
+// Runs the query selecting exchange rates as of the time set by 'SetAsOf'.
+func (s *DbStorage) selectRates(ctx context.Context, query string, params ...any) ([]StoredRate, error) {
+	rates := []StoredRate{}
+	query, params = s.ratesQuery(query, params...)
+	err := s.SelectRows(ctx, func(rows *sql.Rows) error {
+		var (
+			r               StoredRate
+			date, effective string
+			err             error
+		)
+		err = rows.Scan(&date, &effective, &r.NumCode, &r.Name, &r.CharCode, &r.Nominal, &r.Value)
+		if err != nil {
+			return err
+		}
+		if r.Date, err = parseDbDate(date); err != nil {
+			return err
+		}
+		if r.Effective, err = parseDbDate(effective); err != nil {
+			return err
+		}
+		rates = append(rates, r)
+		return nil
+	}, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// Parses a date stored in the database.
+func parseDbDate(date string) (time.Time, error) {
+	dt, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("incorrect date %q in the database: %v", date, err)
+	}
+	return dt, nil
+}
+
+// Replaces the cached currency catalog.
+func (s *DbStorage) SaveCatalog(ctx context.Context, catalog *CurrencyCatalog) error {
+	var (
+		db   *sql.DB
+		tx   *sql.Tx
+		stmt *sql.Stmt
+		err  error
+	)
+
+	if db, err = s.conn(); err != nil {
+		return err
+	}
+
+	if tx, err = db.BeginTx(ctx, nil); err != nil {
+		return fmt.Errorf("failed to begin a transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, sqlClearCatalog); err != nil {
+		return fmt.Errorf("failed to clear the currency catalog: %v", err)
+	}
+
+	if stmt, err = tx.PrepareContext(ctx, sqlUpsertCatalogItem); err != nil {
+		return fmt.Errorf("incorrect query: %v", err)
+	}
+	defer stmt.Close()
+
+	updated := time.Now().UTC().Format(time.RFC3339)
+	for _, c := range catalog.Items() {
+		id := c.ID
+		if id == "" {
+			id = codeCurrencyID(c.NumCode, c.CharCode)
+		}
+		if _, err = stmt.ExecContext(ctx, id, c.NumCode, c.CharCode, c.Name, c.RusName, updated); err != nil {
+			return fmt.Errorf("failed to insert a currency %q: %v", c.CharCode, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit a transaction: %v", err)
+	}
+
+	return nil
+}
+
+// Loads the cached currency catalog. The catalog is empty if it was never saved.
+func (s *DbStorage) LoadCatalog(ctx context.Context) (*CurrencyCatalog, error) {
+	items := []CurrencyInfo{}
+	saved := ""
+	err := s.SelectRows(ctx, func(rows *sql.Rows) error {
+		var (
+			c       CurrencyInfo
+			updated string
+		)
+		if err := rows.Scan(&c.ID, &c.NumCode, &c.CharCode, &c.Name, &c.RusName, &updated); err != nil {
+			return err
+		}
+		if strings.HasPrefix(c.ID, codeCurrencyIDPrefix) {
+			c.ID = ""
+		}
+		items = append(items, c)
+		if updated > saved {
+			saved = updated
+		}
+		return nil
+	}, sqlSelectCatalog)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog := newCurrencyCatalog(items)
+	if saved != "" {
+		// a catalog with an unknown save time is downloaded again
+		catalog.saved, _ = time.Parse(time.RFC3339, saved)
+	}
+	return catalog, nil
+}
+
+// Executes the queries without parameters in one transaction.
+func (s *DbStorage) ExecQueries(ctx context.Context, queries ...string) error {
+	var (
+		db  *sql.DB
+		tx  *sql.Tx
+		err error
+	)
+
+	if db, err = s.conn(); err != nil {
+		return err
+	}
+
+	if tx, err = db.BeginTx(ctx, nil); err != nil {
+		return fmt.Errorf("failed to begin a transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, q := range queries {
+		if _, err = tx.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("database query failed: %v", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit a transaction: %v", err)
 	}
 
 	return nil
@@ -84,14 +756,15 @@ func (s *DbStorage) ExecQuery(ctx context.Context, query string, params ...any)
 		err   error
 	)
 
-	if db, err = sql.Open("sqlite3", s.name); err != nil {
-		return 0, fmt.Errorf("failed to open the database: %v", err)
+	if db, err = s.conn(); err != nil {
+		return 0, err
 	}
-	defer db.Close()
 
-	if tx, err = db.Begin(); err != nil {
+	if tx, err = db.BeginTx(ctx, nil); err != nil {
 		return 0, fmt.Errorf("failed to begin a transaction: %v", err)
 	}
+	defer tx.Rollback()
+
 	if stmt, err = tx.PrepareContext(ctx, query); err != nil {
 		return 0, fmt.Errorf("incorrect query: %v", err)
 	}
@@ -118,10 +791,9 @@ func (s *DbStorage) SelectCount(ctx context.Context, query string, params ...any
 		err   error
 	)
 
-	if db, err = sql.Open("sqlite3", s.name); err != nil {
-		return 0, fmt.Errorf("failed to open the database: %v", err)
+	if db, err = s.conn(); err != nil {
+		return 0, err
 	}
-	defer db.Close()
 
 	if stmt, err = db.PrepareContext(ctx, query); err != nil {
 		return 0, fmt.Errorf("incorrect query: %v", err)
@@ -134,3 +806,40 @@ func (s *DbStorage) SelectCount(ctx context.Context, query string, params ...any
 
 	return count, nil
 }
+
+// Runs the prepared query and calls 'scan' for every selected row.
+func (s *DbStorage) SelectRows(ctx context.Context, scan func(*sql.Rows) error, query string,
+	params ...any) error {
+
+	var (
+		db   *sql.DB
+		stmt *sql.Stmt
+		rows *sql.Rows
+		err  error
+	)
+
+	if db, err = s.conn(); err != nil {
+		return err
+	}
+
+	if stmt, err = db.PrepareContext(ctx, query); err != nil {
+		return fmt.Errorf("incorrect query: %v", err)
+	}
+	defer stmt.Close()
+
+	if rows, err = stmt.QueryContext(ctx, params...); err != nil {
+		return fmt.Errorf("database query failed: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return fmt.Errorf("unable to get the value from the database: %v", err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("unable to get the value from the database: %v", err)
+	}
+
+	return nil
+}
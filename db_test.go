@@ -2,8 +2,14 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -14,6 +20,7 @@ const sqlSelect = `
 	SELECT COUNT(*)
         FROM cbr_exchange_rate
         WHERE rate_date = ?
+            AND effective_date = ?
             AND num_code = ?
             AND currency_name = ?
             AND char_code = ?
@@ -26,6 +33,7 @@ func TestDbStorage(t *testing.T) {
 	ctx := context.Background()
 
 	storage := newDbStorage(dbFilename)
+	defer storage.Close()
 	if err = storage.Init(ctx); err != nil {
 		t.Fatalf("failed to create database: %v", err)
 	}
@@ -38,18 +46,19 @@ func TestDbStorage(t *testing.T) {
 			CharCode: "USD",
 			Nominal:  1,
 			Name:     "US Dollar",
-			Value:    59.9756,
+			Value:    mustParseDecimal("59.9756"),
 		},
 		Currency{
 			NumCode:  978,
 			CharCode: "EUR",
 			Nominal:  1,
 			Name:     "Euro",
-			Value:    62.5903,
+			Value:    mustParseDecimal("62.5903"),
 		},
 	}
 
-	if err = storage.Add(ctx, query, &cs, newCurrencyFilter()); err != nil {
+	rates := &DayRates{Query: query, Effective: query.time.AddDate(0, 0, -1), Currencies: cs}
+	if _, err = storage.Add(ctx, rates, newCurrencyFilter(newBuiltinCatalog())); err != nil {
 		t.Fatalf("failed to insert data: %v", err)
 	}
 
@@ -59,6 +68,7 @@ func TestDbStorage(t *testing.T) {
 			ctx,
 			sqlSelect,
 			query.Date("2006-01-02"),
+			rates.EffectiveDate("2006-01-02"),
 			c.NumCode,
 			c.Name,
 			c.CharCode,
@@ -72,10 +82,513 @@ func TestDbStorage(t *testing.T) {
 			t.Fatalf("expected 1 got %d", count)
 		}
 	}
+
+	stored, err := storage.LoadDay(ctx, query)
+	if err != nil {
+		t.Fatalf("failed to load data: %v", err)
+	}
+	if stored == nil || !reflect.DeepEqual(stored.Currencies, cs) {
+		t.Fatalf("expected %v got %v", cs, stored)
+	}
+	if stored.EffectiveDate("2006-01-02") != rates.EffectiveDate("2006-01-02") {
+		t.Fatalf("expected %s got %s", rates.EffectiveDate("2006-01-02"), stored.EffectiveDate("2006-01-02"))
+	}
+
+	missing := newExchRateQuery()
+	missing.SetDate("01.01.2000")
+	if stored, err = storage.LoadDay(ctx, missing); err != nil || stored != nil {
+		t.Fatalf("expected no data got %v: %v", stored, err)
+	}
+}
+
+func TestDbStorageUpdateSchema(t *testing.T) {
+	const name = "test_old.db"
+	defer removeDbFiles(name)
+
+	ctx := context.Background()
+	storage := newDbStorage(name)
+	defer storage.Close()
+
+	_, err := storage.ExecQuery(ctx, `
+        CREATE TABLE cbr_exchange_rate(
+            rate_date TEXT NOT NULL,
+            num_code INTEGER NOT NULL,
+            currency_name TEXT NOT NULL,
+            char_code TEXT NOT NULL,
+            denomination INTEGER NOT NULL,
+            rate_value FLOAT NOT NULL,
+            PRIMARY KEY(rate_date, num_code)
+        );`)
+	if err != nil {
+		t.Fatalf("failed to create a table: %v", err)
+	}
+	_, err = storage.ExecQuery(ctx, `
+        INSERT INTO cbr_exchange_rate VALUES('2022-01-09', 840, 'US Dollar', 'USD', 1, 74.2926);`)
+	if err != nil {
+		t.Fatalf("failed to insert data: %v", err)
+	}
+
+	if err = storage.Init(ctx); err != nil {
+		t.Fatalf("failed to update database: %v", err)
+	}
+	if version, err := storage.SchemaVersion(ctx); err != nil || version != latestSchemaVersion() {
+		t.Fatalf("expected version %d got %d: %v", latestSchemaVersion(), version, err)
+	}
+
+	count, err := storage.SelectCount(ctx, `
+        SELECT COUNT(*) FROM cbr_exchange_rate
+            WHERE effective_date = '2022-01-09'
+                AND rate_value = '74.2926'
+                AND TYPEOF(rate_value) = 'text';`)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 got %d", count)
+	}
+}
+
+func TestDbStorageRead(t *testing.T) {
+	const name = "test_read.db"
+	defer removeDbFiles(name)
+
+	ctx := context.Background()
+	storage := newDbStorage(name)
+	defer storage.Close()
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+
+	if _, err := storage.LatestDate(ctx); !errors.Is(err, errNoStoredRates) {
+		t.Fatalf("expected %v got %v", errNoStoredRates, err)
+	}
+
+	filter := newCurrencyFilter(newBuiltinCatalog())
+	days := []struct {
+		date, effective, usd, eur, eurName string
+	}{
+		{"10.03.2023", "10.03.2023", "75.5", "79.9", "Euro"},
+		{"12.03.2023", "11.03.2023", "75.6", "80.1", "Euro"},
+		{"14.03.2023", "14.03.2023", "75.7", "80.2", "Euro (EU)"},
+	}
+	for _, d := range days {
+		q := newExchRateQuery()
+		q.SetDate(d.date)
+		effective, _ := parseDate(d.effective)
+		rates := &DayRates{Query: q, Effective: effective, Currencies: Currencies{
+			{NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar", Value: mustParseDecimal(d.usd)},
+			{NumCode: 978, CharCode: "EUR", Nominal: 1, Name: d.eurName, Value: mustParseDecimal(d.eur)},
+		}}
+		if _, err := storage.Add(ctx, rates, filter); err != nil {
+			t.Fatalf("failed to insert data: %v", err)
+		}
+	}
+
+	date, _ := parseDate("12.03.2023")
+	rate, err := storage.GetRate(ctx, date, "EUR")
+	if err != nil {
+		t.Fatalf("failed to get the rate: %v", err)
+	}
+	if rate.Value.String() != "80.1" || rate.Effective.Format("02.01.2006") != "11.03.2023" {
+		t.Fatalf("expected 80.1 of 11.03.2023 got %v", rate)
+	}
+
+	// the rate published for a date which wasn't requested
+	date, _ = parseDate("11.03.2023")
+	if rate, err = storage.GetRate(ctx, date, "USD"); err != nil || rate.Value.String() != "75.6" {
+		t.Fatalf("expected 75.6 got %v: %v", rate, err)
+	}
+
+	date, _ = parseDate("13.03.2023")
+	if _, err = storage.GetRate(ctx, date, "USD"); !errors.Is(err, errNoStoredRates) {
+		t.Fatalf("expected %v got %v", errNoStoredRates, err)
+	}
+
+	from, _ := parseDate("11.03.2023")
+	to, _ := parseDate("31.03.2023")
+	series, err := storage.GetSeries(ctx, "USD", from, to)
+	if err != nil {
+		t.Fatalf("failed to get the series: %v", err)
+	}
+	if len(series) != 2 || series[0].Value.String() != "75.6" || series[1].Value.String() != "75.7" {
+		t.Fatalf("expected 75.6, 75.7 got %v", series)
+	}
+
+	latest, err := storage.LatestDate(ctx)
+	if err != nil || latest.Format("02.01.2006") != "14.03.2023" {
+		t.Fatalf("expected 14.03.2023 got %v: %v", latest, err)
+	}
+
+	dates, err := storage.ListDates(ctx)
+	if err != nil || len(dates) != 3 || dates[0].Format("02.01.2006") != "10.03.2023" {
+		t.Fatalf("expected 3 dates from 10.03.2023 got %v: %v", dates, err)
+	}
+
+	currencies, err := storage.ListCurrencies(ctx)
+	if err != nil {
+		t.Fatalf("failed to list currencies: %v", err)
+	}
+	expected := []CurrencyInfo{
+		{NumCode: 978, CharCode: "EUR", Name: "Euro (EU)"},
+		{NumCode: 840, CharCode: "USD", Name: "US Dollar"},
+	}
+	if !reflect.DeepEqual(currencies, expected) {
+		t.Fatalf("expected %v got %v", expected, currencies)
+	}
+}
+
+func TestDbStorageCatalog(t *testing.T) {
+	ctx := context.Background()
+
+	storage := newDbStorage(dbFilename)
+	defer storage.Close()
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+
+	catalog, err := storage.LoadCatalog(ctx)
+	if err != nil {
+		t.Fatalf("failed to load the catalog: %v", err)
+	}
+	if catalog.Len() != 0 {
+		t.Fatalf("expected an empty catalog got %d currencies", catalog.Len())
+	}
+
+	expected := newBuiltinCatalog()
+	if err = storage.SaveCatalog(ctx, expected); err != nil {
+		t.Fatalf("failed to save the catalog: %v", err)
+	}
+	if err = storage.SaveCatalog(ctx, expected); err != nil {
+		t.Fatalf("failed to save the catalog twice: %v", err)
+	}
+	if catalog, err = storage.LoadCatalog(ctx); err != nil {
+		t.Fatalf("failed to load the catalog: %v", err)
+	}
+	if !reflect.DeepEqual(catalog.Items(), expected.Items()) {
+		t.Fatalf("expected %v got %v", expected.Items(), catalog.Items())
+	}
+}
+
+func TestDbStorageConcurrentAdd(t *testing.T) {
+	const name = "test_concurrent.db"
+	defer removeDbFiles(name)
+
+	ctx := context.Background()
+	storage := newDbStorage(name)
+	defer storage.Close()
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+
+	filter := newCurrencyFilter(newBuiltinCatalog())
+	start, _ := parseDate("01.01.2022")
+	const days = 40
+
+	var wg sync.WaitGroup
+	errs := make(chan error, days)
+	for i := 0; i < days; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := newExchRateQuery()
+			q.SetTime(start.AddDate(0, 0, i))
+			rates := &DayRates{Query: q, Effective: q.time, Currencies: Currencies{
+				{NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar", Value: mustParseDecimal("75.5")},
+				{NumCode: 978, CharCode: "EUR", Nominal: 1, Name: "Euro", Value: mustParseDecimal("79.9")},
+			}}
+			_, err := storage.Add(ctx, rates, filter)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("failed to insert data: %v", err)
+		}
+	}
+
+	count, err := storage.SelectCount(ctx, `SELECT COUNT(*) FROM cbr_exchange_rate;`)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if count != 2*days {
+		t.Fatalf("expected %d got %d", 2*days, count)
+	}
+
+	// the connection is reopened after closing
+	if err = storage.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+	if _, err = storage.LatestDate(ctx); err != nil {
+		t.Fatalf("failed to read database: %v", err)
+	}
+}
+
+func TestDbStorageRevisions(t *testing.T) {
+	const name = "test_revisions.db"
+	defer removeDbFiles(name)
+
+	ctx := context.Background()
+	storage := newDbStorage(name)
+	defer storage.Close()
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+
+	filter := newCurrencyFilter(newBuiltinCatalog())
+	query := newExchRateQuery()
+	query.SetDate("10.03.2023")
+	add := func(value string) {
+		rates := &DayRates{Query: query, Effective: query.time, Source: "test", Currencies: Currencies{
+			{NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar", Value: mustParseDecimal(value)},
+		}}
+		if _, err := storage.Add(ctx, rates, filter); err != nil {
+			t.Fatalf("failed to insert data: %v", err)
+		}
+	}
+	revisions := func() int {
+		count, err := storage.SelectCount(ctx, `SELECT COUNT(*) FROM cbr_exchange_rate_revision;`)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		return count
+	}
+
+	// the same rate doesn't make a revision
+	add("75.5")
+	add("75.5")
+	if count := revisions(); count != 1 {
+		t.Fatalf("expected 1 got %d", count)
+	}
+	before := time.Now()
+	add("75.6")
+	if count := revisions(); count != 2 {
+		t.Fatalf("expected 2 got %d", count)
+	}
+
+	rate, err := storage.GetRate(ctx, query.time, "USD")
+	if err != nil || rate.Value.String() != "75.6" {
+		t.Fatalf("expected 75.6 got %v: %v", rate, err)
+	}
+
+	storage.SetAsOf(before)
+	if rate, err = storage.GetRate(ctx, query.time, "USD"); err != nil || rate.Value.String() != "75.5" {
+		t.Fatalf("expected 75.5 got %v: %v", rate, err)
+	}
+	storage.SetAsOf(before.Add(-time.Hour))
+	if _, err = storage.GetRate(ctx, query.time, "USD"); !errors.Is(err, errNoStoredRates) {
+		t.Fatalf("expected %v got %v", errNoStoredRates, err)
+	}
+	storage.SetAsOf(time.Time{})
+
+	// revisions are append-only
+	if _, err = storage.ExecQuery(ctx, `DELETE FROM rates;`); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+	if _, err = storage.ExecQuery(ctx, `UPDATE rates SET rate_value = '1';`); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+	if count := revisions(); count != 2 {
+		t.Fatalf("expected 2 got %d", count)
+	}
+}
+
+func TestDbStorageEffectiveDate(t *testing.T) {
+	const name = "test_effective.db"
+	defer removeDbFiles(name)
+
+	ctx := context.Background()
+	storage := newDbStorage(name)
+	defer storage.Close()
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+
+	filter := newCurrencyFilter(newBuiltinCatalog())
+	friday, _ := parseDate("10.03.2023")
+	add := func(date, value string) int {
+		query := newExchRateQuery()
+		query.SetDate(date)
+		rates := &DayRates{Query: query, Effective: friday, Source: "test", Currencies: Currencies{
+			{NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar", Value: mustParseDecimal(value)},
+		}}
+		added, err := storage.Add(ctx, rates, filter)
+		if err != nil {
+			t.Fatalf("failed to insert data: %v", err)
+		}
+		return added
+	}
+
+	// the rates of the weekend are the rates of friday, they aren't stored again
+	add("10.03.2023", "75.5")
+	if added := add("11.03.2023", "75.5"); added != 1 {
+		t.Fatalf("expected 1 got %d", added)
+	}
+	if added := add("11.03.2023", "75.5"); added != 0 {
+		t.Fatalf("expected 0 got %d", added)
+	}
+	add("12.03.2023", "75.5")
+	count, err := storage.SelectCount(ctx, `SELECT COUNT(*) FROM rates;`)
+	if err != nil || count != 1 {
+		t.Fatalf("expected 1 got %d: %v", count, err)
+	}
+
+	saturday, _ := parseDate("11.03.2023")
+	rate, err := storage.GetRate(ctx, saturday, "USD")
+	if err != nil || rate.Value.String() != "75.5" || !rate.Effective.Equal(friday) {
+		t.Fatalf("expected 75.5 of 10.03.2023 got %v: %v", rate, err)
+	}
+	query := newExchRateQuery()
+	query.SetDate("12.03.2023")
+	rates, err := storage.LoadDay(ctx, query)
+	if err != nil || rates == nil || len(rates.Currencies) != 1 || !rates.Effective.Equal(friday) {
+		t.Fatalf("expected the rates of 10.03.2023 got %v: %v", rates, err)
+	}
+
+	// a revision of the rate of friday is seen on the weekend
+	add("10.03.2023", "75.6")
+	if rate, err = storage.GetRate(ctx, saturday, "USD"); err != nil || rate.Value.String() != "75.6" {
+		t.Fatalf("expected 75.6 got %v: %v", rate, err)
+	}
+	if count, err = storage.SelectCount(ctx, `SELECT COUNT(*) FROM cbr_exchange_rate;`); err != nil || count != 3 {
+		t.Fatalf("expected 3 got %d: %v", count, err)
+	}
+}
+
+func TestDbStorageCurrencies(t *testing.T) {
+	const name = "test_currencies.db"
+	defer removeDbFiles(name)
+
+	ctx := context.Background()
+	storage := newDbStorage(name)
+	defer storage.Close()
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+
+	filter := newCurrencyFilter(newBuiltinCatalog())
+	add := func(date string, c Currency) {
+		q := newExchRateQuery()
+		q.SetDate(date)
+		rates := &DayRates{Query: q, Effective: q.time, Currencies: Currencies{c}}
+		if _, err := storage.Add(ctx, rates, filter); err != nil {
+			t.Fatalf("failed to insert data: %v", err)
+		}
+	}
+	usd := Currency{ID: "R01235", NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar",
+		Value: mustParseDecimal("75.5")}
+	add("14.03.2023", usd)
+	add("10.03.2023", usd)
+	// a rate without the CBR code belongs to the stored currency with the same codes
+	usd.ID = ""
+	add("12.03.2023", usd)
+	// a currency unknown to CBR is keyed by its codes
+	add("12.03.2023", Currency{NumCode: 999, CharCode: "XTS", Nominal: 1, Name: "Test", Value: mustParseDecimal("1")})
+
+	type currency struct {
+		id, code, from, to string
+	}
+	currencies := []currency{}
+	err := storage.SelectRows(ctx, func(rows *sql.Rows) error {
+		var c currency
+		if err := rows.Scan(&c.id, &c.code, &c.from, &c.to); err != nil {
+			return err
+		}
+		currencies = append(currencies, c)
+		return nil
+	}, `SELECT id, char_code, valid_from, valid_to FROM currencies ORDER BY id;`)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	expected := []currency{
+		{"ISO:999:XTS", "XTS", "2023-03-12", "2023-03-12"},
+		{"R01235", "USD", "2023-03-10", "2023-03-14"},
+	}
+	if !reflect.DeepEqual(currencies, expected) {
+		t.Fatalf("expected %v got %v", expected, currencies)
+	}
+
+	count, err := storage.SelectCount(ctx, `
+        SELECT COUNT(*) FROM cbr_exchange_rate
+            WHERE currency_id = 'R01235'
+                AND num_code = 840
+                AND currency_name = 'US Dollar';`)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 got %d", count)
+	}
+}
+
+func TestNewDbStorageAt(t *testing.T) {
+	home, _ := os.UserHomeDir()
+	tests := map[string]string{
+		"currencies.db":                        "currencies.db",
+		"./data/my_rates-2023.db":              filepath.Join("data", "my_rates-2023.db"),
+		"/var/lib/rates/cbr.db":                "/var/lib/rates/cbr.db",
+		"~/rates/cbr.db":                       filepath.Join(home, "rates", "cbr.db"),
+		"file:rates.db?_journal=WAL":           "rates.db",
+		"file:///var/lib/rates/cbr.db?mode=ro": "/var/lib/rates/cbr.db",
+		"file://localhost/tmp/a%20b.db":        "/tmp/a b.db",
+	}
+	for location, expected := range tests {
+		storage, err := newDbStorageAt(location)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", location, err)
+		}
+		if storage.name != expected {
+			t.Fatalf("expected %q got %q", expected, storage.name)
+		}
+	}
+
+	storage, _ := newDbStorageAt("file:rates.db?_journal=DELETE&mode=rwc")
+	if dsn := storage.dsn(); dsn != "file:rates.db?_busy_timeout=5000&_journal=DELETE&_txlock=immediate&mode=rwc" {
+		t.Fatalf("unexpected data source name %q", dsn)
+	}
+
+	for _, location := range []string{"", "file:", "file:?mode=ro", "file://host/cbr.db", "~user/cbr.db"} {
+		if _, err := newDbStorageAt(location); err == nil {
+			t.Fatalf("expected an error for %q got nil", location)
+		}
+	}
+}
+
+func TestDbStoragePrepare(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, _ := newDbStorageAt(filepath.Join(dir, "a", "b", "cbr.db"))
+	if err := storage.Prepare(); err != nil {
+		t.Fatalf("failed to prepare the database: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "a", "b")); err != nil || !info.IsDir() {
+		t.Fatalf("expected the directory created: %v", err)
+	}
+
+	if storage, _ = newDbStorageAt(dir); storage.Prepare() == nil {
+		t.Fatalf("expected an error for a directory got nil")
+	}
+
+	if os.Geteuid() != 0 {
+		readOnly := filepath.Join(dir, "ro")
+		os.Mkdir(readOnly, 0555)
+		if storage, _ = newDbStorageAt(filepath.Join(readOnly, "cbr.db")); storage.Prepare() == nil {
+			t.Fatalf("expected an error for a read-only directory got nil")
+		}
+	}
+}
+
+// Removes the database file with its write-ahead log.
+func removeDbFiles(name string) error {
+	os.Remove(name + "-wal")
+	os.Remove(name + "-shm")
+	return os.Remove(name)
 }
 
 func TestDeleteDbFile(t *testing.T) {
-	if err := os.Remove(dbFilename); err != nil {
+	if err := removeDbFiles(dbFilename); err != nil {
 		t.Fatalf("failed to delete database file: %v", err)
 	}
 }
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// The greatest number of digits after the decimal point kept by 'Decimal'.
+const maxDecimalScale = 18
+
+var (
+	errDecimalOverflow = errors.New("decimal overflow")
+	errDivisionByZero  = errors.New("decimal division by zero")
+)
+
+// Rounding mode of 'Decimal'.
+type RoundingMode int
+
+const (
+	RoundHalfEven RoundingMode = iota // to the nearest, ties to even (banker's rounding)
+	RoundHalfUp                       // to the nearest, ties away from zero
+	RoundDown                         // towards zero
+)
+
+// Parses the name of a rounding mode: 'half-even', 'half-up' or 'down'.
+func parseRoundingMode(s string) (RoundingMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "half-even":
+		return RoundHalfEven, nil
+	case "half-up":
+		return RoundHalfUp, nil
+	case "down":
+		return RoundDown, nil
+	}
+	return 0, fmt.Errorf("unknown rounding mode: %q", s)
+}
+
+// 'Decimal' is an exact fixed-point decimal number equal to coef * 10^-scale.
+// The zero value is 0.
+type Decimal struct {
+	coef  int64
+	scale int32
+}
+
+// Creates a 'Decimal' instance equal to coef * 10^-scale.
+func newDecimal(coef int64, scale int32) Decimal {
+	return Decimal{coef: coef, scale: scale}
+}
+
+// Creates a 'Decimal' instance equal to the integer.
+func newDecimalFromInt(i int64) Decimal {
+	return Decimal{coef: i}
+}
+
+// Parses a decimal number, both '.' and ',' are accepted as the decimal separator.
+func parseDecimal(s string) (Decimal, error) {
+	str := strings.TrimSpace(s)
+	if str == "" {
+		return Decimal{}, fmt.Errorf("empty decimal value")
+	}
+
+	str = strings.Replace(str, ",", ".", 1)
+	intPart, fracPart, _ := strings.Cut(str, ".")
+	if strings.ContainsAny(fracPart, "+-") || (intPart == "" || intPart == "-" || intPart == "+") && fracPart == "" {
+		return Decimal{}, fmt.Errorf("incorrect decimal value: %q", s)
+	}
+	fracPart = strings.TrimRight(fracPart, "0")
+	if len(fracPart) > maxDecimalScale {
+		return Decimal{}, fmt.Errorf("too many decimal places: %q", s)
+	}
+
+	digits := intPart + fracPart
+	if digits == "" || digits == "-" || digits == "+" {
+		digits += "0"
+	}
+	coef, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || coef == math.MinInt64 {
+		return Decimal{}, fmt.Errorf("incorrect decimal value: %q", s)
+	}
+
+	return Decimal{coef: coef, scale: int32(len(fracPart))}, nil
+}
+
+// Returns the number with exactly the given number of digits after the decimal point,
+// which is kept between 0 and 'maxDecimalScale'.
+func (d Decimal) StringFixed(places int32) string {
+	places = clampPlaces(places)
+	r := d.Round(places, RoundHalfEven)
+	s := strconv.FormatInt(abs64(r.coef), 10)
+	if r.scale < places {
+		s += strings.Repeat("0", int(places-r.scale))
+	}
+	if places > 0 {
+		if len(s) <= int(places) {
+			s = strings.Repeat("0", int(places)-len(s)+1) + s
+		}
+		s = s[:len(s)-int(places)] + "." + s[len(s)-int(places):]
+	}
+	if r.coef < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+// Returns the number without trailing zeros after the decimal point.
+func (d Decimal) String() string {
+	n := d.normalize()
+	return n.StringFixed(n.scale)
+}
+
+// Returns the number of digits after the decimal point.
+func (d Decimal) Scale() int32 {
+	return d.scale
+}
+
+// Returns -1, 0 or +1 depending on the sign of the number.
+func (d Decimal) Sign() int {
+	switch {
+	case d.coef < 0:
+		return -1
+	case d.coef > 0:
+		return 1
+	}
+	return 0
+}
+
+func (d Decimal) IsZero() bool {
+	return d.coef == 0
+}
+
+// Compares the numbers and returns -1, 0 or +1.
+func (d Decimal) Cmp(e Decimal) int {
+	return d.big(maxScale(d, e)).Cmp(e.big(maxScale(d, e)))
+}
+
+// Checks the numbers are equal regardless of their scales.
+func (d Decimal) Equal(e Decimal) bool {
+	return d.Cmp(e) == 0
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{coef: -d.coef, scale: d.scale}
+}
+
+func (d Decimal) Abs() Decimal {
+	return Decimal{coef: abs64(d.coef), scale: d.scale}
+}
+
+// Adds the numbers. Returns 'errDecimalOverflow' if the integer part of the sum doesn't fit.
+func (d Decimal) Add(e Decimal) (Decimal, error) {
+	scale := maxScale(d, e)
+	return fromBig(new(big.Int).Add(d.big(scale), e.big(scale)), scale)
+}
+
+// Subtracts the numbers. Returns 'errDecimalOverflow' if the integer part of the difference
+// doesn't fit.
+func (d Decimal) Sub(e Decimal) (Decimal, error) {
+	scale := maxScale(d, e)
+	return fromBig(new(big.Int).Sub(d.big(scale), e.big(scale)), scale)
+}
+
+// Multiplies the numbers, the scale of the result is the sum of the scales as far as
+// the result fits. Returns 'errDecimalOverflow' if the integer part of the product doesn't fit.
+func (d Decimal) Mul(e Decimal) (Decimal, error) {
+	return fromBig(new(big.Int).Mul(d.big(d.scale), e.big(e.scale)), d.scale+e.scale)
+}
+
+// Divides the numbers rounding the result to the given number of digits after the decimal point.
+// Returns 'errDivisionByZero' if e is zero, 'errDecimalOverflow' if the integer part
+// of the quotient doesn't fit.
+func (d Decimal) Div(e Decimal, places int32, mode RoundingMode) (Decimal, error) {
+	if e.IsZero() {
+		return Decimal{}, errDivisionByZero
+	}
+
+	// d / e = (d.coef * 10^(places + e.scale - d.scale + 1)) / e.coef * 10^-(places + 1)
+	num := big.NewInt(d.coef)
+	den := big.NewInt(e.coef)
+	shift := int64(places) + int64(e.scale) - int64(d.scale) + 1
+	if shift >= 0 {
+		num.Mul(num, pow10(shift))
+	} else {
+		den.Mul(den, pow10(-shift))
+	}
+
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() != 0 {
+		// a nonzero remainder makes a tie impossible: keep it as a sticky digit
+		quo.Mul(quo, big.NewInt(10))
+		if quo.Sign() < 0 || quo.Sign() == 0 && num.Sign()*den.Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+		return roundBig(quo, places+2, places, mode)
+	}
+	return roundBig(quo, places+1, places, mode)
+}
+
+// Rounds the number to the given number of digits after the decimal point, which is
+// kept between 0 and 'maxDecimalScale'.
+func (d Decimal) Round(places int32, mode RoundingMode) Decimal {
+	places = clampPlaces(places)
+	if d.scale <= places {
+		return d
+	}
+	r, err := roundBig(big.NewInt(d.coef), d.scale, places, mode)
+	if err != nil {
+		// dropping at least one digit can't make the coefficient greater, the number
+		// is kept as is if it ever does
+		return d
+	}
+	return r
+}
+
+// Returns the number of digits after the decimal point limited to 0..'maxDecimalScale'.
+func clampPlaces(places int32) int32 {
+	if places < 0 {
+		return 0
+	}
+	if places > maxDecimalScale {
+		return maxDecimalScale
+	}
+	return places
+}
+
+// Converts the number to float64, the result may be inexact.
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// Decodes the number from XML text, JSON strings and so on.
+// Both '.' and ',' are accepted as the decimal separator.
+func (d *Decimal) UnmarshalText(text []byte) error {
+	v, err := parseDecimal(string(text))
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+func (d Decimal) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Stores the number in the database as text to keep it exact.
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// Reads the number from the database.
+func (d *Decimal) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return d.UnmarshalText([]byte(v))
+	case []byte:
+		return d.UnmarshalText(v)
+	case int64:
+		*d = newDecimalFromInt(v)
+		return nil
+	case float64:
+		return d.UnmarshalText([]byte(strconv.FormatFloat(v, 'f', -1, 64)))
+	}
+	return fmt.Errorf("unsupported decimal value type: %T", src)
+}
+
+// Removes trailing zeros after the decimal point.
+func (d Decimal) normalize() Decimal {
+	for d.scale > 0 && d.coef%10 == 0 {
+		d.coef /= 10
+		d.scale--
+	}
+	return d
+}
+
+// Returns the coefficient of the number rescaled to the given scale, which must not be less
+// than the scale of the number.
+func (d Decimal) big(scale int32) *big.Int {
+	b := big.NewInt(d.coef)
+	if scale > d.scale {
+		b.Mul(b, pow10(int64(scale-d.scale)))
+	}
+	return b
+}
+
+func maxScale(d, e Decimal) int32 {
+	if d.scale > e.scale {
+		return d.scale
+	}
+	return e.scale
+}
+
+// Creates a 'Decimal' instance from a big coefficient. Digits beyond 'maxDecimalScale' or
+// beyond the range of int64 are rounded off. Returns 'errDecimalOverflow' if the integer
+// part doesn't fit.
+func fromBig(coef *big.Int, scale int32) (Decimal, error) {
+	if scale > maxDecimalScale {
+		return roundBig(coef, scale, maxDecimalScale, RoundHalfEven)
+	}
+	if !coef.IsInt64() || coef.Int64() == math.MinInt64 {
+		if scale <= 0 {
+			return Decimal{}, errDecimalOverflow
+		}
+		return roundBig(coef, scale, scale-1, RoundHalfEven)
+	}
+	return Decimal{coef: coef.Int64(), scale: scale}, nil
+}
+
+// Rounds the coefficient of the given scale to the given number of places.
+func roundBig(coef *big.Int, scale, places int32, mode RoundingMode) (Decimal, error) {
+	div := pow10(int64(scale - places))
+	quo, rem := new(big.Int).QuoRem(coef, div, new(big.Int))
+
+	if rem.Sign() != 0 {
+		twice := new(big.Int).Abs(rem)
+		twice.Mul(twice, big.NewInt(2))
+		half := twice.Cmp(div) // -1 less than a half, 0 a half, +1 more than a half
+
+		var up bool
+		switch mode {
+		case RoundHalfEven:
+			up = half > 0 || half == 0 && quo.Bit(0) == 1
+		case RoundHalfUp:
+			up = half >= 0
+		case RoundDown:
+			up = false
+		}
+		if up {
+			quo.Add(quo, big.NewInt(int64(coef.Sign())))
+		}
+	}
+
+	return fromBig(quo, places)
+}
+
+func pow10(n int64) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(n), nil)
+}
+
+func abs64(i int64) int64 {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
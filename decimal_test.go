@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func mustParseDecimal(s string) Decimal {
+	d, err := parseDecimal(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Returns the result of an operation which must succeed.
+func mustDecimal(d Decimal, err error) Decimal {
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func TestParseDecimal(t *testing.T) {
+	for _, s := range []string{"", "-", ".", "1.2.3", "1e5", "12,3a", "1.-5"} {
+		if _, err := parseDecimal(s); err == nil {
+			t.Fatalf("expected an error for %q got nil", s)
+		}
+	}
+
+	cases := map[string]string{
+		"52,3656":   "52.3656",
+		" 52.3656 ": "52.3656",
+		"62.5900":   "62.59",
+		"-0,5":      "-0.5",
+		".25":       "0.25",
+		"100":       "100",
+		"100.000":   "100",
+	}
+	for in, expected := range cases {
+		d, err := parseDecimal(in)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", in, err)
+		}
+		if d.String() != expected {
+			t.Fatalf("expected %s got %s", expected, d.String())
+		}
+	}
+}
+
+func TestDecimalStringFixed(t *testing.T) {
+	cases := []struct {
+		in       string
+		places   int32
+		expected string
+	}{
+		{"52.3656", 4, "52.3656"},
+		{"62.59", 4, "62.5900"},
+		{"0.005", 2, "0.00"},
+		{"0.015", 2, "0.02"},
+		{"-1.5", 0, "-2"},
+		{"0.0103647", 4, "0.0104"},
+	}
+	for _, c := range cases {
+		if s := mustParseDecimal(c.in).StringFixed(c.places); s != c.expected {
+			t.Fatalf("expected %s got %s", c.expected, s)
+		}
+	}
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	a := mustParseDecimal("0.1")
+	b := mustParseDecimal("0.2")
+	if s := mustDecimal(a.Add(b)).String(); s != "0.3" {
+		t.Fatalf("expected 0.3 got %s", s)
+	}
+	if s := mustDecimal(a.Sub(b)).String(); s != "-0.1" {
+		t.Fatalf("expected -0.1 got %s", s)
+	}
+	if s := mustDecimal(mustParseDecimal("1500").Mul(mustParseDecimal("75.4571"))).String(); s != "113185.65" {
+		t.Fatalf("expected 113185.65 got %s", s)
+	}
+	if a.Cmp(b) != -1 || b.Cmp(a) != 1 || !a.Equal(mustParseDecimal("0.100")) {
+		t.Fatalf("incorrect comparison of %s and %s", a, b)
+	}
+}
+
+func TestDecimalDivRound(t *testing.T) {
+	one := newDecimalFromInt(1)
+	three := newDecimalFromInt(3)
+	if s := mustDecimal(one.Div(three, 4, RoundHalfEven)).String(); s != "0.3333" {
+		t.Fatalf("expected 0.3333 got %s", s)
+	}
+	if s := mustDecimal(one.Neg().Div(three, 4, RoundHalfUp)).String(); s != "-0.3333" {
+		t.Fatalf("expected -0.3333 got %s", s)
+	}
+	if s := mustDecimal(newDecimalFromInt(2).Div(three, 2, RoundHalfEven)).String(); s != "0.67" {
+		t.Fatalf("expected 0.67 got %s", s)
+	}
+
+	half := mustParseDecimal("2.5")
+	if s := half.Round(0, RoundHalfEven).String(); s != "2" {
+		t.Fatalf("expected 2 got %s", s)
+	}
+	if s := half.Round(0, RoundHalfUp).String(); s != "3" {
+		t.Fatalf("expected 3 got %s", s)
+	}
+	if s := half.Neg().Round(0, RoundHalfUp).String(); s != "-3" {
+		t.Fatalf("expected -3 got %s", s)
+	}
+	if s := mustParseDecimal("2.51").Round(0, RoundDown).String(); s != "2" {
+		t.Fatalf("expected 2 got %s", s)
+	}
+
+	// 5 / 2 = 2.5 exactly, but 5.0000001 / 2 is more than a half
+	if s := mustDecimal(newDecimalFromInt(5).Div(newDecimalFromInt(2), 0, RoundHalfEven)).String(); s != "2" {
+		t.Fatalf("expected 2 got %s", s)
+	}
+	if s := mustDecimal(mustParseDecimal("5.0000001").Div(newDecimalFromInt(2), 0, RoundHalfEven)).String(); s != "3" {
+		t.Fatalf("expected 3 got %s", s)
+	}
+}
+
+func TestDecimalErrors(t *testing.T) {
+	max := mustParseDecimal("9223372036854775807")
+	if _, err := max.Add(newDecimalFromInt(1)); !errors.Is(err, errDecimalOverflow) {
+		t.Fatalf("expected %v got %v", errDecimalOverflow, err)
+	}
+	if _, err := max.Neg().Sub(newDecimalFromInt(1)); !errors.Is(err, errDecimalOverflow) {
+		t.Fatalf("expected %v got %v", errDecimalOverflow, err)
+	}
+	if _, err := max.Mul(newDecimalFromInt(10)); !errors.Is(err, errDecimalOverflow) {
+		t.Fatalf("expected %v got %v", errDecimalOverflow, err)
+	}
+	if _, err := max.Div(mustParseDecimal("0.1"), 0, RoundHalfEven); !errors.Is(err, errDecimalOverflow) {
+		t.Fatalf("expected %v got %v", errDecimalOverflow, err)
+	}
+	if _, err := newDecimalFromInt(1).Div(Decimal{}, 2, RoundHalfEven); !errors.Is(err, errDivisionByZero) {
+		t.Fatalf("expected %v got %v", errDivisionByZero, err)
+	}
+	if _, err := parseDecimal("-9223372036854775808"); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+
+	// the digits after the decimal point are rounded off as far as the integer part fits
+	d, err := mustParseDecimal("92233720368547758.07").Mul(newDecimalFromInt(10))
+	if err != nil || d.String() != "922337203685477580.7" {
+		t.Fatalf("expected 922337203685477580.7 got %s: %v", d, err)
+	}
+}
+
+func TestDecimalRoundPlaces(t *testing.T) {
+	// the number of places is kept between 0 and 'maxDecimalScale'
+	if s := newDecimalFromInt(100).StringFixed(-2); s != "100" {
+		t.Fatalf("expected 100 got %s", s)
+	}
+	if s := mustParseDecimal("15.5").Round(-1, RoundHalfUp).String(); s != "16" {
+		t.Fatalf("expected 16 got %s", s)
+	}
+	if d := mustParseDecimal("1.25").Round(-3, RoundHalfEven); d.Scale() < 0 || d.String() != "1" {
+		t.Fatalf("expected 1 with a non-negative scale got %s with scale %d", d, d.Scale())
+	}
+	if s := mustParseDecimal("0.5").StringFixed(20); s != "0.500000000000000000" {
+		t.Fatalf("expected 18 places got %s", s)
+	}
+}
+
+func TestDecimalScan(t *testing.T) {
+	var d Decimal
+	for _, src := range []any{"52.3656", []byte("52.3656"), 52.3656} {
+		if err := d.Scan(src); err != nil {
+			t.Fatalf("failed to scan %v: %v", src, err)
+		}
+		if d.String() != "52.3656" {
+			t.Fatalf("expected 52.3656 got %s", d)
+		}
+	}
+	if err := d.Scan(true); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+}
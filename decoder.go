@@ -1,30 +1,57 @@
 package main
 
 import (
+	"bufio"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"time"
+	"unicode"
 
 	"golang.org/x/text/encoding/charmap"
 )
 
+// The number of bytes of an incorrect answer kept for error messages.
+const incorrectAnswerPrefixSize = 512
+
 type CbrDecoder struct {
 	xml.Decoder
 	isValid bool
+	prefix  string // the beginning of an incorrect answer
+	err     error  // the failure of reading the beginning of the answer
 }
 
-func newCbrDecoder(inStr string) *CbrDecoder {
-	if !strings.HasPrefix(inStr, "<?xml") {
+// Creates a decoder reading the answer from the stream. Decimal commas are handled by
+// the 'Decimal' type, so the text of other fields stays as is.
+func newCbrDecoder(r io.Reader) *CbrDecoder {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			break
+		}
+		if !unicode.IsSpace(rune(b)) {
+			br.UnreadByte()
+			break
+		}
+	}
+
+	if head, _ := br.Peek(5); string(head) != "<?xml" {
+		prefix, err := br.Peek(incorrectAnswerPrefixSize)
+		if err == io.EOF {
+			err = nil
+		}
 		return &CbrDecoder{
 			Decoder: *xml.NewDecoder(strings.NewReader("")),
 			isValid: false,
+			prefix:  string(prefix),
+			err:     err,
 		}
 	}
 
-	inStr = strings.Replace(inStr, ",", ".", -1)
-
-	decoder := xml.NewDecoder(strings.NewReader(inStr))
+	decoder := xml.NewDecoder(br)
 
 	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
 		switch charset {
@@ -40,3 +67,127 @@ func newCbrDecoder(inStr string) *CbrDecoder {
 		isValid: true,
 	}
 }
+
+// Returns the error describing an incorrect answer.
+func (d *CbrDecoder) incorrectAnswerError() error {
+	if d.err != nil {
+		return fmt.Errorf("failed to read the answer: %w", d.err)
+	}
+	if strings.Contains(d.prefix, "Error in parameters") {
+		return fmt.Errorf("%w: %s", errCbrParameters, strings.TrimSpace(d.prefix))
+	}
+	return fmt.Errorf("received incorrect answer: %s", d.prefix)
+}
+
+// Decodes the answer to the daily request.
+func (q *ExchRateQuery) Decode(answer io.Reader) ([]DayRates, error) {
+	decoder := newCbrDecoder(answer)
+	if !decoder.isValid {
+		return nil, decoder.incorrectAnswerError()
+	}
+
+	result := CbrResult{}
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	// an incorrect date is reported by the validation
+	effective, err := parseCbrDate(result.Date)
+	if err != nil {
+		effective = q.time
+	}
+
+	return []DayRates{{
+		Query:      q,
+		Effective:  effective,
+		RawDate:    result.Date,
+		Currencies: result.Currencies,
+	}}, nil
+}
+
+// Parses a date of the CBR answer.
+func parseCbrDate(date string) (time.Time, error) {
+	dt, err := time.Parse("02.01.2006", date)
+	if err != nil {
+		if dt, err = time.Parse("02/01/2006", date); err != nil {
+			return time.Time{}, fmt.Errorf("incorrect date %q: %v", date, err)
+		}
+	}
+	return dt, nil
+}
+
+// Decodes the answer to the dynamic request. Every requested date gets the last rate
+// published on or before it, dates before the first published rate are skipped.
+func (q *DynamicQuery) Decode(answer io.Reader) ([]DayRates, error) {
+	decoder := newCbrDecoder(answer)
+	if !decoder.isValid {
+		return nil, decoder.incorrectAnswerError()
+	}
+
+	result := CbrDynamicResult{}
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	type record struct {
+		date time.Time
+		DynamicRecord
+	}
+	records := make([]record, 0, len(result.Records))
+	for _, r := range result.Records {
+		dt, err := parseCbrDate(r.Date)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record{dt, r})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].date.Before(records[j].date) })
+
+	rates := []DayRates{}
+	i := -1
+	for _, d := range q.dates {
+		for i+1 < len(records) && !records[i+1].date.After(d) {
+			i++
+		}
+		if i < 0 {
+			continue
+		}
+
+		// the series has the previous publication of every rate but the first one
+		var preceding map[string]StoredRate
+		if i > 0 {
+			p := records[i-1]
+			preceding = map[string]StoredRate{q.currency.CharCode: {
+				Date:      p.date,
+				Effective: p.date,
+				Currency: Currency{
+					ID:       q.currency.ID,
+					NumCode:  q.currency.NumCode,
+					CharCode: q.currency.CharCode,
+					Nominal:  p.Nominal,
+					Name:     q.currency.Name,
+					Value:    p.Value,
+				},
+			}}
+		}
+
+		query := newExchRateQuery()
+		query.SetTime(d)
+		rates = append(rates, DayRates{
+			Query:     query,
+			Effective: records[i].date,
+			RawDate:   records[i].Date,
+			Currencies: Currencies{{
+				ID:       q.currency.ID,
+				NumCode:  q.currency.NumCode,
+				CharCode: q.currency.CharCode,
+				Nominal:  records[i].Nominal,
+				Name:     q.currency.Name,
+				Value:    records[i].Value,
+			}},
+			Preceding: preceding,
+		})
+	}
+
+	return rates, nil
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCbrDecoder(t *testing.T) {
 	s := ``
-	decoder := newCbrDecoder(s)
+	decoder := newCbrDecoder(strings.NewReader(s))
 	result := CbrResult{}
 	if err := decoder.Decode(&result); err == nil {
 		t.Fatalf("expected an error got nil")
@@ -22,7 +25,7 @@ func TestCbrDecoder(t *testing.T) {
 			<Name>British Pound Sterling</Name>
 			<Value>52,3656</Value>
 		</Valute>`
-	decoder = newCbrDecoder(s)
+	decoder = newCbrDecoder(strings.NewReader(s))
 	result = CbrResult{}
 	if err := decoder.Decode(&result); err == nil {
 		t.Fatalf("expected an error got nil")
@@ -66,10 +69,101 @@ func TestCbrDecoder(t *testing.T) {
 			<Name>Japanese Yen</Name>
 			<Value>21,8528</Value>
 		</Valute>
+		<Valute ID="R01815">
+			<NumCode>410</NumCode>
+			<CharCode>KRW</CharCode>
+			<Nominal>1000</Nominal>
+			<Name>Won, Republic of Korea</Name>
+			<Value>20,2164</Value>
+		</Valute>
 	</ValCurs>`
-	decoder = newCbrDecoder(s)
+	decoder = newCbrDecoder(strings.NewReader(s))
 	result = CbrResult{}
 	if err := decoder.Decode(&result); err != nil {
 		t.Fatalf("got an error: %v", err)
 	}
+
+	q := newExchRateQuery()
+	q.SetDate("21.01.2007")
+	rates, err := q.Decode(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("got an error: %v", err)
+	}
+	if len(rates) != 1 || len(rates[0].Currencies) != 6 {
+		t.Fatalf("expected 6 currencies on one date got %v", rates)
+	}
+	krw := rates[0].Currencies[5]
+	if krw.Name != "Won, Republic of Korea" || krw.Value.String() != "20.2164" {
+		t.Fatalf("expected \"Won, Republic of Korea\" 20.2164 got %q %s", krw.Name, krw.Value)
+	}
+	if rates[0].EffectiveDate("02.01.2006") != "20.01.2007" {
+		t.Fatalf("expected \"20.01.2007\" got %q", rates[0].EffectiveDate("02.01.2006"))
+	}
+	if !rates[0].IsEffectiveDateDiffers() {
+		t.Fatalf("expected the effective date differs from the requested one")
+	}
+}
+
+func TestDynamicQueryDecode(t *testing.T) {
+	info, _ := newBuiltinCatalog().Lookup("USD")
+	var dates []time.Time
+	for _, d := range []string{"01.03.2001", "03.03.2001", "04.03.2001", "06.03.2001"} {
+		dt, _ := parseDate(d)
+		dates = append(dates, dt)
+	}
+	q := newDynamicQuery(info, dates)
+
+	s := `<?xml version="1.0" encoding="windows-1251"?>
+	<ValCurs ID="R01235" DateRange1="19.02.2001" DateRange2="06.03.2001" name="Foreign Currency Market Dynamic">
+		<Record Date="02.03.2001" Id="R01235">
+			<Nominal>1</Nominal>
+			<Value>28,6200</Value>
+		</Record>
+		<Record Date="03.03.2001" Id="R01235">
+			<Nominal>1</Nominal>
+			<Value>28,6500</Value>
+		</Record>
+		<Record Date="06.03.2001" Id="R01235">
+			<Nominal>1</Nominal>
+			<Value>28,6600</Value>
+		</Record>
+	</ValCurs>`
+	rates, err := q.Decode(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("got an error: %v", err)
+	}
+	if rates[1].EffectiveDate("02.01.2006") != "03.03.2001" {
+		t.Fatalf("expected \"03.03.2001\" got %q", rates[1].EffectiveDate("02.01.2006"))
+	}
+
+	expected := map[string]string{"03.03.2001": "28.65", "04.03.2001": "28.65", "06.03.2001": "28.66"}
+	if len(rates) != len(expected) {
+		t.Fatalf("expected %d dates got %d", len(expected), len(rates))
+	}
+	for _, r := range rates {
+		date := r.Query.Date("02.01.2006")
+		if len(r.Currencies) != 1 || r.Currencies[0].CharCode != "USD" {
+			t.Fatalf("expected USD on %s got %v", date, r.Currencies)
+		}
+		if r.Currencies[0].Value.String() != expected[date] {
+			t.Fatalf("expected %v on %s got %v", expected[date], date, r.Currencies[0].Value)
+		}
+	}
+
+	// the rates are preceded by the previous publication in the series but the first one
+	preceding := map[string]string{"03.03.2001": "28.62", "04.03.2001": "28.62", "06.03.2001": "28.65"}
+	for _, r := range rates {
+		date := r.Query.Date("02.01.2006")
+		if p, ok := r.Preceding["USD"]; !ok || p.Value.String() != preceding[date] {
+			t.Fatalf("expected %v before %s got %v", preceding[date], date, r.Preceding)
+		}
+	}
+	dates[0], _ = parseDate("02.03.2001")
+	if rates, err = newDynamicQuery(info, dates).Decode(strings.NewReader(s)); err != nil || rates[0].Preceding != nil {
+		t.Fatalf("expected no preceding rates on 02.03.2001 got %v: %v", rates[0].Preceding, err)
+	}
+
+	if _, err = q.Decode(strings.NewReader("Error in parameters")); !errors.Is(err, errCbrParameters) {
+		t.Fatalf("expected %v got %v", errCbrParameters, err)
+	}
 }
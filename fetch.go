@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	sqlInsertFetch = `
+        INSERT INTO cbr_fetch
+            (url, query_dates, currencies, status, error, started_at, duration_ms, from_cache,
+                size, sha256, payload)
+            VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+	// an answer taken from the cache again is linked to the fetch archived before
+	sqlSelectCachedFetch = `
+        SELECT COALESCE(MAX(id), 0)
+            FROM cbr_fetch
+            WHERE url = ?
+                AND currencies = ?
+                AND sha256 = ?;`
+
+	sqlSelectFetches = `
+        SELECT id, url, query_dates, currencies, status, error, started_at, duration_ms, from_cache,
+                sha256, payload
+            FROM cbr_fetch
+            WHERE payload IS NOT NULL
+            ORDER BY id;`
+)
+
+// Request to the server and its answer archived in the database.
+type FetchRecord struct {
+	ID         int64         `json:"id"`
+	URL        string        `json:"url"`
+	Dates      []time.Time   `json:"dates"`                // the requested dates
+	Currencies []string      `json:"currencies,omitempty"` // the currencies saved from the answer, empty for all
+	Status     int           `json:"status"`               // HTTP status, zero if there is no response
+	Err        string        `json:"error,omitempty"`
+	Started    time.Time     `json:"started_at"`
+	Duration   time.Duration `json:"duration_ns"`
+	FromCache  bool          `json:"from_cache,omitempty"`
+	Hash       string        `json:"sha256,omitempty"`  // SHA-256 of the answer
+	Payload    []byte        `json:"payload,omitempty"` // the raw answer, nil if there is none
+}
+
+// Creates a 'FetchRecord' instance of the query answered with the payload.
+func newFetchRecord(query RateQuery, started time.Time, payload []byte) *FetchRecord {
+	f := &FetchRecord{
+		URL:     query.String(),
+		Dates:   query.Dates(),
+		Started: started,
+		Payload: payload,
+	}
+	if payload != nil {
+		sum := sha256.Sum256(payload)
+		f.Hash = hex.EncodeToString(sum[:])
+	}
+	return f
+}
+
+// Archives the fetch, the payload is compressed. Returns the identifier of the fetch.
+func (s *DbStorage) AddFetch(ctx context.Context, f *FetchRecord) (int64, error) {
+	var (
+		db  *sql.DB
+		tx  *sql.Tx
+		res sql.Result
+		id  int64
+		err error
+	)
+
+	if db, err = s.conn(); err != nil {
+		return 0, err
+	}
+
+	if tx, err = db.BeginTx(ctx, nil); err != nil {
+		return 0, fmt.Errorf("failed to begin a transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	currencies := strings.Join(f.Currencies, ",")
+	if f.FromCache {
+		err = tx.QueryRowContext(ctx, sqlSelectCachedFetch, f.URL, currencies, f.Hash).Scan(&id)
+		if err != nil {
+			return 0, fmt.Errorf("unable to get the value from the database: %v", err)
+		}
+		if id != 0 {
+			return id, nil
+		}
+	}
+
+	var payload []byte
+	if f.Payload != nil {
+		if payload, err = compressPayload(f.Payload); err != nil {
+			return 0, fmt.Errorf("failed to compress the answer: %v", err)
+		}
+	}
+
+	dates := make([]string, len(f.Dates))
+	for i, d := range f.Dates {
+		dates[i] = d.Format("2006-01-02")
+	}
+
+	res, err = tx.ExecContext(ctx, sqlInsertFetch,
+		f.URL,
+		strings.Join(dates, ","),
+		currencies,
+		f.Status,
+		f.Err,
+		f.Started.UTC().Format(dbTimeFormat),
+		f.Duration.Milliseconds(),
+		f.FromCache,
+		len(f.Payload),
+		f.Hash,
+		payload,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert a fetch: %v", err)
+	}
+	if id, err = res.LastInsertId(); err != nil {
+		return 0, fmt.Errorf("unknown database query execution status: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit a transaction: %v", err)
+	}
+
+	return id, nil
+}
+
+// Calls 'handle' for every archived fetch with an answer in the order they were made.
+func (s *DbStorage) ForEachFetch(ctx context.Context, handle func(*FetchRecord) error) error {
+	fetches := []*FetchRecord{}
+	err := s.SelectRows(ctx, func(rows *sql.Rows) error {
+		var (
+			f                          FetchRecord
+			dates, currencies, started string
+			duration                   int64
+		)
+		err := rows.Scan(&f.ID, &f.URL, &dates, &currencies, &f.Status, &f.Err, &started, &duration,
+			&f.FromCache, &f.Hash, &f.Payload)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range strings.Split(dates, ",") {
+			dt, err := parseDbDate(d)
+			if err != nil {
+				return err
+			}
+			f.Dates = append(f.Dates, dt)
+		}
+		if currencies != "" {
+			f.Currencies = strings.Split(currencies, ",")
+		}
+		if f.Started, err = time.Parse(dbTimeFormat, started); err != nil {
+			return fmt.Errorf("incorrect time %q of fetch %d: %v", started, f.ID, err)
+		}
+		f.Duration = time.Duration(duration) * time.Millisecond
+
+		fetches = append(fetches, &f)
+		return nil
+	}, sqlSelectFetches)
+	if err != nil {
+		return err
+	}
+
+	// the rows are read before handling, so that the handler can write to the database,
+	// the answers are decompressed one by one
+	for _, f := range fetches {
+		compressed := f.Payload
+		if f.Payload, err = decompressPayload(compressed); err != nil {
+			return fmt.Errorf("failed to decompress the answer of fetch %d: %v", f.ID, err)
+		}
+		if err = handle(f); err != nil {
+			return err
+		}
+		f.Payload = nil
+	}
+	return nil
+}
+
+func compressPayload(payload []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decompressPayload(payload []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Decodes the archived answers again and saves the rates, only the changed rates get
+// new revisions. Returns the numbers of the reprocessed fetches and the new revisions,
+// an answer which can't be decoded is reported and skipped.
+func reprocessFetches(ctx context.Context, storage Storage, catalog *CurrencyCatalog,
+	validator *RatesValidator) (int, int, error) {
+
+	count, revised := 0, 0
+	err := storage.ForEachFetch(ctx, func(f *FetchRecord) error {
+		query, err := parseRateQuery(f.URL, f.Dates, catalog)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("fetch %d wasn't reprocessed: %v", f.ID, err))
+			fmt.Printf("fetch %d wasn't reprocessed: %v\n", f.ID, err)
+			return nil
+		}
+
+		rates, err := query.Decode(bytes.NewReader(f.Payload))
+		if err != nil {
+			logger.Warn(fmt.Sprintf("[%s] fetch %d wasn't decoded: %v", query, f.ID, err))
+			fmt.Printf("fetch %d of %q wasn't decoded: %v\n", f.ID, query, err)
+			return nil
+		}
+		if verr := validator.Validate(rates); verr != nil {
+			logger.Warn(fmt.Sprintf("[%s] fetch %d validation failed: %v", query, f.ID, verr))
+			if validator.IsStrict() {
+				fmt.Printf("fetch %d of %q was rejected: %v\n", f.ID, query, verr)
+				return nil
+			}
+		}
+
+		filter := newCurrencyFilter(catalog)
+		for _, code := range f.Currencies {
+			filter.CurrencyEnable(code)
+		}
+		if len(f.Currencies) > 0 {
+			filter.Enable()
+		}
+
+		for _, r := range rates {
+			r.Fetched = f.Started
+			r.Source = f.URL
+			r.FetchID = f.ID
+			added, err := storage.Add(ctx, &r, filter)
+			if err != nil {
+				return err
+			}
+			revised += added
+		}
+		count++
+		return nil
+	})
+	return count, revised, err
+}
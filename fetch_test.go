@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const fetchTestAnswer = `<?xml version="1.0" encoding="windows-1251"?>
+<ValCurs Date="20.01.2007" name="Foreign Currency Market">
+	<Valute ID="R01235">
+		<NumCode>840</NumCode>
+		<CharCode>USD</CharCode>
+		<Nominal>1</Nominal>
+		<Name>US Dollar</Name>
+		<Value>26,5075</Value>
+	</Valute>
+	<Valute ID="R01239">
+		<NumCode>978</NumCode>
+		<CharCode>EUR</CharCode>
+		<Nominal>1</Nominal>
+		<Name>Euro</Name>
+		<Value>34,3508</Value>
+	</Valute>
+</ValCurs>`
+
+func TestDbStorageFetches(t *testing.T) {
+	const name = "test_fetches.db"
+	defer removeDbFiles(name)
+
+	ctx := context.Background()
+	storage := newDbStorage(name)
+	defer storage.Close()
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+
+	query := newExchRateQuery()
+	query.SetDate("20.01.2007")
+	started := time.Date(2023, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	fetch := newFetchRecord(query, started, []byte(fetchTestAnswer))
+	fetch.Status = 200
+	fetch.Duration = 150 * time.Millisecond
+	fetch.Currencies = []string{"USD"}
+	id, err := storage.AddFetch(ctx, fetch)
+	if err != nil {
+		t.Fatalf("failed to archive the fetch: %v", err)
+	}
+
+	// the same answer taken from the cache is linked to the archived fetch
+	cached := newFetchRecord(query, started, []byte(fetchTestAnswer))
+	cached.FromCache = true
+	cached.Currencies = []string{"USD"}
+	if cachedID, err := storage.AddFetch(ctx, cached); err != nil || cachedID != id {
+		t.Fatalf("expected fetch %d got %d: %v", id, cachedID, err)
+	}
+
+	// a failed request has no answer to reprocess
+	failed := newFetchRecord(query, started, nil)
+	failed.Status = 503
+	failed.Err = "unexpected status"
+	if _, err = storage.AddFetch(ctx, failed); err != nil {
+		t.Fatalf("failed to archive the fetch: %v", err)
+	}
+
+	fetches := []*FetchRecord{}
+	err = storage.ForEachFetch(ctx, func(f *FetchRecord) error {
+		if string(f.Payload) != fetchTestAnswer {
+			t.Fatalf("expected the archived answer got %q", f.Payload)
+		}
+		fetches = append(fetches, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read the fetches: %v", err)
+	}
+	if len(fetches) != 1 {
+		t.Fatalf("expected 1 got %d", len(fetches))
+	}
+	f := fetches[0]
+	if f.ID != id || f.URL != query.String() || f.Hash != fetch.Hash || !f.Started.Equal(started) ||
+		f.Duration != fetch.Duration || len(f.Currencies) != 1 || f.Currencies[0] != "USD" {
+		t.Fatalf("expected %v got %v", fetch, f)
+	}
+
+	catalog := newBuiltinCatalog()
+	validator := newRatesValidator(catalog, false)
+	count, revised, err := reprocessFetches(ctx, storage, catalog, validator)
+	if err != nil {
+		t.Fatalf("failed to reprocess: %v", err)
+	}
+	if count != 1 || revised != 1 {
+		t.Fatalf("expected 1 answer and 1 rate got %d and %d", count, revised)
+	}
+
+	linked, err := storage.SelectCount(ctx, `
+        SELECT COUNT(*) FROM cbr_exchange_rate
+            WHERE rate_date = '2007-01-20'
+                AND char_code = 'USD'
+                AND rate_value = '26.5075'
+                AND fetch_id = ?;`, id)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if linked != 1 {
+		t.Fatalf("expected 1 got %d", linked)
+	}
+
+	// nothing has changed since
+	if count, revised, err = reprocessFetches(ctx, storage, catalog, validator); err != nil || revised != 0 {
+		t.Fatalf("expected 0 got %d: %v", revised, err)
+	}
+}
+
+func TestParseRateQuery(t *testing.T) {
+	catalog := newBuiltinCatalog()
+	date, _ := parseDate("20.01.2007")
+	dates := []time.Time{date}
+
+	daily := newExchRateQuery()
+	daily.SetTime(date)
+	q, err := parseRateQuery(daily.String(), dates, catalog)
+	if err != nil || q.String() != daily.String() {
+		t.Fatalf("expected %s got %v: %v", daily, q, err)
+	}
+
+	info, _ := catalog.Lookup("USD")
+	dynamic := newDynamicQuery(info, dates)
+	if q, err = parseRateQuery(dynamic.String(), dates, catalog); err != nil || q.String() != dynamic.String() {
+		t.Fatalf("expected %s got %v: %v", dynamic, q, err)
+	}
+
+	if _, err = parseRateQuery("https://www.cbr.ru/scripts/unknown.asp", dates, catalog); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+}
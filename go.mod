@@ -2,13 +2,16 @@ module cbr_currencies
 
 go 1.19
 
+require (
+	github.com/mattn/go-sqlite3 v1.14.15
+	github.com/spf13/cobra v1.5.0
+	go.uber.org/zap v1.23.0
+	golang.org/x/text v0.3.7
+)
+
 require (
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.15 // indirect
-	github.com/spf13/cobra v1.5.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	go.uber.org/atomic v1.10.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
-	go.uber.org/zap v1.23.0 // indirect
-	golang.org/x/text v0.3.7 // indirect
 )
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Kinds of the records of a JSON Lines storage.
+const (
+	jsonlRate    = "rate"
+	jsonlFetch   = "fetch"
+	jsonlCatalog = "catalog"
+)
+
+// Line of a JSON Lines storage.
+type jsonlRecord struct {
+	Kind    string         `json:"kind"`
+	Rate    *rateRevision  `json:"rate,omitempty"`
+	Fetch   *FetchRecord   `json:"fetch,omitempty"` // the payload is compressed
+	Catalog []CurrencyInfo `json:"catalog,omitempty"`
+	SavedAt string         `json:"saved_at,omitempty"` // the time the catalog was saved
+}
+
+// 'JsonlStorage' keeps everything in memory and appends the changes to a JSON Lines
+// file, which is replayed when the storage is opened. Lines are never changed: a changed
+// rate is a new line, a saved catalog replaces the previous one. All methods are safe
+// for concurrent use.
+type JsonlStorage struct {
+	*MemStorage
+	path string
+
+	mu   sync.Mutex // serializes the changes, so that the file keeps their order
+	file *os.File
+}
+
+// Creates a 'JsonlStorage' instance keeping the data in the file.
+func newJsonlStorage(path string) *JsonlStorage {
+	return &JsonlStorage{
+		MemStorage: newMemStorage(),
+		path:       path,
+	}
+}
+
+// Returns the path of the file.
+func (s *JsonlStorage) String() string {
+	return s.path
+}
+
+// Opens the file, creates it and its directories if they don't exist, and loads it.
+func (s *JsonlStorage) Init(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file != nil {
+		return nil
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("can't create the directory %q: %v", dir, err)
+	}
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("the file %q isn't writable: %v", s.path, err)
+	}
+
+	if err = s.load(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to load %q: %v", s.path, err)
+	}
+	s.file = f
+	return nil
+}
+
+// Replays the records of the file and moves to its end. An incomplete last line left
+// by an interrupted write is cut off, a correct one without the line end is ended.
+func (s *JsonlStorage) load(f *os.File) error {
+	s.MemStorage.Lock()
+	defer s.MemStorage.Unlock()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		last := errors.Is(err, io.EOF)
+		if err != nil && !last {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			offset += int64(len(line))
+			if last {
+				break
+			}
+			continue
+		}
+
+		var rec jsonlRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			if last {
+				logger.Warn(fmt.Sprintf("incomplete line %d of %q is removed", n, s.path))
+				if err = f.Truncate(offset); err != nil {
+					return err
+				}
+				break
+			}
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		offset += int64(len(line))
+		if last {
+			// the line is complete, only its end is missing
+			if _, err = f.WriteAt([]byte("\n"), offset); err != nil {
+				return err
+			}
+			offset++
+		}
+		if err = s.replay(&rec); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		if last {
+			break
+		}
+	}
+
+	_, err := f.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Applies the record to the memory. The caller must hold the lock of the memory.
+func (s *JsonlStorage) replay(rec *jsonlRecord) error {
+	switch rec.Kind {
+	case jsonlRate:
+		if rec.Rate == nil {
+			return fmt.Errorf("no rate in the record")
+		}
+		s.revisions = append(s.revisions, *rec.Rate)
+
+	case jsonlFetch:
+		if rec.Fetch == nil {
+			return fmt.Errorf("no fetch in the record")
+		}
+		fetch := *rec.Fetch
+		if fetch.Payload != nil {
+			payload, err := decompressPayload(fetch.Payload)
+			if err != nil {
+				return fmt.Errorf("failed to decompress the answer of fetch %d: %v", fetch.ID, err)
+			}
+			fetch.Payload = payload
+		}
+		s.fetches = append(s.fetches, fetch)
+
+	case jsonlCatalog:
+		s.catalog = rec.Catalog
+		// a catalog saved before the time was recorded is downloaded again
+		s.savedAt, _ = time.Parse(dbTimeFormat, rec.SavedAt)
+
+	default:
+		return fmt.Errorf("unknown record kind %q", rec.Kind)
+	}
+	return nil
+}
+
+// Writes the records at the end of the file.
+func (s *JsonlStorage) write(records ...jsonlRecord) error {
+	if s.file == nil {
+		return fmt.Errorf("the storage %q isn't initialized", s.path)
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+	end, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to write %q: %v", s.path, err)
+	}
+	if _, err = s.file.Write(b.Bytes()); err != nil {
+		// a partly written line would break the lines written after it
+		if s.file.Truncate(end) == nil {
+			s.file.Seek(end, io.SeekStart)
+		}
+		return fmt.Errorf("failed to write %q: %v", s.path, err)
+	}
+	return nil
+}
+
+// Closes the file.
+func (s *JsonlStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
+
+// Adds the exchange rates on the date, a changed rate is added as a new revision of it.
+// Returns the number of the added revisions.
+func (s *JsonlStorage) Add(ctx context.Context, rates *DayRates, filter *CurrencyFilter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return 0, fmt.Errorf("the storage %q isn't initialized", s.path)
+	}
+
+	// the memory is changed only after the file, so that they stay the same on failures
+	s.MemStorage.Lock()
+	defer s.MemStorage.Unlock()
+
+	added := s.newRevisions(rates, filter)
+	records := make([]jsonlRecord, len(added))
+	for i := range added {
+		records[i] = jsonlRecord{Kind: jsonlRate, Rate: &added[i]}
+	}
+	if err := s.write(records...); err != nil {
+		return 0, err
+	}
+	s.revisions = append(s.revisions, added...)
+	return len(added), nil
+}
+
+// Archives the fetch, the payload is compressed. Returns the identifier of the fetch.
+func (s *JsonlStorage) AddFetch(ctx context.Context, f *FetchRecord) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return 0, fmt.Errorf("the storage %q isn't initialized", s.path)
+	}
+
+	s.MemStorage.Lock()
+	defer s.MemStorage.Unlock()
+
+	if id, ok := s.archivedFetch(f); ok {
+		return id, nil
+	}
+	fetch := *f
+	fetch.ID = s.nextFetchID()
+
+	archived := fetch
+	if f.Payload != nil {
+		payload, err := compressPayload(f.Payload)
+		if err != nil {
+			return 0, fmt.Errorf("failed to compress the answer: %v", err)
+		}
+		archived.Payload = payload
+	}
+	if err := s.write(jsonlRecord{Kind: jsonlFetch, Fetch: &archived}); err != nil {
+		return 0, err
+	}
+	s.fetches = append(s.fetches, fetch)
+	return fetch.ID, nil
+}
+
+// Replaces the cached currency catalog.
+func (s *JsonlStorage) SaveCatalog(ctx context.Context, catalog *CurrencyCatalog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("the storage %q isn't initialized", s.path)
+	}
+
+	s.MemStorage.Lock()
+	defer s.MemStorage.Unlock()
+
+	saved := time.Now().UTC()
+	record := jsonlRecord{Kind: jsonlCatalog, Catalog: catalog.Items(), SavedAt: saved.Format(dbTimeFormat)}
+	if err := s.write(record); err != nil {
+		return err
+	}
+	s.catalog = record.Catalog
+	s.savedAt = saved
+	return nil
+}
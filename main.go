@@ -1,21 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
-	"runtime"
-	"sync"
 	"time"
 
 	"go.uber.org/zap"
 )
 
-const maxInstances = 3
-
 var (
-	logger         *zap.Logger // all methods are safe for concurrent use
-	currencyFilter *CurrencyFilter
+	logger          *zap.Logger // all methods are safe for concurrent use
+	currencyCatalog *CurrencyCatalog
+	currencyFilter  *CurrencyFilter
 )
 
 func init() {
@@ -27,23 +28,24 @@ func init() {
 	}
 	defer logger.Sync()
 
-	currencyFilter = newCurrencyFilter()
+	currencyCatalog = newBuiltinCatalog()
 }
 
 func main() {
-	var err error
-
 	cmd := newRootCmd()
-	if err = cmd.Execute(); err != nil {
+	executed, err := cmd.ExecuteC()
+	if err != nil {
 		// cobra prints an error
 		logger.Info(fmt.Sprintf("cmd error: %v", err))
 		return
 	}
-	if cmd.Flags().Changed("help") {
-		// cobra prints help
+	if executed != cmd || cmd.Flags().Changed("help") {
+		// a subcommand has done its work or cobra prints help
 		return
 	}
 
+	currencyFilter = newCurrencyFilter(currencyCatalog)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -68,7 +70,7 @@ func main() {
 		currencyFilter.Enable()
 	}
 
-	var queries []*ExchRateQuery
+	var dates []time.Time
 	if cmd.Flags().Changed("date") {
 		len := len(argDate)
 		if len == 0 {
@@ -79,24 +81,31 @@ func main() {
 			return
 		}
 
-		queries = make([]*ExchRateQuery, len, len)
+		dates = make([]time.Time, len, len)
 		for i, d := range argDate {
-			q := newExchRateQuery()
-			if err = q.SetDate(d); err != nil {
+			if dates[i], err = parseDate(d); err != nil {
 				logger.Warn(fmt.Sprintf("setting date %q failed: %v", d, err))
 
 				fmt.Printf("%v.\nPass the exchange rate date you're interested as day.month.year.\n", err)
 				return
 			}
-			queries[i] = q
+		}
+	} else if cmd.Flags().Changed("from") {
+		from, _ := parseDate(argFrom)
+		to, _ := parseDate(argTo)
+		if dates, err = expandDateRange(from, to, argStep); err != nil {
+			logger.Warn(fmt.Sprintf("period %q - %q wasn't expanded: %v", argFrom, argTo, err))
+
+			fmt.Printf("%v.\nPass the period you're interested, for example \"--from 01.01.2022 --to 31.03.2022\".\n", err)
+			return
 		}
 	} else {
-		queries = []*ExchRateQuery{newExchRateQuery()}
+		dates = []time.Time{newExchRateQuery().time}
 	}
 
-	var storage *DbStorage
-	if cmd.Flags().Changed("sql") {
-		if len(argSql) == 0 {
+	var storage Storage
+	if cmd.Flags().Changed("sql") || cmd.Flags().Changed("store") {
+		if len(storeLocation()) == 0 {
 			logger.Warn("entered an empty name of the database file")
 
 			fmt.Println("pass the name of the database file in which the exchange rate data ",
@@ -104,77 +113,315 @@ func main() {
 			return
 		}
 
-		storage = newDbStorage("./" + argSql)
-		if err = storage.Init(ctx); err != nil {
-			logger.Error(fmt.Sprintf("failed to create the database: %v", err))
+		if storage, err = openStorage(storeLocation()); err != nil {
+			fmt.Printf("%v\n", err)
+			return
+		}
+		defer storage.Close()
+
+		if cmd.Flags().Changed("as-of") {
+			asOf, _ := parseMoment(argAsOf)
+			storage.SetAsOf(asOf)
+		}
+	}
+
+	// the dates found in the storage aren't requested
+	var stored []*QueryResult
+	if argOffline || argDbFirst {
+		if stored, dates, err = loadStoredRates(ctx, storage, dates, currencyFilter); err != nil {
+			logger.Error(fmt.Sprintf("failed to read the storage: %v", err))
 
-			fmt.Printf("failed to create the database: %v\n", err)
+			fmt.Printf("failed to read the storage: %v\n", err)
 			return
 		}
+		logger.Info(fmt.Sprintf("%d dates found in the storage, %d dates are missing", len(stored), len(dates)))
 	}
 
-	var wg sync.WaitGroup
+	// the format is checked with the flags
+	formatter, _ := formatterFromArgs()
+	printer := newResultPrinter(formatter)
+	order, _ := parseRecordOrder(argSort)
+	printer.setOrder(order)
+	printer.setStream(argStream)
 
-	printer := newResultPrinter()
+	expected := make([]RateQuery, 0, len(stored))
+	for _, result := range stored {
+		expected = append(expected, result.Query)
+	}
+
+	if argOffline {
+		missing := make([]RateQuery, len(dates))
+		for i, d := range dates {
+			query := newExchRateQuery()
+			query.SetTime(d)
+			missing[i] = query
+		}
+		printer.expect(append(expected, missing...))
 
-	for _, query := range queries {
-		for runtime.NumGoroutine() > maxInstances {
-			time.Sleep(500 * time.Millisecond)
+		var previous *PreviousRates
+		if argChange {
+			previous = newPreviousRates(storage, nil)
 		}
+		for _, result := range stored {
+			handleResult(ctx, result, currencyFilter, printer, storage, previous)
+		}
+		for i, query := range missing {
+			printer.report(query, "no data on %s in the storage %q\n", dates[i].Format("02.01.2006"), storage)
+			printer.done(query)
+		}
+		printer.finish()
+		printer.message("Done.\n")
+		return
+	}
+
+	queries := planQueries(dates, currencyFilter, currencyCatalog)
+	logger.Info(fmt.Sprintf("%d dates planned as %d requests", len(dates), len(queries)))
 
-		wg.Add(1)
-		go worker(&wg, ctx, query, currencyFilter, printer, storage)
+	printer.expect(append(expected, queries...))
+
+	client := newClientFromArgs()
+	validator := newRatesValidator(currencyCatalog, argStrict)
+
+	cache := newCacheFromArgs()
+	fetch := func(ctx context.Context, query RateQuery) *QueryResult {
+		return fetchRates(ctx, client, cache, query, validator, storage != nil)
+	}
+
+	var previous *PreviousRates
+	if argChange {
+		previous = newPreviousRates(storage, fetch)
+	}
+	for _, result := range stored {
+		handleResult(ctx, result, currencyFilter, printer, storage, previous)
 	}
 
-	wg.Wait()
+	pool := newWorkerPool(argConcurrency)
+	results := pool.Run(ctx, queries, fetch)
 
-	fmt.Println("Done.")
+	for result := range results {
+		handleResult(ctx, result, currencyFilter, printer, storage, previous)
+	}
+
+	printer.finish()
+	printer.message("Done.\n")
 }
 
-func worker(wg *sync.WaitGroup, ctx context.Context, query *ExchRateQuery,
-	filter *CurrencyFilter, printer *ResultPrinter, storage *DbStorage) {
+// Requests, decodes and validates the exchange rates. Answers are taken from the cache
+// and saved in it if the cache isn't nil, the answer from the server is kept in the fetch
+// record if 'archive' is set. Safe for concurrent use.
+func fetchRates(ctx context.Context, client *CbrClient, cache *ResponseCache, query RateQuery,
+	validator *RatesValidator, archive bool) *QueryResult {
+
+	result := &QueryResult{Query: query}
+
+	var (
+		answer   []byte
+		fresh    *bytes.Buffer // the answer from the server, nil if it isn't kept
+		received time.Time
+		ok       bool
+		err      error
+	)
+	if cache != nil {
+		answer, received, ok = cache.Get(query.String(), query.LatestDate())
+	}
+	if ok {
+		logger.Info(fmt.Sprintf("[%s] answer taken from the cache", query))
+		result.Fetch = newFetchRecord(query, received, answer)
+		result.Fetch.Status = http.StatusOK
+		result.Fetch.FromCache = true
+
+		result.Rates, err = query.Decode(bytes.NewReader(answer))
+	} else {
+		received = time.Now()
+		// the answer is decoded while it's read, a copy is kept only to be cached or archived
+		rerr := client.Get(ctx, query.String(), func(answer io.Reader) error {
+			fresh = nil
+			if cache != nil || archive {
+				fresh = &bytes.Buffer{}
+				answer = io.TeeReader(answer, fresh)
+			}
+			result.Rates, err = query.Decode(answer)
+			if fresh != nil {
+				// the decoder may stop before the end, the kept answer must be whole
+				if _, cerr := io.Copy(io.Discard, answer); cerr != nil {
+					return cerr
+				}
+			}
+
+			// a failure of reading the answer is retried, a failure of decoding isn't
+			var e *RequestError
+			if errors.As(err, &e) {
+				return err
+			}
+			return nil
+		})
+		if rerr != nil {
+			logger.Error(fmt.Sprintf("[%s] failed: %v", query, rerr))
+
+			result.Rates = nil
+			result.Fetch = newFetchRecord(query, received, nil)
+			result.Fetch.Duration = time.Since(received)
+			var e *RequestError
+			if errors.As(rerr, &e) {
+				result.Fetch.Status = e.StatusCode
+			}
+			result.Fetch.Err = rerr.Error()
+			result.Err = fmt.Errorf("request wasn't completed: %w", rerr)
+			return result
+		}
 
-	defer wg.Done()
+		var payload []byte
+		if fresh != nil && archive {
+			payload = fresh.Bytes()
+		}
+		result.Fetch = newFetchRecord(query, received, payload)
+		result.Fetch.Duration = time.Since(received)
+		result.Fetch.Status = http.StatusOK
+	}
 
-	client := newCbrClient()
-	answer, err := client.Get(ctx, query.String())
 	if err != nil {
-		logger.Error(fmt.Sprintf("[%s] failed: %v", query, err))
+		logger.Error(fmt.Sprintf("[%s] decoding failed: %v", query, err))
 
-		fmt.Printf("request %q wasn't completed: %v\n", query, err)
-		return
+		result.Err = fmt.Errorf("response was not decoded: %w", err)
+		return result
+	}
+	logger.Info(fmt.Sprintf("[%s] response successfully decoded", query))
+	for i := range result.Rates {
+		result.Rates[i].Fetched = received
+		result.Rates[i].Source = query.String()
 	}
-	logger.Debug(fmt.Sprintf("[%s] received an answer: %s", query, answer))
 
-	decoder := newCbrDecoder(answer)
-	if !decoder.isValid {
-		logger.Error(fmt.Sprintf("[%s] failed, received incorrect answer: %s", query, answer))
+	if verr := validator.Validate(result.Rates); verr != nil {
+		if validator.IsStrict() {
+			logger.Error(fmt.Sprintf("[%s] validation failed: %v", query, verr))
 
-		fmt.Printf("response to request %q was not decoded, received incorrect answer:\n%s\n", query, answer)
-		return
+			result.Err = fmt.Errorf("response was rejected: %w", verr)
+			return result
+		}
+		logger.Warn(fmt.Sprintf("[%s] validation failed: %v", query, verr))
+
+		result.Issues = verr
 	}
 
-	result := CbrResult{}
-	if err = decoder.Decode(&result); err != nil {
-		logger.Error(fmt.Sprintf("[%s] decoding failed: %v", query, err))
+	if cache != nil && fresh != nil {
+		if err = cache.Put(query.String(), fresh.Bytes()); err != nil {
+			logger.Warn(fmt.Sprintf("[%s] failed to cache the answer: %v", query, err))
+		}
+	}
+
+	return result
+}
+
+// Prints and saves the result of the query. The previous rates are looked up if 'previous'
+// isn't nil.
+func handleResult(ctx context.Context, result *QueryResult, filter *CurrencyFilter,
+	printer *ResultPrinter, storage Storage, previous *PreviousRates) {
+
+	query := result.Query
+	defer printer.done(query)
+
+	if result.Stored {
+		// the rates were read from the database, there is nothing to check or to save
+		storage = nil
+	}
+
+	// the failed requests are archived too, an answer which wasn't decoded
+	// may be reprocessed later
+	var fetchID int64
+	if storage != nil && result.Fetch != nil {
+		if filter.IsEnabled() {
+			result.Fetch.Currencies = filter.EnabledCodes()
+		}
+		var err error
+		if fetchID, err = storage.AddFetch(ctx, result.Fetch); err != nil {
+			logger.Error(fmt.Sprintf("failed to archive the request: %v", err))
 
-		fmt.Printf("response to request %q was not decoded: %v\n", query, err)
+			printer.report(query, "failed to archive the request %q: %v\n", query, err)
+			return
+		}
+	}
+
+	if result.Err != nil {
+		printer.report(query, "request %q failed: %v\n", query, result.Err)
 		return
 	}
-	logger.Info(fmt.Sprintf("[%s] response successfully decoded", query))
+	if result.Issues != nil {
+		printer.report(query, "response to request %q has %d issues, see the log for details\n",
+			query, len(result.Issues.Issues))
+	}
 
-	// print the answer
-	printer.print(query, filter, &result.Currencies)
+	for _, r := range result.Rates {
+		if previous != nil {
+			if err := previous.Load(ctx, &r, filter); err != nil {
+				logger.Warn(fmt.Sprintf("[%s] failed to look up the previous rates: %v", query, err))
 
-	// save the answer to db
-	if storage != nil {
-		err = storage.Add(ctx, query, &result.Currencies, filter)
+				printer.report(query, "failed to look up the previous rates: %v\n", err)
+			}
+			if _, ok := query.(*ExchRateQuery); ok && !result.Stored {
+				day := r
+				previous.remember(&day)
+			}
+		}
+
+		// print the answer
+		printer.print(query, &r, filter)
+
+		// save the answer to db
+		if storage != nil {
+			r.FetchID = fetchID
+			_, err := storage.Add(ctx, &r, filter)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to save data to the database: %v", err))
+
+				printer.report(query, "failed to save data to the database: %v\n", err)
+				return
+			}
+			logger.Info(fmt.Sprintf("[%s] data on %s successfully saved in %q",
+				query, r.Query.Date("02.01.2006"), storage))
+		}
+	}
+}
+
+// Loads the exchange rates on the dates from the database. Returns the rates found
+// and the dates missing in the database. When the filter is enabled, a date is found
+// only if all the enabled currencies are stored on it.
+func loadStoredRates(ctx context.Context, storage Storage, dates []time.Time,
+	filter *CurrencyFilter) ([]*QueryResult, []time.Time, error) {
+
+	stored := []*QueryResult{}
+	missing := []time.Time{}
+	for _, d := range dates {
+		query := newExchRateQuery()
+		query.SetTime(d)
+
+		rates, err := storage.LoadDay(ctx, query)
 		if err != nil {
-			logger.Error(fmt.Sprintf("failed to save data to the database: %v", err))
+			return nil, nil, err
+		}
+		if rates == nil || !hasEnabledCurrencies(rates.Currencies, filter) {
+			missing = append(missing, d)
+			continue
+		}
 
-			fmt.Printf("failed to save data to the database: %v\n", err)
-			return
+		stored = append(stored, &QueryResult{Query: query, Rates: []DayRates{*rates}, Stored: true})
+	}
+	return stored, missing, nil
+}
+
+// Checks all the currencies enabled in the filter are in the list.
+func hasEnabledCurrencies(currencies Currencies, filter *CurrencyFilter) bool {
+	if !filter.IsEnabled() {
+		return len(currencies) > 0
+	}
+
+	found := map[string]bool{}
+	for _, c := range currencies {
+		found[c.CharCode] = true
+	}
+	for _, code := range filter.EnabledCodes() {
+		if !found[code] {
+			return false
 		}
-		logger.Info(fmt.Sprintf("[%s] data successfully saved in %q", query, storage.name))
 	}
+	return true
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestFetchRates(t *testing.T) {
+	answer := `<?xml version="1.0" encoding="windows-1251"?>
+	<ValCurs Date="10.03.2023" name="Foreign Currency Market">
+		<Valute ID="R01235">
+			<NumCode>840</NumCode>
+			<CharCode>USD</CharCode>
+			<Nominal>1</Nominal>
+			<Name>US Dollar</Name>
+			<Value>75,5</Value>
+		</Valute>
+	</ValCurs>
+`
+	dropped := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml; charset=windows-1251")
+		if dropped {
+			// the connection is dropped in the middle of the answer
+			dropped = false
+			w.Header().Set("Content-Length", strconv.Itoa(len(answer)))
+			w.Write([]byte(answer[:len(answer)/2]))
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte(answer))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client := newTestClient(0)
+	validator := newRatesValidator(newBuiltinCatalog(), false)
+	query := newExchRateQuery()
+	query.SetDate("11.03.2023")
+	query.link = server.URL + "?date_req="
+
+	// the answer isn't kept if it's neither cached nor archived
+	result := fetchRates(ctx, client, nil, query, validator, false)
+	if result.Err != nil {
+		t.Fatalf("request failed: %v", result.Err)
+	}
+	if len(result.Rates) != 1 || result.Rates[0].Currencies[0].Value.String() != "75.5" {
+		t.Fatalf("expected USD 75.5 got %v", result.Rates)
+	}
+	if result.Fetch.Payload != nil {
+		t.Fatalf("expected no payload got %q", result.Fetch.Payload)
+	}
+
+	cache := newResponseCache(t.TempDir())
+	if result = fetchRates(ctx, client, cache, query, validator, true); result.Err != nil {
+		t.Fatalf("request failed: %v", result.Err)
+	}
+	if string(result.Fetch.Payload) != answer {
+		t.Fatalf("expected the whole answer got %q", result.Fetch.Payload)
+	}
+	if cached, _, ok := cache.Get(query.String(), query.LatestDate()); !ok || string(cached) != answer {
+		t.Fatalf("expected the whole answer in the cache got %q", cached)
+	}
+
+	// the answer is requested again if the connection is dropped while it's read
+	dropped = true
+	client.retries = 1
+	if result = fetchRates(ctx, client, nil, query, validator, true); result.Err != nil || dropped {
+		t.Fatalf("expected the second request to succeed got %v", result.Err)
+	}
+	if string(result.Fetch.Payload) != answer || len(result.Rates) != 1 {
+		t.Fatalf("expected the whole answer got %q", result.Fetch.Payload)
+	}
+	dropped = true
+	client.retries = 0
+	if result = fetchRates(ctx, client, nil, query, validator, true); !isTransient(result.Err) || result.Rates != nil {
+		t.Fatalf("expected a transient error got %v", result.Err)
+	}
+
+	// an answer which wasn't decoded is archived whole
+	answer = `<?xml version="1.0" encoding="windows-1251"?><ValCurs><Valute>` + answer
+	query.SetDate("12.03.2023")
+	if result = fetchRates(ctx, client, nil, query, validator, true); result.Err == nil {
+		t.Fatalf("expected a decoding error got nil")
+	}
+	if string(result.Fetch.Payload) != answer {
+		t.Fatalf("expected the whole answer got %q", result.Fetch.Payload)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// pages copied by one backup step, the database isn't locked between steps
+	dbBackupStepPages = 256
+
+	sqlIntegrityCheck = `PRAGMA integrity_check;`
+
+	sqlForeignKeyCheck = `PRAGMA foreign_key_check;`
+
+	sqlAttachSource = `ATTACH DATABASE ? AS source;`
+
+	sqlDetachSource = `DETACH DATABASE source;`
+
+	sqlSelectSourceVersion = `
+        SELECT COALESCE(MAX(version), 0)
+            FROM source.schema_version;`
+
+	// the currencies keep the names of the target, the periods are joined; a currency
+	// which doesn't change isn't updated, so that it isn't counted
+	sqlMergeCurrencies = `
+        INSERT INTO main.currencies
+            (id, num_code, char_code, name, rus_name, valid_from, valid_to)
+            SELECT id, num_code, char_code, name, rus_name, valid_from, valid_to
+                FROM source.currencies
+                WHERE true
+            ON CONFLICT(id) DO UPDATE
+                SET rus_name = CASE WHEN rus_name = '' THEN excluded.rus_name ELSE rus_name END,
+                    valid_from = MIN(COALESCE(valid_from, excluded.valid_from),
+                        COALESCE(excluded.valid_from, valid_from)),
+                    valid_to = MAX(COALESCE(valid_to, excluded.valid_to),
+                        COALESCE(excluded.valid_to, valid_to))
+                WHERE (rus_name = '' AND excluded.rus_name <> '')
+                    OR (excluded.valid_from IS NOT NULL
+                        AND (valid_from IS NULL OR excluded.valid_from < valid_from))
+                    OR (excluded.valid_to IS NOT NULL
+                        AND (valid_to IS NULL OR excluded.valid_to > valid_to));`
+
+	// a fetch is the same if it was made at the same time and got the same answer
+	sqlMergeFetches = `
+        INSERT INTO main.cbr_fetch
+            (url, query_dates, currencies, status, error, started_at, duration_ms, from_cache,
+                size, sha256, payload)
+            SELECT url, query_dates, currencies, status, error, started_at, duration_ms, from_cache,
+                    size, sha256, payload
+                FROM source.cbr_fetch f
+                WHERE NOT EXISTS (
+                    SELECT 1
+                        FROM main.cbr_fetch
+                        WHERE url = f.url
+                            AND started_at = f.started_at
+                            AND sha256 = f.sha256)
+                ORDER BY id;`
+
+	// the requested dates missing in the target are merged with all their mappings
+	sqlCreateMergedDates = `
+        CREATE TEMP TABLE merged_date AS
+            SELECT DISTINCT rate_date, currency_id
+                FROM source.rate_dates d
+                WHERE NOT EXISTS (
+                    SELECT 1
+                        FROM main.rate_dates
+                        WHERE rate_date = d.rate_date
+                            AND currency_id = d.currency_id);`
+
+	sqlMergeRateDates = `
+        INSERT INTO main.rate_dates
+            (rate_date, currency_id, effective_date, recorded_at)
+            SELECT d.rate_date, d.currency_id, d.effective_date, d.recorded_at
+                FROM source.rate_dates d
+                    JOIN merged_date k ON k.rate_date = d.rate_date
+                        AND k.currency_id = d.currency_id
+                ORDER BY d.id;`
+
+	sqlDropMergedDates = `DROP TABLE temp.merged_date;`
+
+	// the rates published for the dates missing in the target are merged with all
+	// their revisions
+	sqlCreateMergedKeys = `
+        CREATE TEMP TABLE merged_key AS
+            SELECT DISTINCT effective_date, currency_id
+                FROM source.rates r
+                WHERE NOT EXISTS (
+                    SELECT 1
+                        FROM main.rates
+                        WHERE effective_date = r.effective_date
+                            AND currency_id = r.currency_id);`
+
+	sqlMergeRates = `
+        INSERT INTO main.rates
+            (effective_date, currency_id, denomination, rate_value,
+                fetched_at, recorded_at, source, fetch_id)
+            SELECT r.effective_date, r.currency_id, r.denomination, r.rate_value,
+                    r.fetched_at, r.recorded_at, r.source,
+                    (SELECT t.id
+                        FROM main.cbr_fetch t
+                            JOIN source.cbr_fetch f ON f.url = t.url
+                                AND f.started_at = t.started_at
+                                AND f.sha256 = t.sha256
+                        WHERE f.id = r.fetch_id
+                        ORDER BY t.id
+                        LIMIT 1)
+                FROM source.rates r
+                    JOIN merged_key k ON k.effective_date = r.effective_date
+                        AND k.currency_id = r.currency_id
+                ORDER BY r.id;`
+
+	sqlDropMergedKeys = `DROP TABLE temp.merged_key;`
+
+	sqlSelectMergeConflicts = `
+        SELECT t.rate_date, t.char_code, t.effective_date, t.denomination, t.rate_value,
+                s.effective_date, s.denomination, s.rate_value
+            FROM source.cbr_exchange_rate s
+                JOIN main.cbr_exchange_rate t ON t.rate_date = s.rate_date
+                    AND t.currency_id = s.currency_id
+            WHERE t.effective_date <> s.effective_date
+                OR t.denomination <> s.denomination
+                OR t.rate_value <> s.rate_value
+            ORDER BY t.rate_date, t.char_code;`
+)
+
+// Copies the database to the file with the SQLite online backup API. The database can be
+// used meanwhile. The file must not exist.
+func (s *DbStorage) Backup(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("the backup file %q already exists", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("can't access the backup file %q: %v", path, err)
+	}
+
+	db, err := s.conn()
+	if err != nil {
+		return err
+	}
+	src, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open the database: %v", err)
+	}
+	defer src.Close()
+
+	dest, err := sql.Open("sqlite3", newDbStorage(path).dsn())
+	if err != nil {
+		return fmt.Errorf("failed to open the backup file: %v", err)
+	}
+	defer dest.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open the backup file: %v", err)
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destRaw any) error {
+		return src.Raw(func(srcRaw any) error {
+			backup, err := destRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return fmt.Errorf("failed to start the backup: %v", err)
+			}
+			defer backup.Close()
+
+			for {
+				done, err := backup.Step(dbBackupStepPages)
+				if err != nil {
+					return fmt.Errorf("failed to copy the database: %v", err)
+				}
+				if done {
+					break
+				}
+				// the database is busy or the pages are left for the next step
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(time.Millisecond):
+				}
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// Rebuilds the database file, so that it takes no unused space.
+func (s *DbStorage) Vacuum(ctx context.Context) error {
+	db, err := s.conn()
+	if err != nil {
+		return err
+	}
+	// VACUUM can't be run in a transaction
+	if _, err = db.ExecContext(ctx, `VACUUM;`); err != nil {
+		return fmt.Errorf("failed to vacuum the database: %v", err)
+	}
+	return nil
+}
+
+// Checks the database file with the SQLite integrity check and the stored rates as the answers
+// of the server are checked: codes unknown to the catalog, non-positive nominals and values,
+// duplicates. Returns the found problems, none if the database is fine.
+func (s *DbStorage) Check(ctx context.Context, catalog *CurrencyCatalog) ([]string, error) {
+	problems := []string{}
+
+	err := s.SelectRows(ctx, func(rows *sql.Rows) error {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, "integrity: "+result)
+		}
+		return nil
+	}, sqlIntegrityCheck)
+	if err != nil {
+		return nil, err
+	}
+	// the rest of the checks can't be trusted if the file is damaged
+	if len(problems) > 0 {
+		return problems, nil
+	}
+
+	err = s.SelectRows(ctx, func(rows *sql.Rows) error {
+		var (
+			table, parent string
+			rowid         sql.NullInt64
+			fkid          int
+		)
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			return err
+		}
+		problems = append(problems, fmt.Sprintf("foreign key: row %d of %s refers to a missing row of %s",
+			rowid.Int64, table, parent))
+		return nil
+	}, sqlForeignKeyCheck)
+	if err != nil {
+		return nil, err
+	}
+
+	dates, err := s.ListDates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	validator := newRatesValidator(catalog, false)
+	for _, d := range dates {
+		query := newExchRateQuery()
+		query.SetTime(d)
+		day, err := s.LoadDay(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		if day == nil {
+			continue
+		}
+		// the date is stored in another format than CBR sends it
+		day.RawDate = day.EffectiveDate("02.01.2006")
+		if verr := validator.Validate([]DayRates{*day}); verr != nil {
+			for _, issue := range verr.Issues {
+				problems = append(problems, issue.String())
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// Rate stored differently in two databases.
+type MergeConflict struct {
+	Date     string // the requested date
+	CharCode string
+	Target   string // the rate kept in the target database
+	Source   string // the rate of the merged database
+}
+
+func (c MergeConflict) String() string {
+	return fmt.Sprintf("%s %s: %s is kept, %s is skipped", c.Date, c.CharCode, c.Target, c.Source)
+}
+
+// Changes made by merging a database.
+type MergeResult struct {
+	Currencies int // added or updated
+	Fetches    int
+	Revisions  int
+	Conflicts  []MergeConflict
+}
+
+// Merges the database file into the database in one transaction. The currencies are joined,
+// the fetches missing in the database are added, the rates on the dates missing in the
+// database are added with all their revisions. The current rates stored in both databases
+// differently are reported as conflicts, the rates of the database are kept. The merged
+// database must be at the same schema version and isn't changed.
+func (s *DbStorage) Merge(ctx context.Context, path string) (*MergeResult, error) {
+	var (
+		db     *sql.DB
+		conn   *sql.Conn
+		tx     *sql.Tx
+		res    sql.Result
+		count  int64
+		result MergeResult
+		err    error
+	)
+
+	// attaching a missing file creates it
+	if _, err = os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to open the merged database: %v", err)
+	}
+
+	if db, err = s.conn(); err != nil {
+		return nil, err
+	}
+	// the attached database is seen by one connection only
+	if conn, err = db.Conn(ctx); err != nil {
+		return nil, fmt.Errorf("failed to open the database: %v", err)
+	}
+	defer conn.Close()
+
+	source := (&DbStorage{name: path, params: url.Values{"mode": {"ro"}}}).dsn()
+	if _, err = conn.ExecContext(ctx, sqlAttachSource, source); err != nil {
+		return nil, fmt.Errorf("failed to attach the merged database: %v", err)
+	}
+	defer conn.ExecContext(context.Background(), sqlDetachSource)
+
+	var version int
+	if err = conn.QueryRowContext(ctx, sqlSelectSourceVersion).Scan(&version); err != nil {
+		return nil, fmt.Errorf("failed to read the schema version of %q: %v", path, err)
+	}
+	if version != latestSchemaVersion() {
+		return nil, fmt.Errorf("the schema version %d of %q differs from the version %d, migrate it first",
+			version, path, latestSchemaVersion())
+	}
+
+	if tx, err = conn.BeginTx(ctx, nil); err != nil {
+		return nil, fmt.Errorf("failed to begin a transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, sqlSelectMergeConflicts)
+	if err != nil {
+		return nil, fmt.Errorf("database query failed: %v", err)
+	}
+	for rows.Next() {
+		var (
+			c                                MergeConflict
+			targetEffective, sourceEffective string
+			targetNominal, sourceNominal     int
+			targetValue, sourceValue         Decimal
+		)
+		err = rows.Scan(&c.Date, &c.CharCode, &targetEffective, &targetNominal, &targetValue,
+			&sourceEffective, &sourceNominal, &sourceValue)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read the conflicts: %v", err)
+		}
+		c.Target = fmt.Sprintf("%d for %s RUB of %s", targetNominal, targetValue, targetEffective)
+		c.Source = fmt.Sprintf("%d for %s RUB of %s", sourceNominal, sourceValue, sourceEffective)
+		result.Conflicts = append(result.Conflicts, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the conflicts: %v", err)
+	}
+
+	steps := []struct {
+		query string
+		count *int
+	}{
+		{sqlMergeCurrencies, &result.Currencies},
+		{sqlMergeFetches, &result.Fetches},
+		{sqlCreateMergedDates, nil},
+		{sqlMergeRateDates, nil},
+		{sqlDropMergedDates, nil},
+		{sqlCreateMergedKeys, nil},
+		{sqlMergeRates, &result.Revisions},
+		{sqlDropMergedKeys, nil},
+	}
+	for _, step := range steps {
+		if res, err = tx.ExecContext(ctx, step.query); err != nil {
+			return nil, fmt.Errorf("database query failed: %v", err)
+		}
+		if step.count == nil {
+			continue
+		}
+		if count, err = res.RowsAffected(); err != nil {
+			return nil, fmt.Errorf("unknown database query execution status: %v", err)
+		}
+		*step.count = int(count)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit a transaction: %v", err)
+	}
+
+	return &result, nil
+}
+
+// Returns the size of the database file, zero if it can't be read.
+func (s *DbStorage) fileSize() int64 {
+	info, err := os.Stat(s.name)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
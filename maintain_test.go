@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Creates a database with the rates on the dates, 'values' holds USD and EUR values of every date.
+func newTestDb(t *testing.T, name string, values map[string][2]string) *DbStorage {
+	ctx := context.Background()
+	storage := newDbStorage(name)
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+
+	filter := newCurrencyFilter(newBuiltinCatalog())
+	for date, v := range values {
+		q := newExchRateQuery()
+		q.SetDate(date)
+		rates := &DayRates{Query: q, Effective: q.time, Currencies: Currencies{
+			{ID: "R01235", NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar", Value: mustParseDecimal(v[0])},
+			{ID: "R01239", NumCode: 978, CharCode: "EUR", Nominal: 1, Name: "Euro", Value: mustParseDecimal(v[1])},
+		}}
+		if _, err := storage.Add(ctx, rates, filter); err != nil {
+			t.Fatalf("failed to insert data: %v", err)
+		}
+	}
+	return storage
+}
+
+func TestDbStorageBackup(t *testing.T) {
+	const name, backup = "test_backup_src.db", "test_backup.db"
+	defer removeDbFiles(name)
+	defer removeDbFiles(backup)
+
+	ctx := context.Background()
+	storage := newTestDb(t, name, map[string][2]string{"10.03.2023": {"75.5", "79.9"}})
+	defer storage.Close()
+
+	if err := storage.Backup(ctx, backup); err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+	if err := storage.Backup(ctx, backup); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+
+	copied := newDbStorage(backup)
+	defer copied.Close()
+	if version, err := copied.SchemaVersion(ctx); err != nil || version != latestSchemaVersion() {
+		t.Fatalf("expected version %d got %d: %v", latestSchemaVersion(), version, err)
+	}
+	date, _ := parseDate("10.03.2023")
+	if rate, err := copied.GetRate(ctx, date, "EUR"); err != nil || rate.Value.String() != "79.9" {
+		t.Fatalf("expected 79.9 got %v: %v", rate, err)
+	}
+
+	if err := copied.Vacuum(ctx); err != nil {
+		t.Fatalf("failed to vacuum: %v", err)
+	}
+}
+
+func TestDbStorageMerge(t *testing.T) {
+	const name, other = "test_merge.db", "test_merge_other.db"
+	defer removeDbFiles(name)
+	defer removeDbFiles(other)
+
+	ctx := context.Background()
+	target := newTestDb(t, name, map[string][2]string{
+		"10.03.2023": {"75.5", "79.9"},
+		"11.03.2023": {"75.6", "80.1"},
+	})
+	defer target.Close()
+	source := newTestDb(t, other, map[string][2]string{
+		"11.03.2023": {"75.6", "80.2"},
+		"12.03.2023": {"75.7", "80.3"},
+	})
+	// the merged rate keeps its history and its fetch
+	q := newExchRateQuery()
+	q.SetDate("12.03.2023")
+	fetch := newFetchRecord(q, time.Date(2023, 3, 12, 12, 0, 0, 0, time.UTC), []byte(fetchTestAnswer))
+	fetchID, err := source.AddFetch(ctx, fetch)
+	if err != nil {
+		t.Fatalf("failed to archive the fetch: %v", err)
+	}
+	rates := &DayRates{Query: q, Effective: q.time, FetchID: fetchID, Currencies: Currencies{
+		{ID: "R01235", NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar", Value: mustParseDecimal("75.8")},
+	}}
+	if _, err = source.Add(ctx, rates, newCurrencyFilter(newBuiltinCatalog())); err != nil {
+		t.Fatalf("failed to insert data: %v", err)
+	}
+	source.Close()
+
+	if _, err = target.Merge(ctx, "missing.db"); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+
+	result, err := target.Merge(ctx, other)
+	if err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+	// the periods of both currencies are extended to 12.03
+	if result.Currencies != 2 || result.Revisions != 3 || result.Fetches != 1 || len(result.Conflicts) != 1 {
+		t.Fatalf("expected 2 currencies, 3 revisions, 1 fetch and 1 conflict got %+v", result)
+	}
+	if c := result.Conflicts[0]; c.Date != "2023-03-11" || c.CharCode != "EUR" ||
+		!strings.Contains(c.Target, "80.1") || !strings.Contains(c.Source, "80.2") {
+		t.Fatalf("expected the conflict of EUR on 2023-03-11 got %v", c)
+	}
+
+	date, _ := parseDate("12.03.2023")
+	if rate, err := target.GetRate(ctx, date, "USD"); err != nil || rate.Value.String() != "75.8" {
+		t.Fatalf("expected 75.8 got %v: %v", rate, err)
+	}
+	date, _ = parseDate("11.03.2023")
+	if rate, err := target.GetRate(ctx, date, "EUR"); err != nil || rate.Value.String() != "80.1" {
+		t.Fatalf("expected 80.1 got %v: %v", rate, err)
+	}
+	linked, err := target.SelectCount(ctx, `
+        SELECT COUNT(*) FROM cbr_exchange_rate
+            WHERE rate_date = '2023-03-12'
+                AND char_code = 'USD'
+                AND fetch_id = (SELECT MAX(id) FROM cbr_fetch);`)
+	if err != nil || linked != 1 {
+		t.Fatalf("expected 1 got %d: %v", linked, err)
+	}
+
+	// merging again changes nothing
+	if result, err = target.Merge(ctx, other); err != nil || result.Currencies != 0 || result.Revisions != 0 ||
+		result.Fetches != 0 {
+		t.Fatalf("expected no changes got %+v: %v", result, err)
+	}
+}
+
+func TestDbStorageCheck(t *testing.T) {
+	const name = "test_check.db"
+	defer removeDbFiles(name)
+
+	ctx := context.Background()
+	storage := newTestDb(t, name, map[string][2]string{"10.03.2023": {"75.5", "79.9"}})
+	defer storage.Close()
+
+	catalog := newBuiltinCatalog()
+	problems, err := storage.Check(ctx, catalog)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("expected no problems got %v: %v", problems, err)
+	}
+
+	q := newExchRateQuery()
+	q.SetDate("11.03.2023")
+	rates := &DayRates{Query: q, Effective: q.time, Currencies: Currencies{
+		{NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar", Value: mustParseDecimal("0")},
+		{NumCode: 999, CharCode: "XTS", Nominal: 1, Name: "Test", Value: mustParseDecimal("1")},
+	}}
+	if _, err = storage.Add(ctx, rates, newCurrencyFilter(catalog)); err != nil {
+		t.Fatalf("failed to insert data: %v", err)
+	}
+
+	if problems, err = storage.Check(ctx, catalog); err != nil {
+		t.Fatalf("failed to check: %v", err)
+	}
+	if len(problems) != 2 || !strings.Contains(problems[0], "isn't positive") ||
+		!strings.Contains(problems[1], "unknown char code") {
+		t.Fatalf("expected 2 problems got %v", problems)
+	}
+}
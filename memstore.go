@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Revision of the exchange rate of a currency on a date. Dates and times are kept
+// in the formats of the database.
+type rateRevision struct {
+	Date       string  `json:"date"`
+	Effective  string  `json:"effective"`
+	NumCode    int     `json:"num_code"`
+	CharCode   string  `json:"char_code"`
+	Name       string  `json:"name"`
+	Nominal    int     `json:"nominal"`
+	Value      Decimal `json:"value"`
+	FetchedAt  string  `json:"fetched_at,omitempty"`
+	RecordedAt string  `json:"recorded_at"`
+	Source     string  `json:"source,omitempty"`
+	FetchID    int64   `json:"fetch_id,omitempty"`
+}
+
+// Checks the revisions hold the same rate.
+func (r *rateRevision) sameRate(o *rateRevision) bool {
+	return r.Effective == o.Effective &&
+		r.Name == o.Name &&
+		r.CharCode == o.CharCode &&
+		r.Nominal == o.Nominal &&
+		r.Value.String() == o.Value.String()
+}
+
+func (r *rateRevision) storedRate() (StoredRate, error) {
+	var (
+		s   StoredRate
+		err error
+	)
+	if s.Date, err = parseDbDate(r.Date); err != nil {
+		return s, err
+	}
+	if s.Effective, err = parseDbDate(r.Effective); err != nil {
+		return s, err
+	}
+	s.Currency = Currency{
+		NumCode:  r.NumCode,
+		CharCode: r.CharCode,
+		Nominal:  r.Nominal,
+		Name:     r.Name,
+		Value:    r.Value,
+	}
+	return s, nil
+}
+
+// 'MemStorage' keeps everything in memory. It's used in tests, by programs embedding
+// the package and as the base of the file storages. All methods are safe for concurrent use.
+type MemStorage struct {
+	sync.Mutex
+	asOf      time.Time
+	revisions []rateRevision
+	fetches   []FetchRecord
+	catalog   []CurrencyInfo
+	savedAt   time.Time // the time the catalog was saved
+}
+
+// Creates a 'MemStorage' instance.
+func newMemStorage() *MemStorage {
+	return &MemStorage{}
+}
+
+func (s *MemStorage) String() string {
+	return storeMem
+}
+
+// Does nothing, the storage is ready to work.
+func (s *MemStorage) Init(ctx context.Context) error {
+	return nil
+}
+
+// Does nothing, there are no resources to release.
+func (s *MemStorage) Close() error {
+	return nil
+}
+
+// Adds the exchange rates on the date, a changed rate is added as a new revision of it.
+// Returns the number of the added revisions.
+func (s *MemStorage) Add(ctx context.Context, rates *DayRates, filter *CurrencyFilter) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	added := s.newRevisions(rates, filter)
+	s.revisions = append(s.revisions, added...)
+	return len(added), nil
+}
+
+// Returns the revisions of the rates which aren't stored yet, the storage isn't changed.
+// The caller must hold the lock.
+func (s *MemStorage) newRevisions(rates *DayRates, filter *CurrencyFilter) []rateRevision {
+	date := rates.Query.Date("2006-01-02")
+	current := map[int]*rateRevision{}
+	for i := range s.revisions {
+		if r := &s.revisions[i]; r.Date == date {
+			current[r.NumCode] = r
+		}
+	}
+
+	fetched := ""
+	if !rates.Fetched.IsZero() {
+		fetched = rates.Fetched.UTC().Format(dbTimeFormat)
+	}
+	recorded := time.Now().UTC().Format(dbTimeFormat)
+
+	added := []rateRevision{}
+	for _, c := range rates.Currencies {
+		if filter.IsEnabled() && !filter.IsCurrencyEnabled(c.CharCode) {
+			continue
+		}
+
+		r := rateRevision{
+			Date:       date,
+			Effective:  rates.EffectiveDate("2006-01-02"),
+			NumCode:    c.NumCode,
+			CharCode:   c.CharCode,
+			Name:       c.Name,
+			Nominal:    c.Nominal,
+			Value:      c.Value,
+			FetchedAt:  fetched,
+			RecordedAt: recorded,
+			Source:     rates.Source,
+			FetchID:    rates.FetchID,
+		}
+		if prev, ok := current[c.NumCode]; ok && prev.sameRate(&r) {
+			continue
+		}
+		added = append(added, r)
+	}
+	return added
+}
+
+// Archives the fetch. Returns the identifier of the fetch.
+func (s *MemStorage) AddFetch(ctx context.Context, f *FetchRecord) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	if id, ok := s.archivedFetch(f); ok {
+		return id, nil
+	}
+	fetch := *f
+	fetch.ID = s.nextFetchID()
+	s.fetches = append(s.fetches, fetch)
+	return fetch.ID, nil
+}
+
+// Returns the identifier of the archived fetch if the fetch is taken from the cache
+// and archived before. The caller must hold the lock.
+func (s *MemStorage) archivedFetch(f *FetchRecord) (int64, bool) {
+	if f.FromCache {
+		currencies := fmt.Sprint(f.Currencies)
+		for i := len(s.fetches) - 1; i >= 0; i-- {
+			prev := &s.fetches[i]
+			if prev.URL == f.URL && prev.Hash == f.Hash && fmt.Sprint(prev.Currencies) == currencies {
+				return prev.ID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Returns the identifier of the next archived fetch. The caller must hold the lock.
+func (s *MemStorage) nextFetchID() int64 {
+	return int64(len(s.fetches) + 1)
+}
+
+// Replaces the cached currency catalog.
+func (s *MemStorage) SaveCatalog(ctx context.Context, catalog *CurrencyCatalog) error {
+	s.Lock()
+	defer s.Unlock()
+	s.catalog = catalog.Items()
+	s.savedAt = time.Now().UTC()
+	return nil
+}
+
+// Loads the cached currency catalog. The catalog is empty if it was never saved.
+func (s *MemStorage) LoadCatalog(ctx context.Context) (*CurrencyCatalog, error) {
+	s.Lock()
+	defer s.Unlock()
+	catalog := newCurrencyCatalog(s.catalog)
+	catalog.saved = s.savedAt
+	return catalog, nil
+}
+
+// Makes the storage read the rates as they were recorded by the given time,
+// a zero time means the current rates.
+func (s *MemStorage) SetAsOf(t time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.asOf = t
+}
+
+// Returns the latest revisions recorded by the time set by 'SetAsOf' in the order
+// they were added. The caller must hold the lock.
+func (s *MemStorage) current() []*rateRevision {
+	asOf := ""
+	if !s.asOf.IsZero() {
+		asOf = s.asOf.UTC().Format(dbTimeFormat)
+	}
+
+	type key struct {
+		date    string
+		numCode int
+	}
+	latest := map[key]int{}
+	for i, r := range s.revisions {
+		if asOf != "" && r.RecordedAt > asOf {
+			continue
+		}
+		latest[key{r.Date, r.NumCode}] = i
+	}
+
+	indexes := make([]int, 0, len(latest))
+	for _, i := range latest {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	revisions := make([]*rateRevision, len(indexes))
+	for i, index := range indexes {
+		revisions[i] = &s.revisions[index]
+	}
+	return revisions
+}
+
+// Loads the exchange rates stored on the requested date. Returns nil if there are none.
+func (s *MemStorage) LoadDay(ctx context.Context, query *ExchRateQuery) (*DayRates, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	date := query.Date("2006-01-02")
+	rates := &DayRates{Query: query}
+	for _, r := range s.current() {
+		if r.Date != date {
+			continue
+		}
+		rates.RawDate = r.Effective
+		rates.Currencies = append(rates.Currencies, Currency{
+			NumCode:  r.NumCode,
+			CharCode: r.CharCode,
+			Nominal:  r.Nominal,
+			Name:     r.Name,
+			Value:    r.Value,
+		})
+	}
+	if len(rates.Currencies) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	if rates.Effective, err = parseDbDate(rates.RawDate); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// Returns the exchange rate of the currency requested on the date or published for it.
+// Returns 'errNoStoredRates' if there is no such rate.
+func (s *MemStorage) GetRate(ctx context.Context, date time.Time, code string) (*StoredRate, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	day := date.Format("2006-01-02")
+	var found *rateRevision
+	for _, r := range s.current() {
+		if r.CharCode != code {
+			continue
+		}
+		if r.Date == day {
+			found = r
+			break
+		}
+		if r.Effective == day && found == nil {
+			found = r
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s on %s", errNoStoredRates, code, date.Format("02.01.2006"))
+	}
+
+	rate, err := found.storedRate()
+	if err != nil {
+		return nil, err
+	}
+	return &rate, nil
+}
+
+// Returns the latest exchange rate of the currency published for a date before the given
+// one. Returns 'errNoStoredRates' if there is no such rate.
+func (s *MemStorage) GetPreviousRate(ctx context.Context, before time.Time, code string) (*StoredRate, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	day := before.Format("2006-01-02")
+	var found *rateRevision
+	for _, r := range s.current() {
+		if r.CharCode != code || r.Effective >= day {
+			continue
+		}
+		if found == nil || r.Effective > found.Effective ||
+			(r.Effective == found.Effective && r.Date > found.Date) {
+			found = r
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s before %s", errNoStoredRates, code, before.Format("02.01.2006"))
+	}
+
+	rate, err := found.storedRate()
+	if err != nil {
+		return nil, err
+	}
+	return &rate, nil
+}
+
+// Returns the exchange rates of the currency requested on the dates from 'from' to 'to'
+// inclusive, sorted by date.
+func (s *MemStorage) GetSeries(ctx context.Context, code string, from, to time.Time) ([]StoredRate, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	first, last := from.Format("2006-01-02"), to.Format("2006-01-02")
+	rates := []StoredRate{}
+	for _, r := range s.current() {
+		if r.CharCode != code || r.Date < first || r.Date > last {
+			continue
+		}
+		rate, err := r.storedRate()
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Date.Before(rates[j].Date) })
+
+	return rates, nil
+}
+
+// Returns the latest requested date. Returns 'errNoStoredRates' if there are no rates.
+func (s *MemStorage) LatestDate(ctx context.Context) (time.Time, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	latest := ""
+	for _, r := range s.current() {
+		if r.Date > latest {
+			latest = r.Date
+		}
+	}
+	if latest == "" {
+		return time.Time{}, errNoStoredRates
+	}
+	return parseDbDate(latest)
+}
+
+// Returns the requested dates, sorted.
+func (s *MemStorage) ListDates(ctx context.Context) ([]time.Time, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	found := map[string]bool{}
+	days := []string{}
+	for _, r := range s.current() {
+		if !found[r.Date] {
+			found[r.Date] = true
+			days = append(days, r.Date)
+		}
+	}
+	sort.Strings(days)
+
+	dates := make([]time.Time, len(days))
+	for i, day := range days {
+		dt, err := parseDbDate(day)
+		if err != nil {
+			return nil, err
+		}
+		dates[i] = dt
+	}
+	return dates, nil
+}
+
+// Returns the currencies sorted by code, names are taken from the latest rates.
+func (s *MemStorage) ListCurrencies(ctx context.Context) ([]CurrencyInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	latest := map[string]*rateRevision{}
+	for _, r := range s.current() {
+		if prev, ok := latest[r.CharCode]; !ok || r.Date > prev.Date {
+			latest[r.CharCode] = r
+		}
+	}
+
+	currencies := make([]CurrencyInfo, 0, len(latest))
+	for _, r := range latest {
+		currencies = append(currencies, CurrencyInfo{NumCode: r.NumCode, CharCode: r.CharCode, Name: r.Name})
+	}
+	sort.Slice(currencies, func(i, j int) bool { return currencies[i].CharCode < currencies[j].CharCode })
+
+	return currencies, nil
+}
+
+// Calls 'handle' for every archived fetch with an answer in the order they were made.
+func (s *MemStorage) ForEachFetch(ctx context.Context, handle func(*FetchRecord) error) error {
+	// the handler may write to the storage
+	s.Lock()
+	fetches := append([]FetchRecord(nil), s.fetches...)
+	s.Unlock()
+
+	for i := range fetches {
+		if fetches[i].Payload == nil {
+			continue
+		}
+		if err := handle(&fetches[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
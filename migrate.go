@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// the first version of the exchange rate table, it's replaced by the revisions
+	sqlCreateTable = `
+        CREATE TABLE IF NOT EXISTS cbr_exchange_rate(
+            rate_date TEXT NOT NULL,
+            effective_date TEXT NOT NULL,
+            num_code INTEGER NOT NULL,
+            currency_name TEXT NOT NULL,
+            char_code TEXT NOT NULL,
+            denomination INTEGER NOT NULL,
+            rate_value TEXT NOT NULL,
+            PRIMARY KEY(rate_date, num_code)
+        );`
+
+	// the first version of the currency catalog, it's replaced by the currency table
+	sqlCreateCatalogTable = `
+        CREATE TABLE IF NOT EXISTS cbr_currency_catalog(
+            id TEXT NOT NULL PRIMARY KEY,
+            num_code INTEGER NOT NULL,
+            char_code TEXT NOT NULL,
+            currency_name TEXT NOT NULL,
+            updated_at TEXT NOT NULL
+        );`
+
+	sqlCreateVersionTable = `
+        CREATE TABLE IF NOT EXISTS schema_version(
+            version INTEGER NOT NULL PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_at TEXT NOT NULL
+        );`
+
+	sqlSelectVersionTableCount = `
+        SELECT COUNT(*)
+            FROM sqlite_master
+            WHERE type = 'table'
+                AND name = 'schema_version';`
+
+	sqlSelectVersions = `
+        SELECT version, name, applied_at
+            FROM schema_version
+            ORDER BY version;`
+
+	sqlSelectVersionCount = `
+        SELECT COUNT(*)
+            FROM schema_version
+            WHERE version = ?;`
+
+	sqlInsertVersion = `
+        INSERT INTO schema_version
+            (version, name, applied_at)
+            VALUES(?, ?, ?);`
+
+	// databases created before the effective date was stored get it equal to the requested one
+	sqlAddEffectiveDate = `
+        ALTER TABLE cbr_exchange_rate
+            ADD COLUMN effective_date TEXT NOT NULL DEFAULT '';`
+
+	sqlFillEffectiveDate = `
+        UPDATE cbr_exchange_rate
+            SET effective_date = rate_date
+            WHERE effective_date = '';`
+
+	// the currencies of the stored rates not listed in the cached catalog, with the latest names
+	sqlSelectUnknownCurrencies = `
+        SELECT num_code, char_code, currency_name
+            FROM cbr_exchange_rate_revision r
+            WHERE id = (
+                SELECT MAX(id)
+                    FROM cbr_exchange_rate_revision
+                    WHERE num_code = r.num_code
+                        AND char_code = r.char_code)
+                AND NOT EXISTS (
+                    SELECT 1
+                        FROM currencies
+                        WHERE num_code = r.num_code
+                            AND char_code = r.char_code);`
+
+	sqlInsertCurrency = `
+        INSERT INTO currencies
+            (id, num_code, char_code, name, rus_name)
+            VALUES(?, ?, ?, ?, ?)
+            ON CONFLICT(id) DO NOTHING;`
+
+	sqlUpdateCurrencyRusName = `
+        UPDATE currencies
+            SET rus_name = ?
+            WHERE id = ?
+                AND rus_name = '';`
+
+	sqlSelectColumnCount = `
+        SELECT COUNT(*)
+            FROM pragma_table_info(?)
+            WHERE name = ?;`
+
+	sqlSelectColumnTypeCount = `
+        SELECT COUNT(*)
+            FROM pragma_table_info(?)
+            WHERE name = ?
+                AND UPPER(type) = ?;`
+)
+
+// Rate values of the databases created before they were stored exactly are converted
+// from FLOAT, CBR publishes them with 4 decimal places.
+var sqlConvertRateValue = []string{
+	`ALTER TABLE cbr_exchange_rate RENAME TO cbr_exchange_rate_float;`,
+	sqlCreateTable,
+	`INSERT INTO cbr_exchange_rate
+            (rate_date, effective_date, num_code, currency_name, char_code, denomination, rate_value)
+            SELECT rate_date, effective_date, num_code, currency_name, char_code, denomination,
+                    RTRIM(RTRIM(PRINTF('%.4f', rate_value), '0'), '.')
+                FROM cbr_exchange_rate_float;`,
+	`DROP TABLE cbr_exchange_rate_float;`,
+}
+
+// Rates are kept as revisions, which are never changed or deleted. The rates stored
+// before get no fetch and record times, they are treated as known at any time.
+var sqlCreateRevisions = []string{
+	`CREATE TABLE cbr_exchange_rate_revision(
+            id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+            rate_date TEXT NOT NULL,
+            effective_date TEXT NOT NULL,
+            num_code INTEGER NOT NULL,
+            currency_name TEXT NOT NULL,
+            char_code TEXT NOT NULL,
+            denomination INTEGER NOT NULL,
+            rate_value TEXT NOT NULL,
+            fetched_at TEXT NOT NULL,
+            recorded_at TEXT NOT NULL,
+            source TEXT NOT NULL
+        );`,
+	`CREATE INDEX cbr_exchange_rate_revision_key
+            ON cbr_exchange_rate_revision(rate_date, num_code, id);`,
+	`CREATE TRIGGER cbr_exchange_rate_revision_no_update
+            BEFORE UPDATE ON cbr_exchange_rate_revision
+            BEGIN
+                SELECT RAISE(ABORT, 'exchange rate revisions can''t be changed');
+            END;`,
+	`CREATE TRIGGER cbr_exchange_rate_revision_no_delete
+            BEFORE DELETE ON cbr_exchange_rate_revision
+            BEGIN
+                SELECT RAISE(ABORT, 'exchange rate revisions can''t be deleted');
+            END;`,
+	`INSERT INTO cbr_exchange_rate_revision
+            (rate_date, effective_date, num_code, currency_name, char_code, denomination, rate_value,
+                fetched_at, recorded_at, source)
+            SELECT rate_date, effective_date, num_code, currency_name, char_code, denomination, rate_value,
+                    '', '', ''
+                FROM cbr_exchange_rate
+                ORDER BY rowid;`,
+	`DROP TABLE cbr_exchange_rate;`,
+	// the current rates are the latest revisions
+	`CREATE VIEW cbr_exchange_rate AS
+            SELECT id AS revision_id, rate_date, effective_date, num_code, currency_name, char_code,
+                    denomination, rate_value, fetched_at, recorded_at, source
+                FROM cbr_exchange_rate_revision r
+                WHERE id = (
+                    SELECT MAX(id)
+                        FROM cbr_exchange_rate_revision
+                        WHERE rate_date = r.rate_date
+                            AND num_code = r.num_code);`,
+}
+
+// Requests to the server are archived with their compressed answers, every revision
+// of a rate is linked to the fetch it was decoded from.
+var sqlCreateFetches = []string{
+	`CREATE TABLE cbr_fetch(
+            id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+            url TEXT NOT NULL,
+            query_dates TEXT NOT NULL,
+            currencies TEXT NOT NULL,
+            status INTEGER NOT NULL,
+            error TEXT NOT NULL,
+            started_at TEXT NOT NULL,
+            duration_ms INTEGER NOT NULL,
+            from_cache INTEGER NOT NULL,
+            size INTEGER NOT NULL,
+            sha256 TEXT NOT NULL,
+            payload BLOB
+        );`,
+	`CREATE INDEX cbr_fetch_url ON cbr_fetch(url, sha256);`,
+	`ALTER TABLE cbr_exchange_rate_revision
+            ADD COLUMN fetch_id INTEGER REFERENCES cbr_fetch(id);`,
+	`DROP VIEW cbr_exchange_rate;`,
+	`CREATE VIEW cbr_exchange_rate AS
+            SELECT id AS revision_id, rate_date, effective_date, num_code, currency_name, char_code,
+                    denomination, rate_value, fetched_at, recorded_at, source, fetch_id
+                FROM cbr_exchange_rate_revision r
+                WHERE id = (
+                    SELECT MAX(id)
+                        FROM cbr_exchange_rate_revision
+                        WHERE rate_date = r.rate_date
+                            AND num_code = r.num_code);`,
+}
+
+// Currencies are kept once in the currency table keyed by the CBR code, the rates refer
+// to them. The views keep the shape of the tables they replace.
+var sqlCreateCurrencies = []string{
+	`CREATE TABLE currencies(
+            id TEXT NOT NULL PRIMARY KEY,
+            num_code INTEGER NOT NULL,
+            char_code TEXT NOT NULL,
+            name TEXT NOT NULL,
+            rus_name TEXT NOT NULL DEFAULT '',
+            valid_from TEXT,
+            valid_to TEXT,
+            catalog_updated_at TEXT
+        );`,
+	`CREATE INDEX currencies_code ON currencies(char_code, num_code);`,
+	`INSERT INTO currencies
+            (id, num_code, char_code, name, catalog_updated_at)
+            SELECT id, num_code, char_code, currency_name, updated_at
+                FROM cbr_currency_catalog
+                WHERE id <> '';`,
+}
+
+var sqlCreateRates = []string{
+	`CREATE TABLE rates(
+            id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+            rate_date TEXT NOT NULL,
+            effective_date TEXT NOT NULL,
+            currency_id TEXT NOT NULL REFERENCES currencies(id),
+            denomination INTEGER NOT NULL,
+            rate_value TEXT NOT NULL,
+            fetched_at TEXT NOT NULL,
+            recorded_at TEXT NOT NULL,
+            source TEXT NOT NULL,
+            fetch_id INTEGER REFERENCES cbr_fetch(id)
+        );`,
+	`CREATE INDEX rates_key ON rates(rate_date, currency_id, id);`,
+	`CREATE INDEX rates_currency ON rates(currency_id, rate_date);`,
+	`CREATE TRIGGER rates_no_update
+            BEFORE UPDATE ON rates
+            BEGIN
+                SELECT RAISE(ABORT, 'exchange rate revisions can''t be changed');
+            END;`,
+	`CREATE TRIGGER rates_no_delete
+            BEFORE DELETE ON rates
+            BEGIN
+                SELECT RAISE(ABORT, 'exchange rate revisions can''t be deleted');
+            END;`,
+	// the revisions keep their identifiers
+	`INSERT INTO rates
+            (id, rate_date, effective_date, currency_id, denomination, rate_value,
+                fetched_at, recorded_at, source, fetch_id)
+            SELECT id, rate_date, effective_date,
+                    (SELECT id
+                        FROM currencies
+                        WHERE num_code = r.num_code
+                            AND char_code = r.char_code),
+                    denomination, rate_value, fetched_at, recorded_at, source, fetch_id
+                FROM cbr_exchange_rate_revision r
+                ORDER BY id;`,
+	`UPDATE currencies
+            SET valid_from = (SELECT MIN(effective_date) FROM rates WHERE currency_id = currencies.id),
+                valid_to = (SELECT MAX(effective_date) FROM rates WHERE currency_id = currencies.id);`,
+	`DROP VIEW cbr_exchange_rate;`,
+	`DROP TABLE cbr_exchange_rate_revision;`,
+	`DROP TABLE cbr_currency_catalog;`,
+	`CREATE VIEW cbr_exchange_rate_revision AS
+            SELECT r.id, r.rate_date, r.effective_date, c.num_code, c.name AS currency_name, c.char_code,
+                    r.denomination, r.rate_value, r.fetched_at, r.recorded_at, r.source, r.fetch_id,
+                    r.currency_id
+                FROM rates r
+                    JOIN currencies c ON c.id = r.currency_id;`,
+	// the current rates are the latest revisions
+	`CREATE VIEW cbr_exchange_rate AS
+            SELECT id AS revision_id, rate_date, effective_date, num_code, currency_name, char_code,
+                    denomination, rate_value, fetched_at, recorded_at, source, fetch_id, currency_id
+                FROM cbr_exchange_rate_revision r
+                WHERE id = (
+                    SELECT MAX(id)
+                        FROM rates
+                        WHERE rate_date = r.rate_date
+                            AND currency_id = r.currency_id);`,
+	`CREATE VIEW cbr_currency_catalog AS
+            SELECT id, num_code, char_code, name AS currency_name, catalog_updated_at AS updated_at
+                FROM currencies
+                WHERE catalog_updated_at IS NOT NULL;`,
+}
+
+// The rates are kept once by the date they are published for, the requested dates refer
+// to them. A date without its own rates, a weekend or a holiday, no longer copies the last
+// ones. The mappings of the requested dates are append-only like the revisions of rates,
+// the current one is the latest. The views keep their shape.
+var sqlStoreRatesByEffectiveDate = []string{
+	`DROP VIEW cbr_exchange_rate;`,
+	`DROP VIEW cbr_exchange_rate_revision;`,
+	`CREATE TABLE rate_dates(
+            id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+            rate_date TEXT NOT NULL,
+            currency_id TEXT NOT NULL REFERENCES currencies(id),
+            effective_date TEXT NOT NULL,
+            recorded_at TEXT NOT NULL
+        );`,
+	`CREATE INDEX rate_dates_key ON rate_dates(rate_date, currency_id, id);`,
+	`CREATE TRIGGER rate_dates_no_update
+            BEFORE UPDATE ON rate_dates
+            BEGIN
+                SELECT RAISE(ABORT, 'requested dates can''t be changed');
+            END;`,
+	`CREATE TRIGGER rate_dates_no_delete
+            BEFORE DELETE ON rate_dates
+            BEGIN
+                SELECT RAISE(ABORT, 'requested dates can''t be deleted');
+            END;`,
+	// a requested date gets a mapping for every change of its effective date
+	`INSERT INTO rate_dates
+            (rate_date, currency_id, effective_date, recorded_at)
+            SELECT rate_date, currency_id, effective_date, recorded_at
+                FROM (
+                    SELECT id, rate_date, currency_id, effective_date, recorded_at,
+                            LAG(effective_date) OVER (
+                                PARTITION BY rate_date, currency_id ORDER BY id) AS previous
+                        FROM rates)
+                WHERE previous IS NULL
+                    OR previous <> effective_date
+                ORDER BY id;`,
+	`ALTER TABLE rates RENAME TO rates_v7;`,
+	`CREATE TABLE rates(
+            id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+            effective_date TEXT NOT NULL,
+            currency_id TEXT NOT NULL REFERENCES currencies(id),
+            denomination INTEGER NOT NULL,
+            rate_value TEXT NOT NULL,
+            fetched_at TEXT NOT NULL,
+            recorded_at TEXT NOT NULL,
+            source TEXT NOT NULL,
+            fetch_id INTEGER REFERENCES cbr_fetch(id)
+        );`,
+	// the copies of the same rate made for other requested dates are dropped,
+	// the revisions keep their identifiers
+	`INSERT INTO rates
+            (id, effective_date, currency_id, denomination, rate_value,
+                fetched_at, recorded_at, source, fetch_id)
+            SELECT id, effective_date, currency_id, denomination, rate_value,
+                    fetched_at, recorded_at, source, fetch_id
+                FROM (
+                    SELECT *,
+                            LAG(denomination) OVER key AS previous_denomination,
+                            LAG(rate_value) OVER key AS previous_value
+                        FROM rates_v7
+                        WINDOW key AS (PARTITION BY effective_date, currency_id ORDER BY id))
+                WHERE previous_value IS NULL
+                    OR previous_denomination <> denomination
+                    OR previous_value <> rate_value
+                ORDER BY id;`,
+	`DROP TABLE rates_v7;`,
+	`CREATE INDEX rates_key ON rates(effective_date, currency_id, id);`,
+	`CREATE INDEX rates_currency ON rates(currency_id, effective_date);`,
+	`CREATE TRIGGER rates_no_update
+            BEFORE UPDATE ON rates
+            BEGIN
+                SELECT RAISE(ABORT, 'exchange rate revisions can''t be changed');
+            END;`,
+	`CREATE TRIGGER rates_no_delete
+            BEFORE DELETE ON rates
+            BEGIN
+                SELECT RAISE(ABORT, 'exchange rate revisions can''t be deleted');
+            END;`,
+	// the revisions of the rates published for the date the requested date refers to now
+	`CREATE VIEW cbr_exchange_rate_revision AS
+            SELECT r.id, d.rate_date, r.effective_date, c.num_code, c.name AS currency_name, c.char_code,
+                    r.denomination, r.rate_value, r.fetched_at, r.recorded_at, r.source, r.fetch_id,
+                    r.currency_id
+                FROM rate_dates d
+                    JOIN rates r ON r.effective_date = d.effective_date
+                        AND r.currency_id = d.currency_id
+                    JOIN currencies c ON c.id = r.currency_id
+                WHERE d.id = (
+                    SELECT MAX(id)
+                        FROM rate_dates
+                        WHERE rate_date = d.rate_date
+                            AND currency_id = d.currency_id);`,
+	`CREATE VIEW cbr_exchange_rate AS
+            SELECT id AS revision_id, rate_date, effective_date, num_code, currency_name, char_code,
+                    denomination, rate_value, fetched_at, recorded_at, source, fetch_id, currency_id
+                FROM cbr_exchange_rate_revision r
+                WHERE id = (
+                    SELECT MAX(id)
+                        FROM rates
+                        WHERE effective_date = r.effective_date
+                            AND currency_id = r.currency_id);`,
+}
+
+// Step of the database schema migration. Steps are applied in the order of versions,
+// each one in its own transaction. The databases created before the versions were
+// recorded may already have a step done, so the steps check the schema before changing it.
+type dbMigration struct {
+	version int
+	name    string
+	apply   func(ctx context.Context, tx *sql.Tx) error
+}
+
+// The migration steps. New steps are appended, applied steps must never change.
+var dbMigrations = []dbMigration{
+	{1, "create the exchange rate table", execMigration(sqlCreateTable)},
+	{2, "add the effective date", addEffectiveDate},
+	{3, "create the currency catalog table", execMigration(sqlCreateCatalogTable)},
+	{4, "store rate values as text", convertRateValue},
+	{5, "keep the revisions of rates", execMigration(sqlCreateRevisions...)},
+	{6, "archive fetches", execMigration(sqlCreateFetches...)},
+	{7, "normalize currencies and rates", normalizeRates},
+	{8, "store rates by the effective date", execMigration(sqlStoreRatesByEffectiveDate...)},
+}
+
+// State of a migration step in the database.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time // zero if the step isn't applied
+}
+
+// Returns the schema version the program works with.
+func latestSchemaVersion() int {
+	return dbMigrations[len(dbMigrations)-1].version
+}
+
+// Applies the pending migration steps. Returns the number of applied steps.
+func (s *DbStorage) Migrate(ctx context.Context) (int, error) {
+	if _, err := s.ExecQuery(ctx, sqlCreateVersionTable); err != nil {
+		return 0, fmt.Errorf("failed to create the version table: %v", err)
+	}
+
+	version, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if version > latestSchemaVersion() {
+		return 0, fmt.Errorf("the database schema version %d is newer than the supported version %d",
+			version, latestSchemaVersion())
+	}
+
+	applied := 0
+	for _, m := range dbMigrations {
+		if m.version <= version {
+			continue
+		}
+		done, err := s.migrate(ctx, m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		if done {
+			logger.Info(fmt.Sprintf("database %q migrated to version %d: %s", s.name, m.version, m.name))
+			applied++
+		}
+	}
+
+	return applied, nil
+}
+
+// Applies the migration step unless another process has done it meanwhile.
+func (s *DbStorage) migrate(ctx context.Context, m dbMigration) (bool, error) {
+	var (
+		db    *sql.DB
+		tx    *sql.Tx
+		count int
+		err   error
+	)
+
+	if db, err = s.conn(); err != nil {
+		return false, err
+	}
+
+	if tx, err = db.BeginTx(ctx, nil); err != nil {
+		return false, fmt.Errorf("failed to begin a transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err = tx.QueryRowContext(ctx, sqlSelectVersionCount, m.version).Scan(&count); err != nil {
+		return false, fmt.Errorf("unable to get the value from the database: %v", err)
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	if err = m.apply(ctx, tx); err != nil {
+		return false, err
+	}
+	applied := time.Now().UTC().Format(time.RFC3339)
+	if _, err = tx.ExecContext(ctx, sqlInsertVersion, m.version, m.name, applied); err != nil {
+		return false, fmt.Errorf("failed to record the version: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit a transaction: %v", err)
+	}
+
+	return true, nil
+}
+
+// Returns the schema version of the database, zero if no migration step was applied.
+func (s *DbStorage) SchemaVersion(ctx context.Context) (int, error) {
+	status, err := s.SchemaStatus(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	version := 0
+	for _, m := range status {
+		if !m.AppliedAt.IsZero() {
+			version = m.Version
+		}
+	}
+	return version, nil
+}
+
+// Returns the state of every migration step known to the program or recorded
+// in the database, sorted by version. The database isn't changed.
+func (s *DbStorage) SchemaStatus(ctx context.Context) ([]MigrationStatus, error) {
+	count, err := s.SelectCount(ctx, sqlSelectVersionTableCount)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int]MigrationStatus{}
+	if count > 0 {
+		err = s.SelectRows(ctx, func(rows *sql.Rows) error {
+			var (
+				m  MigrationStatus
+				at string
+			)
+			if err := rows.Scan(&m.Version, &m.Name, &at); err != nil {
+				return err
+			}
+			if m.AppliedAt, err = time.Parse(time.RFC3339, at); err != nil {
+				return fmt.Errorf("incorrect time %q of version %d: %v", at, m.Version, err)
+			}
+			applied[m.Version] = m
+			return nil
+		}, sqlSelectVersions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	status := []MigrationStatus{}
+	for _, m := range dbMigrations {
+		status = append(status, MigrationStatus{Version: m.version, Name: m.name, AppliedAt: applied[m.version].AppliedAt})
+		delete(applied, m.version)
+	}
+	// versions applied by a newer program
+	for _, m := range applied {
+		status = append(status, m)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+
+	return status, nil
+}
+
+// Returns the migration step executing the queries.
+func execMigration(queries ...string) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		for _, q := range queries {
+			if _, err := tx.ExecContext(ctx, q); err != nil {
+				return fmt.Errorf("database query failed: %v", err)
+			}
+		}
+		return nil
+	}
+}
+
+func addEffectiveDate(ctx context.Context, tx *sql.Tx) error {
+	count, err := selectTxCount(ctx, tx, sqlSelectColumnCount, "cbr_exchange_rate", "effective_date")
+	if err != nil || count > 0 {
+		return err
+	}
+	return execMigration(sqlAddEffectiveDate, sqlFillEffectiveDate)(ctx, tx)
+}
+
+func convertRateValue(ctx context.Context, tx *sql.Tx) error {
+	count, err := selectTxCount(ctx, tx, sqlSelectColumnTypeCount, "cbr_exchange_rate", "rate_value", "TEXT")
+	if err != nil || count > 0 {
+		return err
+	}
+	return execMigration(sqlConvertRateValue...)(ctx, tx)
+}
+
+func normalizeRates(ctx context.Context, tx *sql.Tx) error {
+	if err := execMigration(sqlCreateCurrencies...)(ctx, tx); err != nil {
+		return err
+	}
+
+	// the currencies missing in the catalog get their CBR codes from the built-in list
+	// when the codes match, or keys made of the codes
+	unknown := []Currency{}
+	rows, err := tx.QueryContext(ctx, sqlSelectUnknownCurrencies)
+	if err != nil {
+		return fmt.Errorf("database query failed: %v", err)
+	}
+	for rows.Next() {
+		var c Currency
+		if err = rows.Scan(&c.NumCode, &c.CharCode, &c.Name); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read the currencies: %v", err)
+		}
+		unknown = append(unknown, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to read the currencies: %v", err)
+	}
+
+	builtin := newBuiltinCatalog()
+	for _, c := range unknown {
+		var res sql.Result
+		if info, ok := builtin.Lookup(c.CharCode); ok && info.NumCode == c.NumCode {
+			if res, err = tx.ExecContext(ctx, sqlInsertCurrency, info.ID, c.NumCode, c.CharCode, c.Name, info.RusName); err != nil {
+				return fmt.Errorf("failed to insert a currency %q: %v", c.CharCode, err)
+			}
+			if count, _ := res.RowsAffected(); count > 0 {
+				continue
+			}
+		}
+		id := codeCurrencyID(c.NumCode, c.CharCode)
+		if _, err = tx.ExecContext(ctx, sqlInsertCurrency, id, c.NumCode, c.CharCode, c.Name, ""); err != nil {
+			return fmt.Errorf("failed to insert a currency %q: %v", c.CharCode, err)
+		}
+	}
+	for _, info := range builtin.Items() {
+		if _, err = tx.ExecContext(ctx, sqlUpdateCurrencyRusName, info.RusName, info.ID); err != nil {
+			return fmt.Errorf("failed to update a currency %q: %v", info.CharCode, err)
+		}
+	}
+
+	return execMigration(sqlCreateRates...)(ctx, tx)
+}
+
+func selectTxCount(ctx context.Context, tx *sql.Tx, query string, params ...any) (int, error) {
+	var count int
+	if err := tx.QueryRowContext(ctx, query, params...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("unable to get the value from the database: %v", err)
+	}
+	return count, nil
+}
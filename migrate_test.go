@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDbStorageMigrate(t *testing.T) {
+	const name = "test_migrate.db"
+	defer removeDbFiles(name)
+
+	ctx := context.Background()
+	storage := newDbStorage(name)
+	defer storage.Close()
+
+	version, err := storage.SchemaVersion(ctx)
+	if err != nil || version != 0 {
+		t.Fatalf("expected version 0 got %d: %v", version, err)
+	}
+
+	count, err := storage.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	if count != len(dbMigrations) {
+		t.Fatalf("expected %d got %d", len(dbMigrations), count)
+	}
+	if count, err = storage.Migrate(ctx); err != nil || count != 0 {
+		t.Fatalf("expected 0 got %d: %v", count, err)
+	}
+
+	status, err := storage.SchemaStatus(ctx)
+	if err != nil {
+		t.Fatalf("failed to read the status: %v", err)
+	}
+	if len(status) != len(dbMigrations) {
+		t.Fatalf("expected %d got %d", len(dbMigrations), len(status))
+	}
+	for _, m := range status {
+		if m.AppliedAt.IsZero() {
+			t.Fatalf("expected version %d applied", m.Version)
+		}
+	}
+
+	// a database migrated by a newer program isn't changed
+	_, err = storage.ExecQuery(ctx, sqlInsertVersion, latestSchemaVersion()+1, "future", "2030-01-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("failed to insert data: %v", err)
+	}
+	if err = storage.Init(ctx); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+	if status, err = storage.SchemaStatus(ctx); err != nil || status[len(status)-1].Name != "future" {
+		t.Fatalf("expected the future version got %v: %v", status, err)
+	}
+}
+
+func TestDbStorageNormalizeRates(t *testing.T) {
+	const name = "test_normalize.db"
+	defer removeDbFiles(name)
+
+	ctx := context.Background()
+	storage := newDbStorage(name)
+	defer storage.Close()
+
+	// a database of the version before the currency table
+	if _, err := storage.ExecQuery(ctx, sqlCreateVersionTable); err != nil {
+		t.Fatalf("failed to create the version table: %v", err)
+	}
+	for _, m := range dbMigrations {
+		if m.version >= 7 {
+			break
+		}
+		if _, err := storage.migrate(ctx, m); err != nil {
+			t.Fatalf("migration %d failed: %v", m.version, err)
+		}
+	}
+	err := storage.ExecQueries(ctx,
+		`INSERT INTO cbr_currency_catalog VALUES('R01235', 840, 'USD', 'US Dollar', '2023-03-01T00:00:00Z');`,
+		`INSERT INTO cbr_exchange_rate_revision
+            (rate_date, effective_date, num_code, currency_name, char_code, denomination, rate_value,
+                fetched_at, recorded_at, source)
+            VALUES('2023-03-10', '2023-03-10', 840, 'US Dollar', 'USD', 1, '75.5', '', '', ''),
+                ('2023-03-10', '2023-03-10', 978, 'Euro', 'EUR', 1, '79.9', '', '', ''),
+                ('2023-03-10', '2023-03-10', 999, 'Test', 'XTS', 1, '1', '', '', ''),
+                ('2023-03-11', '2023-03-10', 840, 'US Dollar', 'USD', 1, '75.5', '', '', ''),
+                ('2023-03-10', '2023-03-10', 840, 'US Dollar', 'USD', 1, '75.6', '', '', '');`,
+	)
+	if err != nil {
+		t.Fatalf("failed to insert data: %v", err)
+	}
+
+	if err = storage.Init(ctx); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	// the copy of the rate requested on 11.03 is dropped, the date refers to the rate of 10.03
+	queries := map[string]int{
+		`SELECT COUNT(*) FROM rates;`:      4,
+		`SELECT MAX(id) FROM rates;`:       5,
+		`SELECT COUNT(*) FROM rate_dates;`: 4,
+		`SELECT COUNT(*) FROM currencies;`: 3,
+		`SELECT COUNT(*) FROM currencies
+            WHERE id = 'R01235' AND valid_from = '2023-03-10' AND catalog_updated_at IS NOT NULL;`: 1,
+		`SELECT COUNT(*) FROM currencies WHERE id = 'R01239' AND rus_name = 'Евро';`:   1,
+		`SELECT COUNT(*) FROM currencies WHERE id = 'ISO:999:XTS';`:                    1,
+		`SELECT COUNT(*) FROM cbr_currency_catalog WHERE currency_name = 'US Dollar';`: 1,
+		`SELECT COUNT(*) FROM cbr_exchange_rate;`:                                      4,
+		`SELECT COUNT(*) FROM cbr_exchange_rate_revision;`:                             6,
+		`SELECT COUNT(*) FROM cbr_exchange_rate
+            WHERE char_code = 'USD' AND effective_date = '2023-03-10' AND rate_value = '75.6';`: 2,
+	}
+	for query, expected := range queries {
+		count, err := storage.SelectCount(ctx, query)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if count != expected {
+			t.Fatalf("%s: expected %d got %d", query, expected, count)
+		}
+	}
+}
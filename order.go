@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Keys of the order of the records within a date.
+const (
+	sortPublished = ""       // as the server sent them
+	sortCode      = "code"   // by the letter code
+	sortNumCode   = "num"    // by the numeric code
+	sortValue     = "value"  // by the value of one unit
+	sortChange    = "change" // by the change of the value of one unit since the previous date
+)
+
+// Order of the records within a date.
+type RecordOrder struct {
+	key        string
+	descending bool
+}
+
+// Parses the order as a key with an optional '-' prefix for the descending order.
+func parseRecordOrder(s string) (RecordOrder, error) {
+	key := strings.ToLower(strings.TrimSpace(s))
+	order := RecordOrder{}
+	if strings.HasPrefix(key, "-") {
+		order.descending = true
+		key = key[1:]
+	}
+	switch key {
+	case sortCode, sortNumCode, sortValue, sortChange:
+		order.key = key
+		return order, nil
+	case sortPublished:
+		if !order.descending {
+			return order, nil
+		}
+	}
+	return order, fmt.Errorf("unknown sort order %q, the supported ones are %s", s, strings.Join(sortOrders(), ", "))
+}
+
+// Returns the keys of the orders.
+func sortOrders() []string {
+	return []string{sortCode, sortNumCode, sortValue, sortChange}
+}
+
+// Sorts the records. The change is counted from the values of one unit on the previous
+// date by the letter code, the records without it go last in any direction.
+func (o RecordOrder) sort(records []RateRecord, previous map[string]Decimal) {
+	if o.key == sortPublished {
+		return
+	}
+
+	// the changes which can't be counted are treated as unknown
+	changes := map[string]Decimal{}
+	if o.key == sortChange {
+		for _, r := range records {
+			if p, ok := previous[r.CharCode]; ok {
+				if change, err := r.UnitValue.Sub(p); err == nil {
+					changes[r.CharCode] = change
+				}
+			}
+		}
+	}
+
+	less := func(a, b RateRecord) bool { return false }
+	switch o.key {
+	case sortCode:
+		less = func(a, b RateRecord) bool { return a.CharCode < b.CharCode }
+	case sortNumCode:
+		less = func(a, b RateRecord) bool { return a.NumCode < b.NumCode }
+	case sortValue:
+		less = func(a, b RateRecord) bool { return a.UnitValue.Cmp(b.UnitValue) < 0 }
+	case sortChange:
+		less = func(a, b RateRecord) bool { return changes[a.CharCode].Cmp(changes[b.CharCode]) < 0 }
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if o.key == sortChange {
+			_, aok := changes[a.CharCode]
+			_, bok := changes[b.CharCode]
+			if aok != bok {
+				return aok
+			}
+			if !aok {
+				return false
+			}
+		}
+		if o.descending {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+}
+
+// Output of a requested date kept until the dates before it are written.
+type pendingDay struct {
+	date      time.Time
+	pending   int                  // the queries answering the date which aren't handled yet
+	messages  []string             // the messages about the queries of the date
+	effective time.Time            // the date the rates were published for
+	records   map[int][]RateRecord // the records by the index of the query
+	written   bool
+}
+
+// 'OutputSequence' arranges the output of the queries by the requested dates, so that it
+// doesn't depend on the order in which the queries are handled. A date is ready when all
+// the queries answering it are handled and all the dates before it are ready.
+type OutputSequence struct {
+	days    []*pendingDay // in the order of the dates
+	byDate  map[string]*pendingDay
+	queries map[RateQuery]int // the index of the query in the plan
+	next    int               // the first day which isn't written
+}
+
+// Creates an 'OutputSequence' instance of the dates requested by the queries.
+func newOutputSequence(queries []RateQuery) *OutputSequence {
+	s := &OutputSequence{byDate: map[string]*pendingDay{}, queries: map[RateQuery]int{}}
+	for i, q := range queries {
+		s.queries[q] = i
+		for _, d := range q.Dates() {
+			key := d.Format("2006-01-02")
+			day, ok := s.byDate[key]
+			if !ok {
+				day = &pendingDay{date: d, records: map[int][]RateRecord{}}
+				s.byDate[key] = day
+				s.days = append(s.days, day)
+			}
+			day.pending++
+		}
+	}
+	sort.SliceStable(s.days, func(i, j int) bool { return s.days[i].date.Before(s.days[j].date) })
+	return s
+}
+
+// Returns the pending day of the date, nil if it isn't requested or is already written.
+func (s *OutputSequence) day(date time.Time) *pendingDay {
+	day, ok := s.byDate[date.Format("2006-01-02")]
+	if !ok || day.written {
+		return nil
+	}
+	return day
+}
+
+// Adds the records of a date answered by the query. Returns false if the date isn't
+// pending, then the records should be written at once.
+func (s *OutputSequence) add(query RateQuery, day *RateDay) bool {
+	pending := s.day(day.Date.Time)
+	if pending == nil {
+		return false
+	}
+	if pending.effective.IsZero() || day.Effective.Before(pending.effective) {
+		pending.effective = day.Effective.Time
+	}
+	i := s.queries[query]
+	pending.records[i] = append(pending.records[i], day.Records...)
+	return true
+}
+
+// Adds a message about the query before the rates of its first pending date. Returns false
+// if there is no such date, then the message should be written at once.
+func (s *OutputSequence) report(query RateQuery, msg string) bool {
+	for _, d := range s.days[s.next:] {
+		if s.queryDay(query, d) {
+			d.messages = append(d.messages, msg)
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the query answers the pending day.
+func (s *OutputSequence) queryDay(query RateQuery, day *pendingDay) bool {
+	for _, d := range query.Dates() {
+		if sameDate(d, day.date) {
+			return true
+		}
+	}
+	return false
+}
+
+// Marks the query handled.
+func (s *OutputSequence) done(query RateQuery) {
+	for _, d := range query.Dates() {
+		if day := s.day(d); day != nil && day.pending > 0 {
+			day.pending--
+		}
+	}
+}
+
+// Removes the ready days from the sequence and returns them, all the days if 'all' is set.
+func (s *OutputSequence) ready(all bool) []*pendingDay {
+	start := s.next
+	for s.next < len(s.days) && (all || s.days[s.next].pending == 0) {
+		s.days[s.next].written = true
+		s.next++
+	}
+	return s.days[start:s.next]
+}
+
+// Returns the rates of the pending day with the records merged in the order of the queries.
+func (d *pendingDay) rateDay() *RateDay {
+	indexes := make([]int, 0, len(d.records))
+	for i := range d.records {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	day := &RateDay{Date: RateDate{d.date}, Effective: RateDate{d.effective}, Records: []RateRecord{}}
+	for _, i := range indexes {
+		day.Records = append(day.Records, d.records[i]...)
+	}
+	return day
+}
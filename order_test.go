@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseRecordOrder(t *testing.T) {
+	tests := map[string]RecordOrder{
+		"":        {},
+		"code":    {key: sortCode},
+		" Num ":   {key: sortNumCode},
+		"-value":  {key: sortValue, descending: true},
+		"-change": {key: sortChange, descending: true},
+	}
+	for s, expected := range tests {
+		order, err := parseRecordOrder(s)
+		if err != nil || order != expected {
+			t.Fatalf("%q: expected %v got %v: %v", s, expected, order, err)
+		}
+	}
+
+	for _, s := range []string{"-", "name", "--code"} {
+		if _, err := parseRecordOrder(s); err == nil {
+			t.Fatalf("%q: expected an error got nil", s)
+		}
+	}
+}
+
+func TestRecordOrderSort(t *testing.T) {
+	records := []RateRecord{
+		{CharCode: "USD", NumCode: 840, UnitValue: mustParseDecimal("75.5")},
+		{CharCode: "JPY", NumCode: 392, UnitValue: mustParseDecimal("0.556")},
+		{CharCode: "EUR", NumCode: 978, UnitValue: mustParseDecimal("79.9")},
+		{CharCode: "XTS", NumCode: 963, UnitValue: mustParseDecimal("1")},
+	}
+	previous := map[string]Decimal{
+		"USD": mustParseDecimal("75"),
+		"JPY": mustParseDecimal("0.5"),
+		"EUR": mustParseDecimal("80.9"),
+	}
+
+	tests := map[string]string{
+		"":        "USD JPY EUR XTS",
+		"code":    "EUR JPY USD XTS",
+		"num":     "JPY USD XTS EUR",
+		"-value":  "EUR USD XTS JPY",
+		"change":  "EUR JPY USD XTS",
+		"-change": "USD JPY EUR XTS",
+	}
+	for s, expected := range tests {
+		order, _ := parseRecordOrder(s)
+		sorted := append([]RateRecord(nil), records...)
+		order.sort(sorted, previous)
+
+		codes := ""
+		for i, r := range sorted {
+			if i > 0 {
+				codes += " "
+			}
+			codes += r.CharCode
+		}
+		if codes != expected {
+			t.Fatalf("%q: expected %s got %s", s, expected, codes)
+		}
+	}
+}
+
+func TestResultPrinterSequence(t *testing.T) {
+	first, _ := parseDate("10.03.2023")
+	second, _ := parseDate("11.03.2023")
+	firstQuery, secondQuery := newExchRateQuery(), newExchRateQuery()
+	firstQuery.SetTime(first)
+	secondQuery.SetTime(second)
+	usd, _ := newBuiltinCatalog().Lookup("USD")
+	dynamicQuery := newDynamicQuery(usd, []time.Time{first, second})
+
+	dayRates := func(query *ExchRateQuery, code string, value string) *DayRates {
+		return &DayRates{Query: query, Effective: query.time, Currencies: Currencies{
+			{NumCode: 1, CharCode: code, Nominal: 1, Name: code, Value: mustParseDecimal(value)},
+		}}
+	}
+
+	var b bytes.Buffer
+	printer := &ResultPrinter{formatter: &csvFormatter{}, out: &b, msg: &b}
+	printer.setStream(true)
+	printer.expect([]RateQuery{firstQuery, secondQuery, dynamicQuery})
+	filter := newCurrencyFilter(newBuiltinCatalog())
+
+	// the results come in the reverse order
+	printer.print(secondQuery, dayRates(secondQuery, "JPY", "0.55"), filter)
+	printer.done(secondQuery)
+	printer.print(dynamicQuery, dayRates(firstQuery, "USD", "75"), filter)
+	printer.print(dynamicQuery, dayRates(secondQuery, "USD", "76"), filter)
+	printer.done(dynamicQuery)
+	if b.Len() > 0 {
+		t.Fatalf("expected nothing written got %q", b.String())
+	}
+
+	printer.report(firstQuery, "request failed\n")
+	printer.done(firstQuery)
+	expected := `request failed
+date,effective_date,num_code,char_code,name,nominal,value,unit_value
+2023-03-10,2023-03-10,1,USD,USD,1,75,75
+2023-03-11,2023-03-11,1,JPY,JPY,1,0.55,0.55
+2023-03-11,2023-03-11,1,USD,USD,1,76,76
+`
+	if b.String() != expected {
+		t.Fatalf("expected %q got %q", expected, b.String())
+	}
+
+	printer.finish()
+	if b.String() != expected {
+		t.Fatalf("expected %q got %q", expected, b.String())
+	}
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats of the exchange rates.
+const (
+	outputTable    = "table"
+	outputJSON     = "json"
+	outputJSONL    = "jsonl"
+	outputCSV      = "csv"
+	outputMarkdown = "markdown"
+	outputYAML     = "yaml"
+)
+
+// The number of digits after the decimal point of the value of one unit of a currency,
+// enough for the values CBR publishes for up to 10000 units.
+const unitValuePlaces = 8
+
+// The number of digits after the decimal point of the change in percent.
+const changePercentPlaces = 2
+
+// Date of the exchange rates, written as 'day.month.year' by templates.
+type RateDate struct {
+	time.Time
+}
+
+func (d RateDate) String() string {
+	return d.Format("02.01.2006")
+}
+
+// Exchange rate of one currency on a date.
+type RateRecord struct {
+	Date      RateDate // the requested date
+	Effective RateDate // the date the rate was published for
+	NumCode   int
+	CharCode  string
+	Name      string
+	Nominal   int
+	Value     Decimal     // the value of 'Nominal' units in rubles
+	UnitValue Decimal     // the value of one unit in rubles
+	Change    *RateChange // nil if the previous rate is unknown
+}
+
+// Change of the exchange rate since the previous publication.
+type RateChange struct {
+	Effective RateDate // the date the previous rate was published for
+	Value     Decimal  // the previous value of 'Nominal' units in rubles
+	Diff      Decimal  // the value minus the previous value
+	Percent   *Decimal // the difference in percent of the previous value, nil if it's zero
+}
+
+// Creates a 'RateChange' instance of the record since the previous rate. The previous value
+// is converted to the nominal of the record if the nominal has changed. Returns an error
+// if the change doesn't fit in 'Decimal'.
+func newRateChange(r RateRecord, previous StoredRate) (*RateChange, error) {
+	value := previous.Value
+	if previous.Nominal != r.Nominal && previous.Nominal > 0 {
+		total, err := value.Mul(newDecimalFromInt(int64(r.Nominal)))
+		if err != nil {
+			return nil, err
+		}
+		if value, err = total.Div(newDecimalFromInt(int64(previous.Nominal)), unitValuePlaces, RoundHalfEven); err != nil {
+			return nil, err
+		}
+	}
+
+	diff, err := r.Value.Sub(value)
+	if err != nil {
+		return nil, err
+	}
+	change := &RateChange{Effective: RateDate{previous.Effective}, Value: value, Diff: diff}
+	if !value.IsZero() {
+		hundreds, err := diff.Mul(newDecimalFromInt(100))
+		if err != nil {
+			return nil, err
+		}
+		percent, err := hundreds.Div(value, changePercentPlaces, RoundHalfEven)
+		if err != nil {
+			return nil, err
+		}
+		change.Percent = &percent
+	}
+	return change, nil
+}
+
+// Creates a 'RateRecord' instance of the currency rate on the date.
+func newRateRecord(rates *DayRates, c Currency) RateRecord {
+	r := RateRecord{
+		Date:      RateDate{rates.Query.LatestDate()},
+		Effective: RateDate{rates.Effective},
+		NumCode:   c.NumCode,
+		CharCode:  c.CharCode,
+		Name:      c.Name,
+		Nominal:   c.Nominal,
+		Value:     c.Value,
+		UnitValue: c.Value,
+	}
+	if c.Nominal > 1 {
+		// the quotient isn't greater than the value, so it always fits
+		r.UnitValue, _ = c.Value.Div(newDecimalFromInt(int64(c.Nominal)), unitValuePlaces, RoundHalfEven)
+	}
+	if previous, ok := rates.Previous[c.CharCode]; ok {
+		var err error
+		if r.Change, err = newRateChange(r, previous); err != nil {
+			logger.Warn(fmt.Sprintf("change of %s on %s wasn't counted: %v", c.CharCode, r.Date, err))
+		}
+	}
+	return r
+}
+
+// Returns the names and the values of the fields of the record in the output order,
+// with the fields of the change if it's set. Dates are formatted as 'YYYY-MM-DD', numbers
+// without trailing zeros, the fields of an unknown change are empty.
+func (r RateRecord) fields(change bool) ([]string, []string) {
+	names := []string{"date", "effective_date", "num_code", "char_code", "name", "nominal", "value", "unit_value"}
+	values := []string{
+		r.Date.Format("2006-01-02"),
+		r.Effective.Format("2006-01-02"),
+		strconv.Itoa(r.NumCode),
+		r.CharCode,
+		r.Name,
+		strconv.Itoa(r.Nominal),
+		r.Value.String(),
+		r.UnitValue.String(),
+	}
+	if !change {
+		return names, values
+	}
+
+	names = append(names, "previous_date", "previous_value", "change", "change_percent")
+	if r.Change == nil {
+		return names, append(values, "", "", "", "")
+	}
+	percent := ""
+	if r.Change.Percent != nil {
+		percent = r.Change.Percent.String()
+	}
+	return names, append(values,
+		r.Change.Effective.Format("2006-01-02"),
+		r.Change.Value.String(),
+		r.Change.Diff.String(),
+		percent,
+	)
+}
+
+// Writes the numbers as JSON numbers, so that they keep all their digits. The fields
+// of the change are written only if it's known.
+func (r RateRecord) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Date          string      `json:"date"`
+		Effective     string      `json:"effective_date"`
+		NumCode       int         `json:"num_code"`
+		CharCode      string      `json:"char_code"`
+		Name          string      `json:"name"`
+		Nominal       int         `json:"nominal"`
+		Value         json.Number `json:"value"`
+		UnitValue     json.Number `json:"unit_value"`
+		PreviousDate  string      `json:"previous_date,omitempty"`
+		PreviousValue json.Number `json:"previous_value,omitempty"`
+		Change        json.Number `json:"change,omitempty"`
+		ChangePercent json.Number `json:"change_percent,omitempty"`
+	}{
+		Date:      r.Date.Format("2006-01-02"),
+		Effective: r.Effective.Format("2006-01-02"),
+		NumCode:   r.NumCode,
+		CharCode:  r.CharCode,
+		Name:      r.Name,
+		Nominal:   r.Nominal,
+		Value:     json.Number(r.Value.String()),
+		UnitValue: json.Number(r.UnitValue.String()),
+	}
+	if r.Change != nil {
+		v.PreviousDate = r.Change.Effective.Format("2006-01-02")
+		v.PreviousValue = json.Number(r.Change.Value.String())
+		v.Change = json.Number(r.Change.Diff.String())
+		if r.Change.Percent != nil {
+			v.ChangePercent = json.Number(r.Change.Percent.String())
+		}
+	}
+	return json.Marshal(v)
+}
+
+// Exchange rates on one requested date.
+type RateDay struct {
+	Date      RateDate // the requested date
+	Effective RateDate // the date the rates were published for
+	Records   []RateRecord
+}
+
+// Creates a 'RateDay' instance of the rates of the currencies enabled in the filter.
+func newRateDay(rates *DayRates, filter *CurrencyFilter) *RateDay {
+	day := &RateDay{
+		Date:      RateDate{rates.Query.LatestDate()},
+		Effective: RateDate{rates.Effective},
+		Records:   []RateRecord{},
+	}
+	for _, c := range rates.Currencies {
+		if filter.IsEnabled() && filter.IsCurrencyDisabled(c.CharCode) {
+			continue
+		}
+		day.Records = append(day.Records, newRateRecord(rates, c))
+	}
+	return day
+}
+
+// 'Formatter' writes the exchange rates in an output format. 'Begin' is called once before
+// the first date, 'WriteDay' for every date, 'End' once after the last date.
+type Formatter interface {
+	Begin(w io.Writer) error
+	WriteDay(w io.Writer, day *RateDay) error
+	End(w io.Writer) error
+}
+
+// Returns the names of the output formats.
+func outputFormats() []string {
+	return []string{outputTable, outputJSON, outputJSONL, outputCSV, outputMarkdown, outputYAML}
+}
+
+// Creates the formatter of the output format, with the columns of the change if it's set.
+// The table marks the change with colors on a terminal.
+func newFormatter(format string, change bool) (Formatter, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case outputTable:
+		return &tableFormatter{change: change, color: change && isColorTerminal(os.Stdout)}, nil
+	case outputJSON:
+		return &jsonFormatter{}, nil
+	case outputJSONL:
+		return &jsonlFormatter{}, nil
+	case outputCSV:
+		return &csvFormatter{change: change}, nil
+	case outputMarkdown:
+		return &markdownFormatter{change: change}, nil
+	case outputYAML:
+		return &yamlFormatter{change: change}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q, the supported ones are %s",
+		format, strings.Join(outputFormats(), ", "))
+}
+
+// 'tableFormatter' writes the rates for reading: a header line for every date and a line
+// for every currency, with the previous value and the change marked up or down if it's set.
+type tableFormatter struct {
+	change bool
+	color  bool // color the marks of the change
+}
+
+func (f *tableFormatter) Begin(w io.Writer) error {
+	return nil
+}
+
+func (f *tableFormatter) WriteDay(w io.Writer, day *RateDay) error {
+	var b strings.Builder
+	if !day.Effective.IsZero() && !sameDate(day.Date.Time, day.Effective.Time) {
+		fmt.Fprintf(&b, "\nData on %s (rates of %s)\n", day.Date.Format("02.01.2006"),
+			day.Effective.Format("02.01.2006"))
+	} else {
+		fmt.Fprintf(&b, "\nData on %s\n", day.Date.Format("02.01.2006"))
+	}
+	for _, r := range day.Records {
+		fmt.Fprintf(&b, "%8d %s\t%10s RUB", r.Nominal, r.CharCode, r.Value.StringFixed(4))
+		if f.change && r.Change != nil {
+			fmt.Fprintf(&b, "\t%10s %s %s", r.Change.Value.StringFixed(4), f.mark(r.Change.Diff),
+				signedString(r.Change.Diff, 4))
+			if r.Change.Percent != nil {
+				fmt.Fprintf(&b, " (%s%%)", signedString(*r.Change.Percent, changePercentPlaces))
+			}
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *tableFormatter) End(w io.Writer) error {
+	return nil
+}
+
+// Returns the mark of the change up or down.
+func (f *tableFormatter) mark(diff Decimal) string {
+	mark, color := "=", ""
+	switch diff.Sign() {
+	case 1:
+		mark, color = "▲", "\x1b[32m"
+	case -1:
+		mark, color = "▼", "\x1b[31m"
+	}
+	if !f.color || color == "" {
+		return mark
+	}
+	return color + mark + "\x1b[0m"
+}
+
+// 'jsonFormatter' writes an array of all the records.
+type jsonFormatter struct {
+	count int
+}
+
+func (f *jsonFormatter) Begin(w io.Writer) error {
+	_, err := io.WriteString(w, "[")
+	return err
+}
+
+func (f *jsonFormatter) WriteDay(w io.Writer, day *RateDay) error {
+	var b strings.Builder
+	for _, r := range day.Records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if f.count > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n  ")
+		b.Write(data)
+		f.count++
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *jsonFormatter) End(w io.Writer) error {
+	end := "\n]\n"
+	if f.count == 0 {
+		end = "]\n"
+	}
+	_, err := io.WriteString(w, end)
+	return err
+}
+
+// 'jsonlFormatter' writes a JSON object per line for every record.
+type jsonlFormatter struct{}
+
+func (f *jsonlFormatter) Begin(w io.Writer) error {
+	return nil
+}
+
+func (f *jsonlFormatter) WriteDay(w io.Writer, day *RateDay) error {
+	enc := json.NewEncoder(w)
+	for _, r := range day.Records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *jsonlFormatter) End(w io.Writer) error {
+	return nil
+}
+
+// 'csvFormatter' writes the records as CSV with a header line.
+type csvFormatter struct {
+	change bool
+}
+
+func (f *csvFormatter) Begin(w io.Writer) error {
+	names, _ := RateRecord{}.fields(f.change)
+	cw := csv.NewWriter(w)
+	cw.Write(names)
+	cw.Flush()
+	return cw.Error()
+}
+
+func (f *csvFormatter) WriteDay(w io.Writer, day *RateDay) error {
+	cw := csv.NewWriter(w)
+	for _, r := range day.Records {
+		_, values := r.fields(f.change)
+		cw.Write(values)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (f *csvFormatter) End(w io.Writer) error {
+	return nil
+}
+
+// 'markdownFormatter' writes a Markdown table of all the records.
+type markdownFormatter struct {
+	change bool
+}
+
+func (f *markdownFormatter) Begin(w io.Writer) error {
+	header := "| Date | Effective date | Num code | Char code | Name | Nominal | Value | Unit value |"
+	line := "|------|----------------|---------:|-----------|------|--------:|------:|-----------:|"
+	if f.change {
+		header += " Previous date | Previous value | Change | Change, % |"
+		line += "---------------|---------------:|-------:|----------:|"
+	}
+	_, err := io.WriteString(w, header+"\n"+line+"\n")
+	return err
+}
+
+func (f *markdownFormatter) WriteDay(w io.Writer, day *RateDay) error {
+	var b strings.Builder
+	for _, r := range day.Records {
+		_, values := r.fields(f.change)
+		for i, v := range values {
+			values[i] = strings.ReplaceAll(v, "|", `\|`)
+		}
+		b.WriteString("| " + strings.Join(values, " | ") + " |\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *markdownFormatter) End(w io.Writer) error {
+	return nil
+}
+
+// 'yamlFormatter' writes a YAML sequence of all the records. Strings are written
+// as JSON strings, which YAML reads as well, unknown values as nulls.
+type yamlFormatter struct {
+	change bool
+	count  int
+}
+
+func (f *yamlFormatter) Begin(w io.Writer) error {
+	return nil
+}
+
+func (f *yamlFormatter) WriteDay(w io.Writer, day *RateDay) error {
+	var b strings.Builder
+	for _, r := range day.Records {
+		names, values := r.fields(f.change)
+		for i, name := range names {
+			v := values[i]
+			switch {
+			case v == "":
+				v = "null"
+			case name == "date" || name == "effective_date" || name == "previous_date" ||
+				name == "char_code" || name == "name":
+				data, _ := json.Marshal(v)
+				v = string(data)
+			}
+			prefix := "  "
+			if i == 0 {
+				prefix = "- "
+			}
+			fmt.Fprintf(&b, "%s%s: %s\n", prefix, name, v)
+		}
+		f.count++
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *yamlFormatter) End(w io.Writer) error {
+	if f.count > 0 {
+		return nil
+	}
+	_, err := io.WriteString(w, "[]\n")
+	return err
+}
+
+// Returns the number with exactly the given number of digits after the decimal point
+// and a sign.
+func signedString(d Decimal, places int32) string {
+	if d.Round(places, RoundHalfEven).Sign() > 0 {
+		return "+" + d.StringFixed(places)
+	}
+	return d.StringFixed(places)
+}
+
+// Checks the file is a terminal which shows colors.
+func isColorTerminal(f *os.File) bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Checks the times are on the same date.
+func sameDate(a, b time.Time) bool {
+	return a.Format("2006-01-02") == b.Format("2006-01-02")
+}
+
+// 'ResultPrinter' writes the exchange rates with a formatter. The messages about failures
+// go to the same output for reading, otherwise to stderr, so that they don't break
+// the output for parsing. When the queries are expected, their rates and messages are
+// written in the order of the requested dates. All methods are safe for concurrent use.
+type ResultPrinter struct {
+	sync.Mutex
+	formatter Formatter
+	out, msg  io.Writer
+	begun     bool
+	order     RecordOrder
+	stream    bool               // write the dates as soon as they are ready
+	sequence  *OutputSequence    // nil if the queries aren't expected
+	previous  map[string]Decimal // the values of one unit on the last written date
+}
+
+// Creates a 'ResultPrinter' instance writing to stdout with the formatter.
+func newResultPrinter(formatter Formatter) *ResultPrinter {
+	msg := io.Writer(os.Stderr)
+	if _, ok := formatter.(*tableFormatter); ok {
+		msg = os.Stdout
+	}
+	return &ResultPrinter{formatter: formatter, out: os.Stdout, msg: msg}
+}
+
+// Sets the order of the records within a date.
+func (w *ResultPrinter) setOrder(order RecordOrder) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.order = order
+}
+
+// Sets the dates to be written as soon as they and the dates before them are ready,
+// otherwise all of them are written at the end.
+func (w *ResultPrinter) setStream(stream bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.stream = stream
+}
+
+// Sets the queries whose results are going to be printed, their dates are written in order.
+func (w *ResultPrinter) expect(queries []RateQuery) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.sequence = newOutputSequence(queries)
+}
+
+// Writes the beginning of the output unless it's written. The caller must hold the lock.
+func (w *ResultPrinter) begin() {
+	if w.begun {
+		return
+	}
+	w.begun = true
+	if err := w.formatter.Begin(w.out); err != nil {
+		logger.Error(fmt.Sprintf("failed to write the output: %v", err))
+	}
+}
+
+// Writes the rates of a date in the order of the records. The caller must hold the lock.
+func (w *ResultPrinter) writeDay(day *RateDay) {
+	w.begin()
+	previous := map[string]Decimal{}
+	for code, value := range w.previous {
+		previous[code] = value
+	}
+	for _, r := range day.Records {
+		if r.Change != nil && r.Nominal > 0 {
+			unit, err := r.Change.Value.Div(newDecimalFromInt(int64(r.Nominal)), unitValuePlaces, RoundHalfEven)
+			if err == nil {
+				previous[r.CharCode] = unit
+			}
+		}
+	}
+	w.order.sort(day.Records, previous)
+	if err := w.formatter.WriteDay(w.out, day); err != nil {
+		logger.Error(fmt.Sprintf("failed to write the output: %v", err))
+	}
+
+	w.previous = map[string]Decimal{}
+	for _, r := range day.Records {
+		w.previous[r.CharCode] = r.UnitValue
+	}
+}
+
+// Writes the ready dates of the sequence, all of them if 'all' is set. The caller must
+// hold the lock.
+func (w *ResultPrinter) flush(all bool) {
+	if w.sequence == nil {
+		return
+	}
+	for _, d := range w.sequence.ready(all) {
+		for _, m := range d.messages {
+			io.WriteString(w.msg, m)
+		}
+		if day := d.rateDay(); len(day.Records) > 0 {
+			w.writeDay(day)
+		}
+	}
+}
+
+// Writes the exchange rates answered by the query of the currencies enabled in the filter.
+func (w *ResultPrinter) print(query RateQuery, rates *DayRates, filter *CurrencyFilter) {
+	w.Lock()
+	defer w.Unlock()
+
+	day := newRateDay(rates, filter)
+	if w.sequence == nil || !w.sequence.add(query, day) {
+		w.writeDay(day)
+	}
+}
+
+// Writes a message about the query, for example a failure, before the rates of its
+// first date.
+func (w *ResultPrinter) report(query RateQuery, format string, args ...any) {
+	w.Lock()
+	defer w.Unlock()
+
+	msg := fmt.Sprintf(format, args...)
+	if w.sequence == nil || !w.sequence.report(query, msg) {
+		io.WriteString(w.msg, msg)
+	}
+}
+
+// Marks the query handled, its dates may be written then.
+func (w *ResultPrinter) done(query RateQuery) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.sequence == nil {
+		return
+	}
+	w.sequence.done(query)
+	if w.stream {
+		w.flush(false)
+	}
+}
+
+// Writes a message about the work.
+func (w *ResultPrinter) message(format string, args ...any) {
+	w.Lock()
+	defer w.Unlock()
+
+	fmt.Fprintf(w.msg, format, args...)
+}
+
+// Writes the dates left and the end of the output.
+func (w *ResultPrinter) finish() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.flush(true)
+	w.begin()
+	if err := w.formatter.End(w.out); err != nil {
+		logger.Error(fmt.Sprintf("failed to write the output: %v", err))
+	}
+}
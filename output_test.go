@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// Returns the rates on a date published a day before with a currency of 100 units.
+func newTestDayRates() *DayRates {
+	q := newExchRateQuery()
+	q.SetDate("11.03.2023")
+	effective, _ := parseDate("10.03.2023")
+	return &DayRates{Query: q, Effective: effective, Currencies: Currencies{
+		{NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar", Value: mustParseDecimal("75.5")},
+		{NumCode: 392, CharCode: "JPY", Nominal: 100, Name: "Japanese Yen", Value: mustParseDecimal("55.6012")},
+	}}
+}
+
+// Formats the test rates in the output format.
+func formatTestRates(t *testing.T, format string, days int) string {
+	formatter, err := newFormatter(format, false)
+	if err != nil {
+		t.Fatalf("failed to create the formatter: %v", err)
+	}
+	return writeTestRates(formatter, days)
+}
+
+// Writes the test rates with the formatter.
+func writeTestRates(formatter Formatter, days int) string {
+	var b bytes.Buffer
+	printer := &ResultPrinter{formatter: formatter, out: &b, msg: &b}
+	filter := newCurrencyFilter(newBuiltinCatalog())
+	for i := 0; i < days; i++ {
+		rates := newTestDayRates()
+		printer.print(rates.Query, rates, filter)
+	}
+	printer.finish()
+	return b.String()
+}
+
+func TestNewRateRecord(t *testing.T) {
+	rates := newTestDayRates()
+	r := newRateRecord(rates, rates.Currencies[1])
+	if r.UnitValue.String() != "0.556012" {
+		t.Fatalf("expected 0.556012 got %s", r.UnitValue)
+	}
+	if r.Date.Format("02.01.2006") != "11.03.2023" || r.Effective.Format("02.01.2006") != "10.03.2023" {
+		t.Fatalf("expected 11.03.2023 and 10.03.2023 got %v and %v", r.Date, r.Effective)
+	}
+}
+
+func TestFormatters(t *testing.T) {
+	tests := map[string]string{
+		outputTable: `
+Data on 11.03.2023 (rates of 10.03.2023)
+       1 USD	   75.5000 RUB
+     100 JPY	   55.6012 RUB
+`,
+		outputJSON: `[
+  {"date":"2023-03-11","effective_date":"2023-03-10","num_code":840,"char_code":"USD","name":"US Dollar","nominal":1,"value":75.5,"unit_value":75.5},
+  {"date":"2023-03-11","effective_date":"2023-03-10","num_code":392,"char_code":"JPY","name":"Japanese Yen","nominal":100,"value":55.6012,"unit_value":0.556012}
+]
+`,
+		outputJSONL: `{"date":"2023-03-11","effective_date":"2023-03-10","num_code":840,"char_code":"USD","name":"US Dollar","nominal":1,"value":75.5,"unit_value":75.5}
+{"date":"2023-03-11","effective_date":"2023-03-10","num_code":392,"char_code":"JPY","name":"Japanese Yen","nominal":100,"value":55.6012,"unit_value":0.556012}
+`,
+		outputCSV: `date,effective_date,num_code,char_code,name,nominal,value,unit_value
+2023-03-11,2023-03-10,840,USD,US Dollar,1,75.5,75.5
+2023-03-11,2023-03-10,392,JPY,Japanese Yen,100,55.6012,0.556012
+`,
+		outputMarkdown: `| Date | Effective date | Num code | Char code | Name | Nominal | Value | Unit value |
+|------|----------------|---------:|-----------|------|--------:|------:|-----------:|
+| 2023-03-11 | 2023-03-10 | 840 | USD | US Dollar | 1 | 75.5 | 75.5 |
+| 2023-03-11 | 2023-03-10 | 392 | JPY | Japanese Yen | 100 | 55.6012 | 0.556012 |
+`,
+		outputYAML: `- date: "2023-03-11"
+  effective_date: "2023-03-10"
+  num_code: 840
+  char_code: "USD"
+  name: "US Dollar"
+  nominal: 1
+  value: 75.5
+  unit_value: 75.5
+- date: "2023-03-11"
+  effective_date: "2023-03-10"
+  num_code: 392
+  char_code: "JPY"
+  name: "Japanese Yen"
+  nominal: 100
+  value: 55.6012
+  unit_value: 0.556012
+`,
+	}
+	for format, expected := range tests {
+		if got := formatTestRates(t, format, 1); got != expected {
+			t.Fatalf("%s: expected\n%s\ngot\n%s", format, expected, got)
+		}
+	}
+
+	// the output is valid without rates and with several dates
+	empty := map[string]string{outputJSON: "[]\n", outputYAML: "[]\n", outputJSONL: ""}
+	for format, expected := range empty {
+		if got := formatTestRates(t, format, 0); got != expected {
+			t.Fatalf("%s: expected %q got %q", format, expected, got)
+		}
+	}
+	var records []map[string]any
+	if err := json.Unmarshal([]byte(formatTestRates(t, outputJSON, 2)), &records); err != nil || len(records) != 4 {
+		t.Fatalf("expected 4 records got %d: %v", len(records), err)
+	}
+
+	if _, err := newFormatter("xml", false); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+}
+
+func TestFormattersChange(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+
+	rates := newTestDayRates()
+	previous := StoredRate{Currency: Currency{CharCode: "USD", Nominal: 1, Value: mustParseDecimal("76")}}
+	previous.Effective, _ = parseDate("09.03.2023")
+	// the change in percent of a zero value is unknown
+	zero := StoredRate{Currency: Currency{CharCode: "JPY", Nominal: 100, Value: mustParseDecimal("0")}}
+	zero.Effective = previous.Effective
+	rates.Previous = map[string]StoredRate{"USD": previous, "JPY": zero}
+
+	tests := map[string]string{
+		outputTable: `
+Data on 11.03.2023 (rates of 10.03.2023)
+       1 USD	   75.5000 RUB	   76.0000 ▼ -0.5000 (-0.66%)
+     100 JPY	   55.6012 RUB	    0.0000 ▲ +55.6012
+`,
+		outputCSV: `date,effective_date,num_code,char_code,name,nominal,value,unit_value,previous_date,previous_value,change,change_percent
+2023-03-11,2023-03-10,840,USD,US Dollar,1,75.5,75.5,2023-03-09,76,-0.5,-0.66
+2023-03-11,2023-03-10,392,JPY,Japanese Yen,100,55.6012,0.556012,2023-03-09,0,55.6012,
+`,
+		outputJSONL: `{"date":"2023-03-11","effective_date":"2023-03-10","num_code":840,"char_code":"USD","name":"US Dollar","nominal":1,"value":75.5,"unit_value":75.5,"previous_date":"2023-03-09","previous_value":76,"change":-0.5,"change_percent":-0.66}
+{"date":"2023-03-11","effective_date":"2023-03-10","num_code":392,"char_code":"JPY","name":"Japanese Yen","nominal":100,"value":55.6012,"unit_value":0.556012,"previous_date":"2023-03-09","previous_value":0,"change":55.6012}
+`,
+	}
+	for format, expected := range tests {
+		formatter, err := newFormatter(format, true)
+		if err != nil {
+			t.Fatalf("failed to create the formatter: %v", err)
+		}
+
+		var b bytes.Buffer
+		printer := &ResultPrinter{formatter: formatter, out: &b, msg: &b}
+		printer.print(rates.Query, rates, newCurrencyFilter(newBuiltinCatalog()))
+		printer.finish()
+		if b.String() != expected {
+			t.Fatalf("%s: expected\n%s\ngot\n%s", format, expected, b.String())
+		}
+	}
+
+	f := &tableFormatter{change: true, color: true}
+	if mark := f.mark(mustParseDecimal("0.1")); mark != "\x1b[32m▲\x1b[0m" {
+		t.Fatalf("expected a green mark got %q", mark)
+	}
+	if mark := f.mark(mustParseDecimal("0")); mark != "=" {
+		t.Fatalf("expected = got %q", mark)
+	}
+}
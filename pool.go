@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConcurrency = 3
+	defaultRate        = 2 // requests per second
+)
+
+// Result of a query handled by the worker pool.
+type QueryResult struct {
+	Query  RateQuery
+	Rates  []DayRates
+	Issues *ValidationError // violations found in the answer if they didn't fail the query
+	Stored bool             // the rates were read from the database
+	Fetch  *FetchRecord     // the request and its answer to archive, nil if there was no request
+	Err    error
+}
+
+// 'WorkerPool' handles queries on a fixed number of goroutines.
+type WorkerPool struct {
+	concurrency int
+}
+
+// Creates a 'WorkerPool' instance with the given number of workers.
+func newWorkerPool(concurrency int) *WorkerPool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &WorkerPool{concurrency: concurrency}
+}
+
+// Handles the queries and delivers the results in the order of the queries. The channel
+// is closed when all the results are delivered. Queries not started before the context
+// is done get its error as the result.
+func (p *WorkerPool) Run(ctx context.Context, queries []RateQuery,
+	handle func(context.Context, RateQuery) *QueryResult) <-chan *QueryResult {
+
+	type job struct {
+		query  RateQuery
+		result chan *QueryResult
+	}
+
+	jobs := make(chan job)
+	pending := make(chan chan *QueryResult, len(queries))
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for _, q := range queries {
+			j := job{query: q, result: make(chan *QueryResult, 1)}
+			pending <- j.result
+			jobs <- j
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := ctx.Err(); err != nil {
+					j.result <- &QueryResult{Query: j.query, Err: err}
+					continue
+				}
+				j.result <- handle(ctx, j.query)
+			}
+		}()
+	}
+
+	results := make(chan *QueryResult)
+	go func() {
+		defer close(results)
+		for r := range pending {
+			results <- <-r
+		}
+		wg.Wait()
+	}()
+
+	return results
+}
+
+// 'RateLimiter' spaces out events so that there are no more than the given number
+// of them per second. All methods are safe for concurrent use.
+type RateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// Creates a 'RateLimiter' instance, a non-positive rate means no limit.
+func newRateLimiter(perSecond float64) *RateLimiter {
+	l := &RateLimiter{}
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return l
+}
+
+// Blocks until the next event is allowed or the context is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil || l.interval == 0 {
+		return ctx.Err()
+	}
+
+	l.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
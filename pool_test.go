@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolOrder(t *testing.T) {
+	var queries []RateQuery
+	for i := 1; i <= 10; i++ {
+		q := newExchRateQuery()
+		q.SetTime(time.Date(2023, 3, i, 0, 0, 0, 0, time.UTC))
+		queries = append(queries, q)
+	}
+
+	var running, maxRunning int32
+	handle := func(ctx context.Context, q RateQuery) *QueryResult {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		// the earlier queries are the slower ones
+		day := q.(*ExchRateQuery).time.Day()
+		time.Sleep(time.Duration(11-day) * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return &QueryResult{Query: q}
+	}
+
+	i := 0
+	for r := range newWorkerPool(3).Run(context.Background(), queries, handle) {
+		if r.Query != queries[i] {
+			t.Fatalf("expected %s got %s", queries[i], r.Query)
+		}
+		i++
+	}
+	if i != len(queries) {
+		t.Fatalf("expected %d results got %d", len(queries), i)
+	}
+	if maxRunning > 3 {
+		t.Fatalf("expected at most 3 running workers got %d", maxRunning)
+	}
+}
+
+func TestWorkerPoolCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	queries := []RateQuery{newExchRateQuery(), newExchRateQuery()}
+	for r := range newWorkerPool(1).Run(ctx, queries, nil) {
+		if r.Err == nil {
+			t.Fatalf("expected an error got nil")
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatalf("got an error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("expected at least 40ms got %v", elapsed)
+	}
+
+	var unlimited *RateLimiter
+	if err := unlimited.Wait(context.Background()); err != nil {
+		t.Fatalf("got an error: %v", err)
+	}
+}
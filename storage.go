@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// URI schemes of the storage backends.
+const (
+	storeSqlite = "sqlite://"
+	storeJsonl  = "jsonl://"
+	storeMem    = "mem://"
+)
+
+// 'Storage' keeps the exchange rates, the archived fetches and the currency catalog.
+// Stored rates are never replaced, a changed rate is added as a new revision of it.
+// All methods are safe for concurrent use.
+type Storage interface {
+	// Returns the location of the storage.
+	String() string
+	// Prepares the storage for work.
+	Init(ctx context.Context) error
+	// Releases the resources of the storage.
+	Close() error
+
+	// Adds the exchange rates on the date enabled in the filter. Returns the number
+	// of the added revisions.
+	Add(ctx context.Context, rates *DayRates, filter *CurrencyFilter) (int, error)
+	// Archives the fetch. Returns the identifier of the fetch.
+	AddFetch(ctx context.Context, f *FetchRecord) (int64, error)
+	// Replaces the cached currency catalog.
+	SaveCatalog(ctx context.Context, catalog *CurrencyCatalog) error
+
+	// Makes the storage read the rates as they were recorded by the given time,
+	// a zero time means the current rates.
+	SetAsOf(t time.Time)
+	// Loads the exchange rates stored on the requested date. Returns nil if there are none.
+	LoadDay(ctx context.Context, query *ExchRateQuery) (*DayRates, error)
+	// Returns the exchange rate of the currency requested on the date or published for it.
+	// Returns 'errNoStoredRates' if there is no such rate.
+	GetRate(ctx context.Context, date time.Time, code string) (*StoredRate, error)
+	// Returns the latest exchange rate of the currency published for a date before the given
+	// one. Returns 'errNoStoredRates' if there is no such rate.
+	GetPreviousRate(ctx context.Context, before time.Time, code string) (*StoredRate, error)
+	// Returns the exchange rates of the currency requested on the dates from 'from'
+	// to 'to' inclusive, sorted by date.
+	GetSeries(ctx context.Context, code string, from, to time.Time) ([]StoredRate, error)
+	// Returns the latest requested date. Returns 'errNoStoredRates' if there are no rates.
+	LatestDate(ctx context.Context) (time.Time, error)
+	// Returns the requested dates, sorted.
+	ListDates(ctx context.Context) ([]time.Time, error)
+	// Returns the currencies sorted by code, names are taken from the latest rates.
+	ListCurrencies(ctx context.Context) ([]CurrencyInfo, error)
+	// Calls 'handle' for every archived fetch with an answer in the order they were made.
+	ForEachFetch(ctx context.Context, handle func(*FetchRecord) error) error
+	// Loads the cached currency catalog. The catalog is empty if it was never saved.
+	LoadCatalog(ctx context.Context) (*CurrencyCatalog, error)
+}
+
+var (
+	_ Storage = (*DbStorage)(nil)
+	_ Storage = (*JsonlStorage)(nil)
+	_ Storage = (*MemStorage)(nil)
+)
+
+// Creates the storage at the location: 'sqlite://' followed by the path of the database
+// file with optional SQLite options, 'jsonl://' followed by the path of a JSON Lines file,
+// or 'mem://'. A location without a scheme is an SQLite database as the flag '-s' takes.
+func newStorage(location string) (Storage, error) {
+	location = strings.TrimSpace(location)
+	switch {
+	case strings.HasPrefix(location, storeSqlite):
+		path := strings.TrimPrefix(location, storeSqlite)
+		if strings.Contains(path, "?") {
+			// the options are passed the way the driver takes them
+			path = "file:" + path
+		}
+		return newDbStorageAt(path)
+
+	case strings.HasPrefix(location, storeJsonl):
+		path, err := expandPath(strings.TrimPrefix(location, storeJsonl))
+		if err != nil {
+			return nil, err
+		}
+		return newJsonlStorage(path), nil
+
+	case location == storeMem:
+		return newMemStorage(), nil
+
+	case strings.Contains(location, "://"):
+		return nil, fmt.Errorf("unknown storage %q, the supported ones are %s, %s and %s",
+			location, storeSqlite, storeJsonl, storeMem)
+	}
+
+	return newDbStorageAt(location)
+}
+
+// Expands a leading '~' of the path to the home directory.
+func expandPath(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("the path is empty")
+	}
+
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to expand %q: %v", path, err)
+		}
+		path = filepath.Join(home, path[1:])
+	} else if strings.HasPrefix(path, "~") {
+		return "", fmt.Errorf("incorrect path %q: only '~' of the current user is supported", path)
+	}
+
+	return filepath.Clean(path), nil
+}
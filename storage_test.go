@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Checks the behavior shared by all storages.
+func testStorage(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to init %s: %v", storage, err)
+	}
+
+	if _, err := storage.LatestDate(ctx); !errors.Is(err, errNoStoredRates) {
+		t.Fatalf("expected %v got %v", errNoStoredRates, err)
+	}
+
+	filter := newCurrencyFilter(newBuiltinCatalog())
+	add := func(date, effective, usd, eur string) int {
+		q := newExchRateQuery()
+		q.SetDate(date)
+		dt, _ := parseDate(effective)
+		rates := &DayRates{Query: q, Effective: dt, Source: "test", Currencies: Currencies{
+			{NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar", Value: mustParseDecimal(usd)},
+			{NumCode: 978, CharCode: "EUR", Nominal: 1, Name: "Euro", Value: mustParseDecimal(eur)},
+		}}
+		added, err := storage.Add(ctx, rates, filter)
+		if err != nil {
+			t.Fatalf("failed to add rates to %s: %v", storage, err)
+		}
+		return added
+	}
+
+	if added := add("10.03.2023", "10.03.2023", "75.5", "79.9"); added != 2 {
+		t.Fatalf("expected 2 got %d", added)
+	}
+	add("12.03.2023", "11.03.2023", "75.6", "80.1")
+	if added := add("10.03.2023", "10.03.2023", "75.5", "79.9"); added != 0 {
+		t.Fatalf("expected 0 got %d", added)
+	}
+	before := time.Now()
+	if added := add("10.03.2023", "10.03.2023", "75.5", "80"); added != 1 {
+		t.Fatalf("expected 1 got %d", added)
+	}
+
+	query := newExchRateQuery()
+	query.SetDate("10.03.2023")
+	day, err := storage.LoadDay(ctx, query)
+	if err != nil || day == nil || len(day.Currencies) != 2 {
+		t.Fatalf("expected 2 rates got %v: %v", day, err)
+	}
+
+	date, _ := parseDate("11.03.2023")
+	rate, err := storage.GetRate(ctx, date, "EUR")
+	if err != nil || rate.Value.String() != "80.1" {
+		t.Fatalf("expected 80.1 got %v: %v", rate, err)
+	}
+	date, _ = parseDate("10.03.2023")
+	if rate, err = storage.GetRate(ctx, date, "EUR"); err != nil || rate.Value.String() != "80" {
+		t.Fatalf("expected 80 got %v: %v", rate, err)
+	}
+
+	storage.SetAsOf(before)
+	if rate, err = storage.GetRate(ctx, date, "EUR"); err != nil || rate.Value.String() != "79.9" {
+		t.Fatalf("expected 79.9 got %v: %v", rate, err)
+	}
+	storage.SetAsOf(time.Time{})
+
+	next, _ := parseDate("11.03.2023")
+	if rate, err = storage.GetPreviousRate(ctx, next, "EUR"); err != nil || rate.Value.String() != "80" {
+		t.Fatalf("expected 80 got %v: %v", rate, err)
+	}
+	if _, err = storage.GetPreviousRate(ctx, date, "EUR"); !errors.Is(err, errNoStoredRates) {
+		t.Fatalf("expected %v got %v", errNoStoredRates, err)
+	}
+
+	to, _ := parseDate("31.03.2023")
+	series, err := storage.GetSeries(ctx, "USD", date, to)
+	if err != nil || len(series) != 2 || series[1].Value.String() != "75.6" {
+		t.Fatalf("expected 2 rates got %v: %v", series, err)
+	}
+
+	latest, err := storage.LatestDate(ctx)
+	if err != nil || latest.Format("02.01.2006") != "12.03.2023" {
+		t.Fatalf("expected 12.03.2023 got %v: %v", latest, err)
+	}
+	dates, err := storage.ListDates(ctx)
+	if err != nil || len(dates) != 2 {
+		t.Fatalf("expected 2 dates got %v: %v", dates, err)
+	}
+	currencies, err := storage.ListCurrencies(ctx)
+	if err != nil || len(currencies) != 2 || currencies[0].CharCode != "EUR" {
+		t.Fatalf("expected EUR and USD got %v: %v", currencies, err)
+	}
+
+	fetch := newFetchRecord(query, time.Date(2023, 3, 10, 12, 0, 0, 0, time.UTC), []byte(fetchTestAnswer))
+	fetch.Status = 200
+	id, err := storage.AddFetch(ctx, fetch)
+	if err != nil || id == 0 {
+		t.Fatalf("failed to archive the fetch in %s: %v", storage, err)
+	}
+	fetches := 0
+	err = storage.ForEachFetch(ctx, func(f *FetchRecord) error {
+		if f.ID != id || string(f.Payload) != fetchTestAnswer {
+			t.Fatalf("expected fetch %d got %d", id, f.ID)
+		}
+		fetches++
+		return nil
+	})
+	if err != nil || fetches != 1 {
+		t.Fatalf("expected 1 fetch got %d: %v", fetches, err)
+	}
+
+	catalog := newCurrencyCatalog([]CurrencyInfo{{ID: "R01235", NumCode: 840, CharCode: "USD", Name: "US Dollar"}})
+	if err = storage.SaveCatalog(ctx, catalog); err != nil {
+		t.Fatalf("failed to save the catalog in %s: %v", storage, err)
+	}
+	loaded, err := storage.LoadCatalog(ctx)
+	if err != nil || !reflect.DeepEqual(loaded.Items(), catalog.Items()) {
+		t.Fatalf("expected %v got %v: %v", catalog.Items(), loaded, err)
+	}
+	if age := time.Since(loaded.SavedAt()); age < 0 || age > time.Minute {
+		t.Fatalf("expected the catalog saved just now in %s got %v", storage, loaded.SavedAt())
+	}
+}
+
+func TestStorages(t *testing.T) {
+	dir := t.TempDir()
+
+	db := newDbStorage(filepath.Join(dir, "rates.db"))
+	defer db.Close()
+	testStorage(t, db)
+
+	jsonl := newJsonlStorage(filepath.Join(dir, "rates.jsonl"))
+	defer jsonl.Close()
+	testStorage(t, jsonl)
+
+	testStorage(t, newMemStorage())
+}
+
+func TestJsonlStorageReload(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "data", "rates.jsonl")
+
+	storage := newJsonlStorage(path)
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+	q := newExchRateQuery()
+	q.SetDate("10.03.2023")
+	rates := &DayRates{Query: q, Effective: q.time, Currencies: Currencies{
+		{NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar", Value: mustParseDecimal("75.5")},
+	}}
+	if _, err := storage.Add(ctx, rates, newCurrencyFilter(newBuiltinCatalog())); err != nil {
+		t.Fatalf("failed to add rates: %v", err)
+	}
+	if _, err := storage.AddFetch(ctx, newFetchRecord(q, time.Now(), []byte(fetchTestAnswer))); err != nil {
+		t.Fatalf("failed to archive the fetch: %v", err)
+	}
+	storage.Close()
+
+	// an interrupted write leaves an incomplete line
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"kind":"rate","rate":{"date":"2023-03`)
+	f.Close()
+
+	storage = newJsonlStorage(path)
+	defer storage.Close()
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	rate, err := storage.GetRate(ctx, q.time, "USD")
+	if err != nil || rate.Value.String() != "75.5" {
+		t.Fatalf("expected 75.5 got %v: %v", rate, err)
+	}
+	id, err := storage.AddFetch(ctx, newFetchRecord(q, time.Now(), nil))
+	if err != nil || id != 2 {
+		t.Fatalf("expected fetch 2 got %d: %v", id, err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 {
+		t.Fatalf("expected 3 lines got %d", len(lines))
+	}
+	storage.Close()
+
+	// a complete last line without the line end is kept
+	os.WriteFile(path, bytes.TrimSuffix(data, []byte("\n")), 0644)
+	storage = newJsonlStorage(path)
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if id, err = storage.AddFetch(ctx, newFetchRecord(q, time.Now(), nil)); err != nil || id != 3 {
+		t.Fatalf("expected fetch 3 got %d: %v", id, err)
+	}
+	data, _ = os.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 4 {
+		t.Fatalf("expected 4 lines got %d", len(lines))
+	}
+
+	// the memory isn't changed if the file isn't written
+	storage.file.Close()
+	rates.Query.SetDate("11.03.2023")
+	if _, err = storage.Add(ctx, rates, newCurrencyFilter(newBuiltinCatalog())); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+	if _, err = storage.GetRate(ctx, rates.Query.LatestDate(), "USD"); !errors.Is(err, errNoStoredRates) {
+		t.Fatalf("expected %v got %v", errNoStoredRates, err)
+	}
+	if _, err = storage.AddFetch(ctx, newFetchRecord(q, time.Now(), nil)); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+	if len(storage.fetches) != 3 {
+		t.Fatalf("expected 3 fetches got %d", len(storage.fetches))
+	}
+}
+
+func TestNewStorage(t *testing.T) {
+	tests := map[string]string{
+		"rates.db":                         "*main.DbStorage rates.db",
+		"sqlite://rates.db":                "*main.DbStorage rates.db",
+		"sqlite:///var/lib/cbr.db?mode=ro": "*main.DbStorage /var/lib/cbr.db",
+		"jsonl://data/rates.jsonl":         "*main.JsonlStorage data/rates.jsonl",
+		"mem://":                           "*main.MemStorage mem://",
+	}
+	for location, expected := range tests {
+		storage, err := newStorage(location)
+		if err != nil {
+			t.Fatalf("failed to create %q: %v", location, err)
+		}
+		if got := reflect.TypeOf(storage).String() + " " + storage.String(); got != expected {
+			t.Fatalf("expected %q got %q", expected, got)
+		}
+	}
+
+	for _, location := range []string{"", "redis://localhost", "jsonl://"} {
+		if _, err := newStorage(location); err == nil {
+			t.Fatalf("expected an error for %q got nil", location)
+		}
+	}
+}
+
+func TestJsonlStorageCatalogReload(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "rates.jsonl")
+
+	storage := newJsonlStorage(path)
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+	catalog := newCurrencyCatalog([]CurrencyInfo{{ID: "R01235", NumCode: 840, CharCode: "USD", Name: "US Dollar"}})
+	if err := storage.SaveCatalog(ctx, catalog); err != nil {
+		t.Fatalf("failed to save the catalog: %v", err)
+	}
+	saved, _ := storage.LoadCatalog(ctx)
+	storage.Close()
+
+	// the catalog keeps the time it was saved
+	storage = newJsonlStorage(path)
+	defer storage.Close()
+	if err := storage.Init(ctx); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	loaded, err := storage.LoadCatalog(ctx)
+	if err != nil || !loaded.CodeExists("USD") || !loaded.SavedAt().Equal(saved.SavedAt().Truncate(time.Microsecond)) {
+		t.Fatalf("expected the catalog saved at %v got %v: %v", saved.SavedAt(), loaded.SavedAt(), err)
+	}
+}
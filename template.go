@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Data of a report template.
+type RateReport struct {
+	Days    []*RateDay
+	Records []RateRecord // the records of all the days
+}
+
+// 'recordTemplateFormatter' executes a template for every record and ends every result
+// with a new line.
+type recordTemplateFormatter struct {
+	tmpl *template.Template
+}
+
+// Creates a formatter executing the template text for every record.
+func newRecordTemplateFormatter(text string) (*recordTemplateFormatter, error) {
+	tmpl, err := template.New("format").Funcs(templateFuncs()).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("format template is incorrect: %v", err)
+	}
+	return &recordTemplateFormatter{tmpl: tmpl}, nil
+}
+
+func (f *recordTemplateFormatter) Begin(w io.Writer) error {
+	return nil
+}
+
+func (f *recordTemplateFormatter) WriteDay(w io.Writer, day *RateDay) error {
+	var b strings.Builder
+	for _, r := range day.Records {
+		if err := f.tmpl.Execute(&b, r); err != nil {
+			return err
+		}
+		if !strings.HasSuffix(b.String(), "\n") {
+			b.WriteString("\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *recordTemplateFormatter) End(w io.Writer) error {
+	return nil
+}
+
+// 'reportTemplateFormatter' collects all the days and executes a template once for
+// the whole report.
+type reportTemplateFormatter struct {
+	tmpl   *template.Template
+	report RateReport
+}
+
+// Creates a formatter executing the template from the file for the whole report.
+func newReportTemplateFormatter(path string) (*reportTemplateFormatter, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the template file: %v", err)
+	}
+	tmpl, err := template.New(path).Funcs(templateFuncs()).Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("template file %q is incorrect: %v", path, err)
+	}
+	return &reportTemplateFormatter{tmpl: tmpl, report: RateReport{Days: []*RateDay{}, Records: []RateRecord{}}}, nil
+}
+
+func (f *reportTemplateFormatter) Begin(w io.Writer) error {
+	return nil
+}
+
+func (f *reportTemplateFormatter) WriteDay(w io.Writer, day *RateDay) error {
+	f.report.Days = append(f.report.Days, day)
+	f.report.Records = append(f.report.Records, day.Records...)
+	return nil
+}
+
+func (f *reportTemplateFormatter) End(w io.Writer) error {
+	var b strings.Builder
+	if err := f.tmpl.Execute(&b, f.report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Returns the functions available in the templates:
+//
+//	fixed N x       the number with exactly N digits after the decimal point
+//	round N x       the number rounded half to even to N digits
+//	roundUp N x     the number rounded half up to N digits
+//	comma x         the number with a decimal comma
+//	date LAYOUT t   the date in the Go layout, for example "2006-01-02"
+//	padLeft N s     the string padded with spaces on the left to N characters
+//	padRight N s    the string padded with spaces on the right to N characters
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"fixed": func(places int, d Decimal) (string, error) {
+			if err := checkTemplatePlaces(places); err != nil {
+				return "", err
+			}
+			return d.StringFixed(int32(places)), nil
+		},
+		"round": func(places int, d Decimal) (Decimal, error) {
+			if err := checkTemplatePlaces(places); err != nil {
+				return Decimal{}, err
+			}
+			return d.Round(int32(places), RoundHalfEven), nil
+		},
+		"roundUp": func(places int, d Decimal) (Decimal, error) {
+			if err := checkTemplatePlaces(places); err != nil {
+				return Decimal{}, err
+			}
+			return d.Round(int32(places), RoundHalfUp), nil
+		},
+		"comma": func(v any) string {
+			return strings.Replace(fmt.Sprint(v), ".", ",", 1)
+		},
+		"date": func(layout string, v any) (string, error) {
+			switch t := v.(type) {
+			case RateDate:
+				return t.Format(layout), nil
+			case time.Time:
+				return t.Format(layout), nil
+			}
+			return "", fmt.Errorf("%v isn't a date", v)
+		},
+		"padLeft": func(width int, v any) string {
+			return fmt.Sprintf("%*s", width, fmt.Sprint(v))
+		},
+		"padRight": func(width int, v any) string {
+			return fmt.Sprintf("%-*s", width, fmt.Sprint(v))
+		},
+	}
+}
+
+// Checks the number of digits after the decimal point passed to a template function.
+func checkTemplatePlaces(places int) error {
+	if places < 0 || places > maxDecimalScale {
+		return fmt.Errorf("number of decimal places %d isn't between 0 and %d", places, maxDecimalScale)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestRecordTemplateFormatter(t *testing.T) {
+	tests := map[string]string{
+		`{{.Date}};{{.CharCode}};{{.Value}}`: "11.03.2023;USD;75.5\n11.03.2023;JPY;55.6012\n",
+		`{{date "2006-01-02" .Effective}} {{.CharCode}} {{.UnitValue | round 2 | comma}}`: "" +
+			"2023-03-10 USD 75,5\n2023-03-10 JPY 0,56\n",
+		`{{.CharCode | padRight 4}}|{{.Value | fixed 2 | padLeft 7}}`: "" +
+			"USD |  75.50\nJPY |  55.60\n",
+		`{{.Value | roundUp 3}}` + "\n": "75.5\n55.601\n",
+	}
+	for text, expected := range tests {
+		formatter, err := newRecordTemplateFormatter(text)
+		if err != nil {
+			t.Fatalf("failed to create the formatter: %v", err)
+		}
+		if s := writeTestRates(formatter, 1); s != expected {
+			t.Fatalf("%s: expected %q got %q", text, expected, s)
+		}
+	}
+
+	if _, err := newRecordTemplateFormatter(`{{.Date`); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+	formatter, _ := newRecordTemplateFormatter(`{{date "2006" .Value}}`)
+	if s := writeTestRates(formatter, 1); s != "" {
+		t.Fatalf("expected empty output got %q", s)
+	}
+
+	rates := newTestDayRates()
+	day := &RateDay{Records: []RateRecord{newRateRecord(rates, rates.Currencies[0])}}
+	for _, text := range []string{`{{.Value | fixed -1}}`, `{{.Value | round 19}}`, `{{.Value | roundUp -2}}`} {
+		formatter, _ = newRecordTemplateFormatter(text)
+		if err := formatter.WriteDay(io.Discard, day); err == nil {
+			t.Fatalf("%s: expected an error got nil", text)
+		}
+	}
+}
+
+func TestReportTemplateFormatter(t *testing.T) {
+	const name = "test_report.tmpl"
+	defer os.Remove(name)
+
+	text := `{{len .Records}} rates
+{{range .Days}}{{.Date}}:{{range .Records}} {{.CharCode}}={{.Value | fixed 2}}{{end}}
+{{end}}`
+	if err := os.WriteFile(name, []byte(text), 0o644); err != nil {
+		t.Fatalf("failed to write the template: %v", err)
+	}
+
+	formatter, err := newReportTemplateFormatter(name)
+	if err != nil {
+		t.Fatalf("failed to create the formatter: %v", err)
+	}
+	expected := "4 rates\n11.03.2023: USD=75.50 JPY=55.60\n11.03.2023: USD=75.50 JPY=55.60\n"
+	if s := writeTestRates(formatter, 2); s != expected {
+		t.Fatalf("expected %q got %q", expected, s)
+	}
+
+	if _, err = newReportTemplateFormatter("test_missing.tmpl"); err == nil {
+		t.Fatalf("expected an error got nil")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CBR answers with a plain text error when the request parameters are incorrect.
+var errCbrParameters = errors.New("CBR rejected the request parameters")
+
+// Violation found in a decoded answer.
+type ValidationIssue struct {
+	Date     string // the requested date, empty for the whole answer
+	Index    int    // position of the currency on the date, -1 for the whole date
+	CharCode string
+	Message  string
+}
+
+func (i ValidationIssue) String() string {
+	var s strings.Builder
+	if i.Date != "" {
+		s.WriteString(i.Date)
+		s.WriteString(" ")
+	}
+	if i.Index >= 0 {
+		fmt.Fprintf(&s, "#%d %s ", i.Index+1, i.CharCode)
+	}
+	s.WriteString(i.Message)
+	return s.String()
+}
+
+// 'ValidationError' holds all violations found in an answer.
+type ValidationError struct {
+	Issues []ValidationIssue
+}
+
+func (e *ValidationError) Error() string {
+	issues := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		issues[i] = issue.String()
+	}
+	return fmt.Sprintf("%d validation issues: %s", len(e.Issues), strings.Join(issues, "; "))
+}
+
+// 'RatesValidator' checks the decoded exchange rates. In the strict mode any violation
+// fails the query, otherwise violations are only reported.
+type RatesValidator struct {
+	catalog *CurrencyCatalog
+	strict  bool
+}
+
+// Creates a 'RatesValidator' instance checking currency codes against the catalog.
+func newRatesValidator(catalog *CurrencyCatalog, strict bool) *RatesValidator {
+	return &RatesValidator{
+		catalog: catalog,
+		strict:  strict,
+	}
+}
+
+func (v *RatesValidator) IsStrict() bool {
+	return v.strict
+}
+
+// Checks the exchange rates decoded from one answer. Returns nil if there are no violations.
+func (v *RatesValidator) Validate(rates []DayRates) *ValidationError {
+	issues := []ValidationIssue{}
+	if len(rates) == 0 {
+		issues = append(issues, ValidationIssue{Index: -1, Message: "the answer contains no exchange rates"})
+	}
+
+	for _, r := range rates {
+		date := r.Query.Date("02.01.2006")
+		issue := func(i int, code, format string, args ...any) {
+			issues = append(issues, ValidationIssue{
+				Date:     date,
+				Index:    i,
+				CharCode: code,
+				Message:  fmt.Sprintf(format, args...),
+			})
+		}
+
+		if _, err := parseCbrDate(r.RawDate); err != nil {
+			issue(-1, "", "the rate date %q can't be parsed", r.RawDate)
+		}
+		if len(r.Currencies) == 0 {
+			issue(-1, "", "no exchange rates on the date")
+		}
+
+		codes := map[string]bool{}
+		nums := map[int]bool{}
+		for i, c := range r.Currencies {
+			if c.NumCode < 1 || c.NumCode > 999 {
+				issue(i, c.CharCode, "numeric code %d isn't a 3-digit code", c.NumCode)
+			}
+			if !v.catalog.CodeExists(c.CharCode) {
+				issue(i, c.CharCode, "unknown char code %q", c.CharCode)
+			}
+			if c.Nominal <= 0 {
+				issue(i, c.CharCode, "nominal %d isn't positive", c.Nominal)
+			}
+			if c.Value.Sign() <= 0 {
+				issue(i, c.CharCode, "value %s isn't positive", c.Value)
+			}
+
+			if codes[c.CharCode] {
+				issue(i, c.CharCode, "duplicate char code %q", c.CharCode)
+			}
+			codes[c.CharCode] = true
+			if nums[c.NumCode] {
+				issue(i, c.CharCode, "duplicate numeric code %d", c.NumCode)
+			}
+			nums[c.NumCode] = true
+		}
+	}
+
+	if len(issues) == 0 {
+		return nil
+	}
+	return &ValidationError{Issues: issues}
+}
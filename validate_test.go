@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRatesValidator(t *testing.T) {
+	v := newRatesValidator(newBuiltinCatalog(), true)
+	if !v.IsStrict() {
+		t.Fatalf("expected a strict validator")
+	}
+
+	q := newExchRateQuery()
+	q.SetDate("20.01.2007")
+	rates := []DayRates{{
+		Query:   q,
+		RawDate: "20.01.2007",
+		Currencies: Currencies{
+			{NumCode: 840, CharCode: "USD", Nominal: 1, Name: "US Dollar", Value: mustParseDecimal("26.5075")},
+			{NumCode: 978, CharCode: "EUR", Nominal: 1, Name: "Euro", Value: mustParseDecimal("34.4173")},
+		},
+	}}
+	if err := v.Validate(rates); err != nil {
+		t.Fatalf("expected no issues got %v", err)
+	}
+
+	rates[0].RawDate = "2007-01-20"
+	rates[0].Currencies = append(rates[0].Currencies,
+		Currency{NumCode: 1840, CharCode: "USD", Nominal: 0, Name: "US Dollar", Value: Decimal{}},
+		Currency{NumCode: 974, CharCode: "BYX", Nominal: 1000, Name: "Belarussian Ruble", Value: mustParseDecimal("12.3701")},
+	)
+	err := v.Validate(rates)
+	if err == nil {
+		t.Fatalf("expected issues got nil")
+	}
+	// the date, the numeric code, the nominal, the value, the duplicate char code, the unknown char code
+	if len(err.Issues) != 6 {
+		t.Fatalf("expected 6 issues got %d: %v", len(err.Issues), err)
+	}
+	if err.Issues[1].Index != 2 || err.Issues[1].CharCode != "USD" {
+		t.Fatalf("expected the issue of the 3rd currency got %v", err.Issues[1])
+	}
+	if !strings.Contains(err.Error(), "#4 BYX unknown char code") {
+		t.Fatalf("expected the unknown code reported got %v", err)
+	}
+
+	if err = v.Validate([]DayRates{}); err == nil || len(err.Issues) != 1 {
+		t.Fatalf("expected an issue for an empty answer got %v", err)
+	}
+	if err = v.Validate([]DayRates{{Query: q, RawDate: "20.01.2007"}}); err == nil || len(err.Issues) != 1 {
+		t.Fatalf("expected an issue for an empty date got %v", err)
+	}
+}